@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"imagecrop/cropper"
+	"os"
+	"sync"
+)
+
+// analysisLine is one file's line of --analyze-only output
+type analysisLine struct {
+	File string `json:"file"`
+	*cropper.Analysis
+	Error string `json:"error,omitempty"`
+}
+
+// runAnalyze analyzes every job without writing images and prints one JSON
+// line per file, in discovery order. It returns the number of failures.
+func runAnalyze(jobs []job, threads int) int {
+	lines := analyzeJobs(jobs, threads)
+
+	enc := json.NewEncoder(os.Stdout)
+	errorCount := 0
+	for _, line := range lines {
+		if line.Error != "" {
+			errorCount++
+		}
+		if err := enc.Encode(line); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing analysis: %v\n", err)
+			return errorCount + 1
+		}
+	}
+	return errorCount
+}
+
+// runEmitGeometry analyzes every job without writing images and prints one
+// line per file, in discovery order, with the file name and the crop as an
+// ImageMagick geometry string. Failures go to stderr; it returns their number.
+func runEmitGeometry(jobs []job, threads int) int {
+	errorCount := 0
+	for _, line := range analyzeJobs(jobs, threads) {
+		if line.Error != "" {
+			fmt.Fprintf(os.Stderr, "Error: %s: %s\n", line.File, line.Error)
+			errorCount++
+			continue
+		}
+		fmt.Printf("%s %s\n", line.File, line.Geometry)
+	}
+	return errorCount
+}
+
+// analyzeJobs analyzes every job on threads goroutines and returns the
+// results indexed like jobs
+func analyzeJobs(jobs []job, threads int) []analysisLine {
+	lines := make([]analysisLine, len(jobs))
+
+	jobChan := make(chan job, len(jobs))
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobChan {
+				analysis, err := cropper.AnalyzeImage(j.inputPath, j.opts)
+				line := analysisLine{File: j.inputPath, Analysis: analysis}
+				if err != nil {
+					line.Error = err.Error()
+				}
+				lines[j.index] = line
+			}
+		}()
+	}
+
+	for _, j := range jobs {
+		jobChan <- j
+	}
+	close(jobChan)
+	wg.Wait()
+	return lines
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"imagecrop/cropper"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveConfig holds the settings of an --input-archive run
+type archiveConfig struct {
+	archivePath    string
+	outputDir      string
+	outputArchive  string          // new zip to write, replaces outputDir when set
+	maskDir        string          // per-image masks matched by base name
+	extensions     map[string]bool // entry extensions to process
+	template       outputTemplate
+	trustExtension bool // keep entry extensions that do not match the content
+	threads        int
+	reportPath     string
+	statsPath      string
+	summaryOnly    bool // print nothing per file
+	ordered        bool
+	failFast       bool
+}
+
+// archiveRun is the outcome of runArchive
+type archiveRun struct {
+	results      []result // in completion order
+	total        int      // image entries found
+	skipped      int      // non-image entries
+	firstFailure *result  // set when failFast stopped the run
+}
+
+// archiveOutput is a processed archive entry waiting to be written
+type archiveOutput struct {
+	result
+	data     []byte
+	modified time.Time
+}
+
+// runArchiveInput processes --input-archive and prints the same summary as
+// directory input. It returns the exit status of the run.
+func runArchiveInput(cfg archiveConfig, opts cropper.CropOptions) int {
+	if cfg.outputArchive == "" {
+		if err := os.MkdirAll(cfg.outputDir, 0755); err != nil {
+			fmt.Printf("Error creating output directory: %v\n", err)
+			return 1
+		}
+	}
+
+	run, err := runArchive(cfg, opts)
+	results := run.results
+	if err != nil {
+		fmt.Printf("Error processing archive: %v\n", err)
+		return 1
+	}
+
+	if cfg.reportPath != "" {
+		if err := writeReport(cfg.reportPath, reportEntries(results)); err != nil {
+			fmt.Printf("Error writing report: %v\n", err)
+		}
+	}
+	if cfg.statsPath != "" {
+		if err := writeStats(cfg.statsPath, results); err != nil {
+			fmt.Printf("Error writing stats: %v\n", err)
+		}
+	}
+
+	var processed, cropped, corrected, errors, mislabeled int
+	for _, r := range results {
+		if r.mislabeled {
+			mislabeled++
+		}
+		switch {
+		case !r.success:
+			errors++
+		case r.wasCropped:
+			processed++
+			cropped++
+		case r.corrected:
+			processed++
+			corrected++
+		default:
+			processed++
+		}
+	}
+
+	fmt.Printf("\nProcessing complete!\n")
+	fmt.Printf("Successfully processed: %d files\n", processed)
+	fmt.Printf("  Cropped: %d files\n", cropped)
+	if corrected > 0 {
+		fmt.Printf("  Corrected: %d files\n", corrected)
+	}
+	fmt.Printf("  Unchanged: %d files\n", processed-cropped-corrected)
+	if run.skipped > 0 {
+		fmt.Printf("Skipped: %d non-image files\n", run.skipped)
+	}
+	if mislabeled > 0 {
+		fmt.Printf("Mislabeled: %d files whose extension does not match their content\n", mislabeled)
+	}
+	if errors > 0 {
+		fmt.Printf("Errors encountered: %d files\n", errors)
+	}
+
+	if run.firstFailure != nil {
+		fmt.Printf("\nStopped after %s failed (--fail-fast), %d files not processed\n", run.firstFailure.filename, run.total-len(results))
+		return 1
+	}
+	return 0
+}
+
+// runArchive crops every image entry of a zip archive in memory. Outputs go
+// to the output archive when set and to the output directory otherwise,
+// keeping the entry's directory inside the archive. Progress is printed like
+// directory input, with each entry announced when a worker starts it; with
+// failFast the first failure stops handing out entries, and those already
+// being cropped still finish and are written.
+func runArchive(cfg archiveConfig, opts cropper.CropOptions) (archiveRun, error) {
+	var run archiveRun
+	archive, err := zip.OpenReader(cfg.archivePath)
+	if err != nil {
+		return run, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer archive.Close()
+
+	// Collect image entries, skipping directories and non-image files
+	var entries []*zip.File
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		ext := strings.ToLower(path.Ext(f.Name))
+		if !cfg.extensions[ext] {
+			run.skipped++
+			continue
+		}
+		entries = append(entries, f)
+	}
+	run.total = len(entries)
+
+	var zipWriter *zip.Writer
+	if cfg.outputArchive != "" {
+		outFile, err := os.Create(cfg.outputArchive)
+		if err != nil {
+			return run, fmt.Errorf("failed to create output archive: %w", err)
+		}
+		defer outFile.Close()
+		zipWriter = zip.NewWriter(outFile)
+	}
+
+	fmt.Printf("Found %d images in %s using %d threads...\n\n", len(entries), filepath.Base(cfg.archivePath), cfg.threads)
+
+	// Entries are handed out one at a time, so none is started once a
+	// failure canceled ctx; every entry handed out is finished
+	out := newPrinter(cfg.ordered)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	indexChan := make(chan int)
+	go func() {
+		defer close(indexChan)
+		for i := range entries {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case indexChan <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Workers crop entries concurrently, outputs are written from this
+	// goroutine because zip.Writer is not safe for concurrent use
+	outputChan := make(chan archiveOutput, cfg.threads)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexChan {
+				if !cfg.summaryOnly {
+					out.printf(index, "Processing: %s\n", entries[index].Name)
+				}
+				outputChan <- cropArchiveEntry(index, entries[index], cfg, opts)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(outputChan)
+	}()
+
+	for o := range outputChan {
+		if o.success {
+			outputPath, err := writeArchiveOutput(zipWriter, cfg.outputDir, opts.PreserveMTime, o)
+			if err != nil {
+				o.success = false
+				o.message = err.Error()
+			}
+			o.outputPath = outputPath
+		}
+
+		if o.success {
+			if !cfg.summaryOnly {
+				out.printf(o.index, "  %s -> %s\n", o.message, path.Base(o.outputPath))
+			}
+		} else {
+			out.printf(o.index, "  Error processing %s: %s\n", o.filename, o.message)
+			if cfg.failFast && run.firstFailure == nil {
+				failed := o.result
+				run.firstFailure = &failed
+				cancel()
+			}
+		}
+		out.done(o.index)
+		run.results = append(run.results, o.result)
+	}
+
+	if zipWriter != nil {
+		if err := zipWriter.Close(); err != nil {
+			return run, fmt.Errorf("failed to finish output archive: %w", err)
+		}
+	}
+	return run, nil
+}
+
+// cropArchiveEntry buffers one entry, since zip readers cannot seek, and crops
+// it in memory
+func cropArchiveEntry(index int, f *zip.File, cfg archiveConfig, opts cropper.CropOptions) archiveOutput {
+	o := archiveOutput{result: result{
+		index:     index,
+		filename:  f.Name,
+		inputPath: f.Name,
+	}}
+
+	rc, err := f.Open()
+	if err != nil {
+		o.message = fmt.Sprintf("failed to open entry: %v", err)
+		return o
+	}
+	input, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		o.message = fmt.Sprintf("failed to read entry: %v", err)
+		return o
+	}
+
+	if cfg.maskDir != "" {
+		opts.MaskPath = findMask(cfg.maskDir, path.Base(f.Name))
+	}
+
+	var buf bytes.Buffer
+	cropResult, err := cropper.CropImageStream(bytes.NewReader(input), &buf, f.Name, opts)
+	if err != nil {
+		o.message = err.Error()
+		return o
+	}
+
+	// Same naming as directory input, inside the entry's directory
+	name := path.Base(f.Name)
+	if !cfg.trustExtension {
+		name = cropper.CorrectExtension(name, cropResult.Format)
+	}
+	if opts.BackgroundKey != nil {
+		name = cropper.CorrectExtension(name, "png")
+	}
+	name = cfg.template.expand(name, cropResult, cropResult.CropRect.Size(), time.Now())
+	o.outputPath = path.Join(path.Dir(f.Name), name)
+	o.success = true
+	o.wasCropped = cropResult.WasCropped
+	o.corrected = cropResult.Corrected
+	o.message = cropResult.Message
+	o.unchangedReason = cropResult.UnchangedReason
+	o.originalSize = cropResult.OriginalSize
+	o.cropRect = cropResult.CropRect
+	o.confidence = cropResult.Confidence
+	o.tolerance = cropResult.Tolerance
+	o.stopCondition = cropResult.StopCondition
+	o.stats = cropResult.Stats
+	o.mislabeled = cropper.ExtensionMismatch(f.Name, cropResult.Format)
+	o.data = buf.Bytes()
+	o.modified = f.Modified
+	return o
+}
+
+// writeArchiveOutput stores a processed entry in the output archive, or below
+// outputDir when there is none, and returns where it ended up. Zip entries
+// always keep the source entry's time, files only with preserveMTime.
+func writeArchiveOutput(zipWriter *zip.Writer, outputDir string, preserveMTime bool, o archiveOutput) (string, error) {
+	if zipWriter != nil {
+		// Images are already compressed, deflating them again gains nothing
+		w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: o.outputPath, Method: zip.Store, Modified: o.modified})
+		if err != nil {
+			return "", fmt.Errorf("failed to add %s to output archive: %w", o.outputPath, err)
+		}
+		if _, err := w.Write(o.data); err != nil {
+			return "", fmt.Errorf("failed to write %s to output archive: %w", o.outputPath, err)
+		}
+		return o.outputPath, nil
+	}
+
+	// Entry names come from the archive, refuse any that would escape outputDir
+	local := filepath.FromSlash(o.outputPath)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("refusing to write entry outside the output directory: %s", o.outputPath)
+	}
+	outputPath := filepath.Join(outputDir, local)
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := os.WriteFile(outputPath, o.data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write output file: %w", err)
+	}
+	if preserveMTime {
+		if err := os.Chtimes(outputPath, o.modified, o.modified); err != nil {
+			return "", fmt.Errorf("failed to set output modification time: %w", err)
+		}
+	}
+	return outputPath, nil
+}
@@ -0,0 +1,104 @@
+package cropper
+
+import (
+	"image"
+)
+
+// adjustCropRect applies the post-processing steps requested in opts to the
+// rectangle found by analysis. It returns the unchanged reason, replaced when
+// an adjustment discards the crop, and notes describing adjustments that were
+// skipped. A fixed rectangle was adjusted before it was fixed and a manual
+// crop is exactly what was asked for, both are kept as they are, and
+// devignetted images are never cropped.
+func adjustCropRect(rect, bounds image.Rectangle, reason UnchangedReason, opts CropOptions) (image.Rectangle, UnchangedReason, []string) {
+	if opts.FixedRect != nil || opts.ManualCrop != nil || opts.Devignette {
+		return rect, reason, nil
+	}
+
+	var notes []string
+
+	if opts.MarginPixels > 0 || opts.MarginPercent > 0 {
+		rect = expandCrop(rect, bounds, opts)
+	}
+
+	if opts.ForceSquare {
+		if square, ok := squareCrop(rect, bounds, opts.MaxCropPercent); ok {
+			rect = square
+		} else {
+			notes = append(notes, "not squared, would exceed max crop")
+		}
+	}
+
+	// The safe area stays inside the crop whatever the analysis found
+	if opts.SafeArea != nil && !rect.Eq(bounds) {
+		if kept := rect.Union(opts.SafeArea.rect(bounds)); !kept.Eq(rect) {
+			if kept.Eq(bounds) {
+				return bounds, SafeAreaProtected, notes
+			}
+			rect = kept
+			notes = append(notes, "crop limited by safe area")
+		}
+	}
+
+	// Crops this small are usually noise barely exceeding the tolerance
+	if opts.MinCropPercent > 0 && !rect.Eq(bounds) && areaCropPercent(rect, bounds) < opts.MinCropPercent {
+		return bounds, BelowMinCrop, notes
+	}
+
+	return rect, reason, notes
+}
+
+// areaCropPercent returns the percentage of the area of bounds that lies
+// outside rect
+func areaCropPercent(rect, bounds image.Rectangle) float64 {
+	return (1.0 - float64(rect.Dx()*rect.Dy())/float64(bounds.Dx()*bounds.Dy())) * 100
+}
+
+// maxMarginFraction caps the margin on each edge to this fraction of what the
+// analysis removed there, so the margin never restores the whole border
+const maxMarginFraction = 0.5
+
+// expandCrop grows rect outward by the margin in opts. Each edge grows by at
+// most maxMarginFraction of the pixels cropped from it, which also keeps the
+// result inside bounds.
+func expandCrop(rect, bounds image.Rectangle, opts CropOptions) image.Rectangle {
+	marginX := opts.MarginPixels + int(float64(bounds.Dx())*opts.MarginPercent/100.0)
+	marginY := opts.MarginPixels + int(float64(bounds.Dy())*opts.MarginPercent/100.0)
+
+	grow := func(removed, margin int) int {
+		return min(margin, int(float64(removed)*maxMarginFraction))
+	}
+
+	return image.Rect(
+		rect.Min.X-grow(rect.Min.X-bounds.Min.X, marginX),
+		rect.Min.Y-grow(rect.Min.Y-bounds.Min.Y, marginY),
+		rect.Max.X+grow(bounds.Max.X-rect.Max.X, marginX),
+		rect.Max.Y+grow(bounds.Max.Y-rect.Max.Y, marginY),
+	)
+}
+
+// squareCrop trims the longer side of rect, centered, so the result is square.
+// It reports false when the extra trim would take more than maxCropPercent of
+// the original dimension.
+func squareCrop(rect, bounds image.Rectangle, maxCropPercent float64) (image.Rectangle, bool) {
+	width := rect.Dx()
+	height := rect.Dy()
+
+	switch {
+	case width > height:
+		maxCropWidth := int(float64(bounds.Dx()) * maxCropPercent / 100.0)
+		if bounds.Dx()-height > maxCropWidth {
+			return rect, false
+		}
+		rect.Min.X += (width - height) / 2
+		rect.Max.X = rect.Min.X + height
+	case height > width:
+		maxCropHeight := int(float64(bounds.Dy()) * maxCropPercent / 100.0)
+		if bounds.Dy()-width > maxCropHeight {
+			return rect, false
+		}
+		rect.Min.Y += (height - width) / 2
+		rect.Max.Y = rect.Min.Y + width
+	}
+	return rect, true
+}
@@ -0,0 +1,100 @@
+package cropper
+
+import (
+	"fmt"
+	"image"
+)
+
+// Borders are the pixels a crop removes from each edge
+type Borders struct {
+	Top    int `json:"top"`
+	Bottom int `json:"bottom"`
+	Left   int `json:"left"`
+	Right  int `json:"right"`
+}
+
+// Analysis is the detected crop of an image, without any output written
+type Analysis struct {
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Borders Borders `json:"borders"`
+	// UnchangedReason is set when nothing would be cropped
+	UnchangedReason UnchangedReason `json:"unchanged_reason,omitempty"`
+	// Geometry is the kept region as an ImageMagick geometry string
+	Geometry string `json:"geometry"`
+	// Tolerance is the tolerance picked with CropOptions.AutoTolerance
+	Tolerance float64 `json:"tolerance,omitempty"`
+	// StopCondition is why the brightness search ended
+	StopCondition StopCondition `json:"stop_condition,omitempty"`
+}
+
+// AnalyzeImage decodes an image and runs the crop analysis and adjustments
+// without writing any output, reporting the border removed from each edge
+func AnalyzeImage(inputPath string, opts CropOptions) (*Analysis, error) {
+	opts.DecodeLimiter.acquire()
+	defer opts.DecodeLimiter.release()
+
+	img, _, err := decodeFile(inputPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var tolerance float64
+	if opts.AutoTolerance {
+		opts = withAutoTolerance(img, opts)
+		tolerance = opts.Tolerance
+	}
+
+	bounds := img.Bounds()
+	cropRect, reason, stop, err := findCropRect(img, opts)
+	if err != nil {
+		return nil, err
+	}
+	cropRect, reason, _ = adjustCropRect(cropRect, bounds, reason, opts)
+
+	analysis := &Analysis{
+		Width:         bounds.Dx(),
+		Height:        bounds.Dy(),
+		Borders:       bordersOf(cropRect, bounds),
+		Geometry:      Geometry(cropRect, bounds),
+		Tolerance:     tolerance,
+		StopCondition: stop,
+	}
+	if cropRect.Eq(bounds) {
+		analysis.UnchangedReason = reason
+	}
+	return analysis, nil
+}
+
+// CropRectFor returns the rectangle CropImage would keep for an image that
+// is already decoded, and whether it is smaller than the image, i.e. whether
+// a crop is warranted. It runs the same analysis and adjustments but does no
+// encoding and, unless opts.MaskPath names a mask to read, no I/O, so it can
+// run per frame in a live preview. The cache, limiters and orientation
+// options are not used; pass img upright.
+func CropRectFor(img image.Image, opts CropOptions) (image.Rectangle, bool, error) {
+	bounds := img.Bounds()
+	rect, reason, _, err := findCropRect(img, opts)
+	if err != nil {
+		return image.Rectangle{}, false, err
+	}
+	rect, _, _ = adjustCropRect(rect, bounds, reason, opts)
+	return rect, !rect.Eq(bounds), nil
+}
+
+// bordersOf returns the distance from each edge of bounds to rect
+func bordersOf(rect, bounds image.Rectangle) Borders {
+	return Borders{
+		Top:    rect.Min.Y - bounds.Min.Y,
+		Bottom: bounds.Max.Y - rect.Max.Y,
+		Left:   rect.Min.X - bounds.Min.X,
+		Right:  bounds.Max.X - rect.Max.X,
+	}
+}
+
+// Geometry returns rect as an ImageMagick geometry string, WxH+X+Y with the
+// offset measured from the top left corner of bounds, so that
+// "magick in.png -crop WxH+X+Y +repage out.png" keeps the same region
+func Geometry(rect, bounds image.Rectangle) string {
+	return fmt.Sprintf("%dx%d+%d+%d", rect.Dx(), rect.Dy(), rect.Min.X-bounds.Min.X, rect.Min.Y-bounds.Min.Y)
+}
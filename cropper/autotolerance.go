@@ -0,0 +1,47 @@
+package cropper
+
+import (
+	"image"
+	"math"
+)
+
+// autoToleranceScale is the share of the reference region's relative
+// brightness spread, its standard deviation in percent of its mean, that
+// CropOptions.AutoTolerance uses as the tolerance. Edges are compared as band
+// averages, which vary far less than single pixels.
+const autoToleranceScale = 0.5
+
+// autoToleranceMin and autoToleranceMax bound the tolerance picked by
+// CropOptions.AutoTolerance, in percent of the center brightness
+const (
+	autoToleranceMin = 5.0
+	autoToleranceMax = 30.0
+)
+
+// autoTolerance picks a tolerance for img from the brightness spread of its
+// reference region: clean studio shots get a tight one and busy scenes a
+// loose one. It is in the units of opts.ThresholdMode, with absolute
+// tolerances converted at the center brightness.
+func autoTolerance(img image.Image, opts CropOptions) float64 {
+	luma := opts.luma()
+	ref := referenceRect(img.Bounds(), opts)
+	center := math.Max(calculateRegionBrightness(img, ref, luma, opts.stride()), minRelativeBrightness)
+	spread := regionStdDev(img, ref, luma, opts.stride()) / center * 100
+
+	tolerance := math.Min(math.Max(spread*autoToleranceScale, autoToleranceMin), autoToleranceMax)
+	if opts.ThresholdMode == ThresholdAbsolute {
+		tolerance = tolerance / 100 * center
+	}
+	return math.Round(tolerance*10) / 10
+}
+
+// withAutoTolerance returns opts with the tolerance autoTolerance picks for
+// img when AutoTolerance is set, and AutoTolerance cleared so it is picked
+// only once
+func withAutoTolerance(img image.Image, opts CropOptions) CropOptions {
+	if opts.AutoTolerance {
+		opts.Tolerance = autoTolerance(img, opts)
+		opts.AutoTolerance = false
+	}
+	return opts
+}
@@ -0,0 +1,88 @@
+package cropper
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// isBackground reports whether c counts as the key color: fully transparent,
+// or no RGB channel further than tolerance from the key on the 0-255 scale
+func isBackground(c color.Color, key color.NRGBA, tolerance float64) bool {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if n.A == 0 {
+		return true
+	}
+	for _, d := range [3]int{int(n.R) - int(key.R), int(n.G) - int(key.G), int(n.B) - int(key.B)} {
+		if float64(max(d, -d)) > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// findBackgroundCrop computes the tight bounding box of the pixels that do
+// not match CropOptions.BackgroundKey, widened where necessary so that no
+// dimension loses more than the max crop. An image that is all background
+// is left uncropped.
+func findBackgroundCrop(img image.Image, bounds image.Rectangle, opts CropOptions) (image.Rectangle, UnchangedReason) {
+	key := color.NRGBAModel.Convert(opts.BackgroundKey).(color.NRGBA)
+
+	keep := image.Rectangle{}
+	found := false
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if isBackground(img.At(x, y), key, opts.BackgroundTolerance) {
+				continue
+			}
+			px := image.Rect(x, y, x+1, y+1)
+			if !found {
+				keep = px
+				found = true
+			} else {
+				keep = keep.Union(px)
+			}
+		}
+	}
+	if !found {
+		return bounds, NothingToCrop
+	}
+
+	maxCropWidth := int(float64(bounds.Dx()) * opts.MaxCropPercent / 100.0)
+	maxCropHeight := int(float64(bounds.Dy()) * opts.MaxCropPercent / 100.0)
+	keep.Min.X, keep.Max.X = limitCrop(bounds.Min.X, bounds.Max.X, keep.Min.X, keep.Max.X, maxCropWidth)
+	keep.Min.Y, keep.Max.Y = limitCrop(bounds.Min.Y, bounds.Max.Y, keep.Min.Y, keep.Max.Y, maxCropHeight)
+
+	if keep.Eq(bounds) {
+		return bounds, NothingToCrop
+	}
+	return keep, ""
+}
+
+// keyOutBackground returns an 8-bit RGBA copy of img with every pixel
+// matching CropOptions.BackgroundKey made fully transparent, and a note
+// saying how much of the image that was. Matching pixels inside the
+// subject are keyed out too; this is a color key, not a segmentation.
+func keyOutBackground(img image.Image, opts CropOptions) (*image.NRGBA, string) {
+	key := color.NRGBAModel.Convert(opts.BackgroundKey).(color.NRGBA)
+	bounds := img.Bounds()
+	keyed := image.NewNRGBA(bounds)
+
+	transparent := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.At(x, y)
+			if isBackground(c, key, opts.BackgroundTolerance) {
+				transparent++
+				continue
+			}
+			keyed.Set(x, y, c)
+		}
+	}
+
+	percent := 0.0
+	if area := bounds.Dx() * bounds.Dy(); area > 0 {
+		percent = float64(transparent) / float64(area) * 100
+	}
+	return keyed, fmt.Sprintf("background made transparent in %.1f%% of the output", percent)
+}
@@ -0,0 +1,71 @@
+package cropper
+
+import (
+	"image"
+	"math"
+)
+
+// borderSegments is how many pieces each edge band is split into along the
+// edge by CropOptions.MinBorderWidth; every piece must be off-center
+const borderSegments = 8
+
+// flatBorderEdges returns the edges of rect that start with a flat border at
+// least width pixels deep. The band of that depth along an edge, across from
+// the reference region, counts as a border when its pixels vary by no more
+// than the tolerance, and each of borderSegments pieces of it as well as its
+// innermost line are outside the tolerance on the same side of the center
+// brightness. A textured edge such as foliage deviates strongly but is
+// neither flat nor consistently lighter or darker, and is left out.
+func flatBorderEdges(img image.Image, rect image.Rectangle, width int, opts CropOptions) map[string]bool {
+	luma := opts.luma()
+	ref := referenceRect(rect, opts)
+	centerBrightness := referenceBrightness(img, rect, opts)
+	depthX := min(width, rect.Dx()/2)
+	depthY := min(width, rect.Dy()/2)
+
+	// Each band runs along the edge across from the reference region, which
+	// leaves out corners covered by the borders of neighboring edges; inner
+	// is its innermost line
+	bands := map[string]struct {
+		band, inner image.Rectangle
+	}{
+		"top":    {image.Rect(ref.Min.X, rect.Min.Y, ref.Max.X, rect.Min.Y+depthY), image.Rect(ref.Min.X, rect.Min.Y+depthY-1, ref.Max.X, rect.Min.Y+depthY)},
+		"bottom": {image.Rect(ref.Min.X, rect.Max.Y-depthY, ref.Max.X, rect.Max.Y), image.Rect(ref.Min.X, rect.Max.Y-depthY, ref.Max.X, rect.Max.Y-depthY+1)},
+		"left":   {image.Rect(rect.Min.X, ref.Min.Y, rect.Min.X+depthX, ref.Max.Y), image.Rect(rect.Min.X+depthX-1, ref.Min.Y, rect.Min.X+depthX, ref.Max.Y)},
+		"right":  {image.Rect(rect.Max.X-depthX, ref.Min.Y, rect.Max.X, ref.Max.Y), image.Rect(rect.Max.X-depthX, ref.Min.Y, rect.Max.X-depthX+1, ref.Max.Y)},
+	}
+
+	flat := make(map[string]bool)
+	for edge, b := range bands {
+		if b.band.Empty() || !withinTolerance(regionStdDev(img, b.band, luma, opts.stride()), centerBrightness, opts) {
+			continue
+		}
+
+		regions := []image.Rectangle{b.inner}
+		for i := 0; i < borderSegments; i++ {
+			segment := b.band
+			if edge == "top" || edge == "bottom" {
+				segment.Min.X = b.band.Min.X + b.band.Dx()*i/borderSegments
+				segment.Max.X = b.band.Min.X + b.band.Dx()*(i+1)/borderSegments
+			} else {
+				segment.Min.Y = b.band.Min.Y + b.band.Dy()*i/borderSegments
+				segment.Max.Y = b.band.Min.Y + b.band.Dy()*(i+1)/borderSegments
+			}
+			if !segment.Empty() {
+				regions = append(regions, segment)
+			}
+		}
+
+		sign := 0.0
+		flat[edge] = true
+		for _, region := range regions {
+			offset := calculateRegionBrightness(img, region, luma, opts.stride()) - centerBrightness
+			if withinTolerance(math.Abs(offset), centerBrightness, opts) || (sign != 0 && math.Signbit(offset) != math.Signbit(sign)) {
+				flat[edge] = false
+				break
+			}
+			sign = offset
+		}
+	}
+	return flat
+}
@@ -0,0 +1,76 @@
+package cropper
+
+import (
+	"image"
+	"image/color"
+	"math/rand/v2"
+	"testing"
+)
+
+// foliageImage returns a 200x150 image of brightness 128 with a flat dark
+// border 12 pixels wide on the left and a busy, darker texture, like grass,
+// 40 pixels wide on the right
+func foliageImage() *image.Gray {
+	rng := rand.New(rand.NewPCG(3, 4))
+	img := image.NewGray(image.Rect(0, 0, 200, 150))
+	for y := range 150 {
+		for x := range 200 {
+			v := 128
+			switch {
+			case x < 12:
+				v = 40
+			case x >= 160:
+				// 4x4 pixel leaves between 30 and 150
+				leaf := rand.New(rand.NewPCG(uint64(x/4), uint64(y/4)))
+				v = 30 + leaf.IntN(121) + rng.IntN(5) - 2
+			}
+			img.SetGray(x, y, color.Gray{uint8(v)})
+		}
+	}
+	return img
+}
+
+func TestFlatBorderEdges(t *testing.T) {
+	img := foliageImage()
+	opts := CropOptions{Tolerance: 10}
+
+	flat := flatBorderEdges(img, img.Bounds(), 8, opts)
+	if !flat["left"] {
+		t.Error("flat left border not found")
+	}
+	for _, edge := range []string{"right", "top", "bottom"} {
+		if flat[edge] {
+			t.Errorf("%s edge counted as a flat border", edge)
+		}
+	}
+
+	// A border thinner than the minimum width does not count
+	if flat := flatBorderEdges(img, img.Bounds(), 20, opts); flat["left"] {
+		t.Error("12 pixel border counted as 20 pixels wide")
+	}
+}
+
+func TestMinBorderWidthKeepsTexturedEdges(t *testing.T) {
+	data := pngBytes(t, foliageImage())
+	opts := CropOptions{Tolerance: 10, MaxCropPercent: 40}
+
+	// Without the filter the texture is nibbled away as if it were a border
+	result, _ := cropBytes(t, data, "grass.png", opts)
+	if result.CropRect.Max.X >= 200 {
+		t.Fatalf("crop %v keeps the textured edge without MinBorderWidth, the test image needs more texture", result.CropRect)
+	}
+
+	opts.MinBorderWidth = 8
+	result, _ = cropBytes(t, data, "grass.png", opts)
+	if result.CropRect.Max.X != 200 {
+		t.Errorf("crop %v cuts into the textured right edge", result.CropRect)
+	}
+	// The image stays non-uniform, so the left edge stops once its sample
+	// averages within tolerance, which may leave a column of the border
+	if result.CropRect.Min.X < 10 || result.CropRect.Min.X > 14 {
+		t.Errorf("crop %v, want the 12 pixel left border removed", result.CropRect)
+	}
+	if result.CropRect.Min.Y != 0 || result.CropRect.Max.Y != 150 {
+		t.Errorf("crop %v cuts into the top or bottom, which have no border", result.CropRect)
+	}
+}
@@ -0,0 +1,38 @@
+package cropper
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+)
+
+// brightnessMap returns a grayscale image of the brightness the analysis
+// sees at each pixel of img, with the luminance weights and any
+// equalization selected in opts
+func brightnessMap(img image.Image, opts CropOptions) *image.Gray {
+	img = analysisImage(img, opts)
+	luma := opts.luma()
+
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			brightness := calculateBrightness(img.At(x, y), luma)
+			gray.SetGray(x, y, color.Gray{Y: uint8(min(math.Round(brightness), 255))})
+		}
+	}
+	return gray
+}
+
+// encodeBrightnessMap encodes the brightness map of img as a PNG, whatever
+// the format of img, so no compression artifacts are added
+func encodeBrightnessMap(img image.Image, opts CropOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, brightnessMap(img, opts)); err != nil {
+		return nil, fmt.Errorf("failed to encode brightness map: %w", err)
+	}
+	return buf.Bytes(), nil
+}
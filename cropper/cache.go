@@ -0,0 +1,170 @@
+package cropper
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"sync"
+)
+
+// RectCache is a bounded LRU cache of analysis results keyed by a hash of
+// the image file contents and the analysis options, so identical images are
+// only analyzed once per set of options. It is safe for concurrent use. A
+// nil cache caches nothing.
+type RectCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // most recently used first
+	entries map[cacheKey]*list.Element
+	hits    int
+	misses  int
+}
+
+// cacheKey identifies one analysis: the file contents and, from
+// analysisKey, the options it ran with
+type cacheKey struct {
+	content [sha256.Size]byte
+	options string
+}
+
+// cachedRect is the analysis result stored for one image
+type cachedRect struct {
+	key    cacheKey
+	bounds image.Rectangle
+	rect   image.Rectangle
+	reason UnchangedReason
+	stop   StopCondition
+}
+
+// NewRectCache creates a cache holding up to size results
+func NewRectCache(size int) *RectCache {
+	return &RectCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// Stats returns the number of cache hits and misses so far
+func (c *RectCache) Stats() (hits, misses int) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// get returns the stored result for key. Results for images of different
+// dimensions than bounds are treated as misses.
+func (c *RectCache) get(key cacheKey, bounds image.Rectangle) (image.Rectangle, UnchangedReason, StopCondition, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cachedRect)
+		if entry.bounds.Eq(bounds) {
+			c.order.MoveToFront(el)
+			c.hits++
+			return entry.rect, entry.reason, entry.stop, true
+		}
+	}
+	c.misses++
+	return image.Rectangle{}, "", "", false
+}
+
+// put stores a result, evicting the least recently used one when full
+func (c *RectCache) put(key cacheKey, bounds, rect image.Rectangle, reason UnchangedReason, stop StopCondition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = &cachedRect{key: key, bounds: bounds, rect: rect, reason: reason, stop: stop}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedRect{key: key, bounds: bounds, rect: rect, reason: reason, stop: stop})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedRect).key)
+	}
+}
+
+// hashContent hashes everything in r and rewinds it
+func hashContent(r io.ReadSeeker) ([sha256.Size]byte, error) {
+	var key [sha256.Size]byte
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return key, fmt.Errorf("failed to hash input: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return key, fmt.Errorf("failed to rewind input: %w", err)
+	}
+	copy(key[:], h.Sum(nil))
+	return key, nil
+}
+
+// analysisKey describes every option that changes what findCropRect finds
+// in the same file, so results found with different options, such as a
+// per-file tolerance override, are never mixed up. Options applied after the
+// analysis, by adjustCropRect or the encoder, are left out. Pointer options
+// are compared by value.
+func analysisKey(opts CropOptions) string {
+	deref := func(p any) any {
+		switch v := p.(type) {
+		case *ManualCrop:
+			if v != nil {
+				return *v
+			}
+		case *image.Rectangle:
+			if v != nil {
+				return *v
+			}
+		case *ReferencePoint:
+			if v != nil {
+				return *v
+			}
+		}
+		return nil
+	}
+	var key color.Color
+	if opts.BackgroundKey != nil {
+		key = color.NRGBAModel.Convert(opts.BackgroundKey)
+	}
+	return fmt.Sprint([]any{
+		opts.Tolerance, opts.AutoTolerance, opts.ToleranceFalloff,
+		opts.MaxCropPercent, opts.MaxCropPerEdgePercent,
+		opts.Mode, opts.ThresholdMode, opts.Equalize, opts.Denoise,
+		opts.MultiEdge, opts.LockEdges, opts.Refine, opts.CropStepPercent,
+		opts.MinBorderWidth, opts.MinContrast, opts.ChannelVariance,
+		opts.EdgeThreshold, opts.EdgeMarginPercent, fmt.Sprintf("%T", opts.FaceDetector),
+		opts.AutoOrient, opts.Rotate, opts.SeedInsetPixels, opts.SeedInsetPercent,
+		deref(opts.ManualCrop), deref(opts.FixedRect), deref(opts.Reference),
+		opts.luma(), opts.stride(), opts.CenterShape, opts.AdaptiveReference,
+		opts.Devignette, key, opts.BackgroundTolerance,
+	})
+}
+
+// cachedCropRect is findCropRect through the cache in opts. Mask crops depend
+// on the mask, not just the image, and are never cached.
+func cachedCropRect(img image.Image, content *[sha256.Size]byte, opts CropOptions) (image.Rectangle, UnchangedReason, StopCondition, error) {
+	if opts.Cache == nil || content == nil || opts.MaskPath != "" {
+		return findCropRect(img, opts)
+	}
+
+	key := cacheKey{content: *content, options: analysisKey(opts)}
+	bounds := img.Bounds()
+	if rect, reason, stop, ok := opts.Cache.get(key, bounds); ok {
+		return rect, reason, stop, nil
+	}
+	rect, reason, stop, err := findCropRect(img, opts)
+	if err != nil {
+		return rect, reason, stop, err
+	}
+	opts.Cache.put(key, bounds, rect, reason, stop)
+	return rect, reason, stop, nil
+}
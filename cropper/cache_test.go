@@ -0,0 +1,26 @@
+package cropper
+
+import "testing"
+
+func TestRectCacheSeparatesOptions(t *testing.T) {
+	data := pngBytes(t, borderedImage(200, 150, 20, 100))
+	cache := NewRectCache(10)
+
+	tight := CropOptions{Tolerance: 1, MaxCropPercent: 40, Cache: cache}
+	loose := tight
+	loose.Tolerance = 90
+
+	if result, _ := cropBytes(t, data, "a.png", tight); !result.WasCropped {
+		t.Errorf("tolerance 1: got %q, want a crop", result.Message)
+	}
+	if result, _ := cropBytes(t, data, "b.png", loose); result.WasCropped {
+		t.Errorf("tolerance 90 after a cached tolerance 1 crop: got %q, want no crop", result.Message)
+	}
+	if result, _ := cropBytes(t, data, "c.png", tight); !result.WasCropped {
+		t.Errorf("tolerance 1 again: got %q, want a crop", result.Message)
+	}
+
+	if hits, misses := cache.Stats(); hits != 1 || misses != 2 {
+		t.Errorf("cache stats = %d hits, %d misses, want 1 and 2", hits, misses)
+	}
+}
@@ -0,0 +1,124 @@
+package cropper
+
+import (
+	"image"
+)
+
+// defaultChannelVariance is the per-channel variance below which a line
+// counts as uniform when CropOptions.ChannelVariance is zero
+const defaultChannelVariance = 100.0
+
+// channelStats holds the per-channel mean and variance of a region in 8-bit
+// units, in R, G, B order
+type channelStats struct {
+	mean     [3]float64
+	variance [3]float64
+}
+
+// regionChannelStats computes the mean and variance of each RGB channel
+func regionChannelStats(img image.Image, rect image.Rectangle) channelStats {
+	var sum, sumSquares [3]float64
+	count := 0
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			for i, v := range [3]uint32{r >> 8, g >> 8, b >> 8} {
+				sum[i] += float64(v)
+				sumSquares[i] += float64(v) * float64(v)
+			}
+			count++
+		}
+	}
+
+	var stats channelStats
+	if count == 0 {
+		return stats
+	}
+	for i := range 3 {
+		stats.mean[i] = sum[i] / float64(count)
+		stats.variance[i] = max(0, sumSquares[i]/float64(count)-stats.mean[i]*stats.mean[i])
+	}
+	return stats
+}
+
+// findChannelVarianceCrop peels border lines from each edge. A line is border
+// when every RGB channel is nearly constant along it and at least one channel
+// differs from the reference region beyond the tolerance, so colored frames
+// of the same brightness as the content are still found.
+func findChannelVarianceCrop(img image.Image, bounds image.Rectangle, opts CropOptions) (image.Rectangle, UnchangedReason) {
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	maxCropWidth := int(float64(width) * opts.MaxCropPercent / 100.0)
+	maxCropHeight := int(float64(height) * opts.MaxCropPercent / 100.0)
+	if maxCropWidth == 0 && maxCropHeight == 0 {
+		if opts.MaxCropPercent > 0 {
+			return bounds, TooSmall
+		}
+		return bounds, CropLimitReached
+	}
+
+	maxEdgeWidth := width
+	maxEdgeHeight := height
+	if opts.MaxCropPerEdgePercent > 0 {
+		maxEdgeWidth = int(float64(width) * opts.MaxCropPerEdgePercent / 100.0)
+		maxEdgeHeight = int(float64(height) * opts.MaxCropPerEdgePercent / 100.0)
+	}
+
+	variance := opts.ChannelVariance
+	if variance <= 0 {
+		variance = defaultChannelVariance
+	}
+	center := regionChannelStats(img, referenceRect(bounds, opts))
+
+	isBorder := func(line image.Rectangle) bool {
+		stats := regionChannelStats(img, line)
+		differs := false
+		for i := range 3 {
+			if stats.variance[i] > variance {
+				return false
+			}
+			deviation := stats.mean[i] - center.mean[i]
+			if deviation < 0 {
+				deviation = -deviation
+			}
+			if !withinTolerance(deviation, center.mean[i], opts) {
+				differs = true
+			}
+		}
+		return differs
+	}
+
+	rect := bounds
+
+	// Rows first, the column scans then only look at the remaining rows
+	for n := min(maxEdgeHeight, maxCropHeight); n > 0 && rect.Dy() > 1; n-- {
+		if !isBorder(image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+1)) {
+			break
+		}
+		rect.Min.Y++
+	}
+	for n := min(maxEdgeHeight, maxCropHeight-(rect.Min.Y-bounds.Min.Y)); n > 0 && rect.Dy() > 1; n-- {
+		if !isBorder(image.Rect(rect.Min.X, rect.Max.Y-1, rect.Max.X, rect.Max.Y)) {
+			break
+		}
+		rect.Max.Y--
+	}
+	for n := min(maxEdgeWidth, maxCropWidth); n > 0 && rect.Dx() > 1; n-- {
+		if !isBorder(image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+1, rect.Max.Y)) {
+			break
+		}
+		rect.Min.X++
+	}
+	for n := min(maxEdgeWidth, maxCropWidth-(rect.Min.X-bounds.Min.X)); n > 0 && rect.Dx() > 1; n-- {
+		if !isBorder(image.Rect(rect.Max.X-1, rect.Min.Y, rect.Max.X, rect.Max.Y)) {
+			break
+		}
+		rect.Max.X--
+	}
+
+	if rect.Eq(bounds) {
+		return bounds, NothingToCrop
+	}
+	return rect, ""
+}
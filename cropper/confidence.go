@@ -0,0 +1,58 @@
+package cropper
+
+import (
+	"image"
+	"math"
+)
+
+// confidenceFullJump is the brightness step across a crop boundary, in 0-255
+// units, that counts as certain. Smaller steps scale linearly toward zero.
+const confidenceFullJump = 32.0
+
+// cropConfidence scores how clearly rect follows a real border, from 0 to 1.
+// For every cropped edge it looks for the largest brightness step between
+// lines two pixels apart within one coarse crop step of the boundary, since
+// the coarse crop may overshoot the border by up to a step. A hard border
+// such as a scanner bed or a mat produces a large step there, while a crop
+// that stopped inside a gradual vignette finds only small ones. The weakest
+// edge decides the score, since one doubtful edge is enough to send an image
+// to review. Uncropped images score 0.
+func cropConfidence(img image.Image, bounds, rect image.Rectangle, luma LumaWeights, step int) float64 {
+	if rect.Eq(bounds) {
+		return 0
+	}
+	// One coarse step plus the two pixel spacing of compared lines
+	window := step + 2
+
+	// sharpest returns the largest step between lines two apart in [lo, hi),
+	// where line(i) is the region of line i
+	sharpest := func(lo, hi int, line func(i int) image.Rectangle) float64 {
+		best := 0.0
+		for i := lo; i+2 < hi; i++ {
+			a := calculateRegionBrightness(img, line(i), luma, 1)
+			b := calculateRegionBrightness(img, line(i+2), luma, 1)
+			best = math.Max(best, math.Abs(a-b))
+		}
+		return best
+	}
+	row := func(y int) image.Rectangle { return image.Rect(rect.Min.X, y, rect.Max.X, y+1) }
+	col := func(x int) image.Rectangle { return image.Rect(x, rect.Min.Y, x+1, rect.Max.Y) }
+
+	confidence := 1.0
+	score := func(step float64) {
+		confidence = math.Min(confidence, math.Min(1, step/confidenceFullJump))
+	}
+	if rect.Min.Y > bounds.Min.Y {
+		score(sharpest(max(bounds.Min.Y, rect.Min.Y-window), min(rect.Max.Y, rect.Min.Y+window), row))
+	}
+	if rect.Max.Y < bounds.Max.Y {
+		score(sharpest(max(rect.Min.Y, rect.Max.Y-window), min(bounds.Max.Y, rect.Max.Y+window), row))
+	}
+	if rect.Min.X > bounds.Min.X {
+		score(sharpest(max(bounds.Min.X, rect.Min.X-window), min(rect.Max.X, rect.Min.X+window), col))
+	}
+	if rect.Max.X < bounds.Max.X {
+		score(sharpest(max(rect.Min.X, rect.Max.X-window), min(bounds.Max.X, rect.Max.X+window), col))
+	}
+	return confidence
+}
@@ -0,0 +1,104 @@
+package cropper
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// contactSheetMaxRows is the most rows of cells on one contact sheet; larger
+// batches continue on further sheets
+const contactSheetMaxRows = 10
+
+// contactSheetPadding is the gap in pixels around every cell, and
+// contactSheetLabelHeight the strip under each image holding its label
+const (
+	contactSheetPadding     = 4
+	contactSheetLabelHeight = glyphHeight + 4
+)
+
+var (
+	contactSheetBackground = color.RGBA{0x30, 0x30, 0x30, 0xFF}
+	contactSheetText       = color.RGBA{0xF0, 0xF0, 0xF0, 0xFF}
+)
+
+// ContactSheetEntry is one image of a contact sheet
+type ContactSheetEntry struct {
+	// Path is the image file, decoded when its sheet is drawn
+	Path string
+	// Label is drawn under the image, typically its file name
+	Label string
+}
+
+// WriteContactSheets tiles entries, scaled down to fit cellSize pixels
+// square, into a grid of columns cells with each label underneath, and
+// writes it as a PNG to path. A grid of more than contactSheetMaxRows rows
+// continues on sheets named like NAME_2.png next to path. The dark
+// background keeps light and dark crop edges visible. It returns the paths
+// of the sheets written.
+func WriteContactSheets(path string, entries []ContactSheetEntry, columns, cellSize int) ([]string, error) {
+	columns = min(columns, len(entries))
+	perSheet := columns * contactSheetMaxRows
+
+	var paths []string
+	for first := 0; first < len(entries); first += perSheet {
+		sheetEntries := entries[first:min(first+perSheet, len(entries))]
+		sheet, err := drawContactSheet(sheetEntries, columns, cellSize)
+		if err != nil {
+			return paths, err
+		}
+
+		sheetPath := path
+		if first > 0 {
+			ext := filepath.Ext(path)
+			sheetPath = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(path, ext), first/perSheet+1, ext)
+		}
+		f, err := os.Create(sheetPath)
+		if err != nil {
+			return paths, fmt.Errorf("failed to create contact sheet: %w", err)
+		}
+		err = png.Encode(f, sheet)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return paths, fmt.Errorf("failed to write contact sheet: %w", err)
+		}
+		paths = append(paths, sheetPath)
+	}
+	return paths, nil
+}
+
+// drawContactSheet draws one sheet of entries, decoding them one at a time
+func drawContactSheet(entries []ContactSheetEntry, columns, cellSize int) (*image.RGBA, error) {
+	rows := (len(entries) + columns - 1) / columns
+	width := columns*(cellSize+contactSheetPadding) + contactSheetPadding
+	height := rows*(cellSize+contactSheetLabelHeight+contactSheetPadding) + contactSheetPadding
+
+	sheet := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(contactSheetBackground), image.Point{}, draw.Src)
+
+	for i, e := range entries {
+		img, _, err := decodeFile(e.Path, CropOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to add %s to contact sheet: %w", e.Path, err)
+		}
+		thumb := resizeToFit(img, cellSize)
+
+		// Center the thumbnail in its cell, with the label below the cell
+		cell := image.Pt(
+			contactSheetPadding+(i%columns)*(cellSize+contactSheetPadding),
+			contactSheetPadding+(i/columns)*(cellSize+contactSheetLabelHeight+contactSheetPadding),
+		)
+		tb := thumb.Bounds()
+		at := cell.Add(image.Pt((cellSize-tb.Dx())/2, (cellSize-tb.Dy())/2))
+		draw.Draw(sheet, image.Rectangle{at, at.Add(tb.Size())}, thumb, tb.Min, draw.Over)
+		drawLabel(sheet, cell.Add(image.Pt(0, cellSize+2)), e.Label, cellSize, contactSheetText)
+	}
+	return sheet, nil
+}
@@ -1,11 +1,14 @@
 package cropper
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"image"
 	"image/color"
-	"image/jpeg"
+	"image/draw"
 	"image/png"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
@@ -16,115 +19,1044 @@ import (
 type CropResult struct {
 	WasCropped bool
 	Message    string
+	// UnchangedReason explains why an image was copied unchanged. It is empty
+	// when the image was cropped or corrected.
+	UnchangedReason UnchangedReason
+	// Corrected means the pixels were rewritten without a crop, as
+	// CropOptions.Devignette does; such images are neither cropped nor
+	// unchanged
+	Corrected bool
+	// OriginalSize is the width and height of the input image
+	OriginalSize image.Point
+	// CropRect is the kept region in input coordinates; it equals the input
+	// bounds when the image was not cropped
+	CropRect image.Rectangle
+	// Format is the format the input was decoded as, as reported by
+	// image.Decode; outputs are written in it whatever their extension
+	Format string
+	// Tolerance is the tolerance picked for the image with
+	// CropOptions.AutoTolerance, zero when the configured one was used
+	Tolerance float64
+	// Confidence, from 0 to 1, is how sharp the brightness step at the
+	// detected boundary is; low values suggest a gradual transition worth a
+	// manual look. It is 0 for uncropped images.
+	Confidence float64
+	// StopCondition is why the brightness search ended; empty when another
+	// analysis decided the crop
+	StopCondition StopCondition
+	// Stats are the brightness measurements of the image, set when
+	// CropOptions.Stats asks for them
+	Stats *ImageStats
+
+	// thumbnail is the encoded thumbnail CropImage writes to
+	// CropOptions.ThumbnailPath
+	thumbnail []byte
+	// brightnessMap is the encoded brightness map CropImage writes to
+	// CropOptions.BrightnessMapPath
+	brightnessMap []byte
+}
+
+// UnchangedReason is a machine-readable explanation for an uncropped image
+type UnchangedReason string
+
+const (
+	// AlreadyUniform means the edges were within tolerance of the center
+	AlreadyUniform UnchangedReason = "already_uniform"
+	// CropLimitReached means the max crop limit allowed no crop at all
+	CropLimitReached UnchangedReason = "crop_limit_reached"
+	// NoConvergence means the iteration cap was hit without a usable crop
+	NoConvergence UnchangedReason = "no_convergence"
+	// TooSmall means the image is too small for the max crop percentage to
+	// allow removing even a single pixel
+	TooSmall UnchangedReason = "too_small"
+	// NothingToCrop means the mask, edge or channel analysis found no
+	// background to remove
+	NothingToCrop UnchangedReason = "nothing_to_crop"
+	// BelowMinCrop means the crop removed less area than
+	// CropOptions.MinCropPercent and was discarded
+	BelowMinCrop UnchangedReason = "below_min_crop"
+	// FacesProtected means keeping every detected face left nothing to crop
+	FacesProtected UnchangedReason = "faces_protected"
+	// LargerOutput means a minor crop encoded larger than the input and the
+	// original was kept, see CropOptions.SkipIfLarger
+	LargerOutput UnchangedReason = "larger_output"
+	// SafeAreaProtected means keeping CropOptions.SafeArea left nothing to
+	// crop
+	SafeAreaProtected UnchangedReason = "safe_area_protected"
+	// BelowMinContrast means no edge differed from the center by more than
+	// CropOptions.MinContrast, so the brightness search did not start
+	BelowMinContrast UnchangedReason = "below_min_contrast"
+)
+
+// unchangedMessages are the human-readable messages for each reason
+var unchangedMessages = map[UnchangedReason]string{
+	AlreadyUniform:    "already uniform, copied unchanged",
+	CropLimitReached:  "crop limit reached, copied unchanged",
+	NoConvergence:     "no uniform crop found, copied unchanged",
+	TooSmall:          "too small to crop, copied unchanged",
+	NothingToCrop:     "nothing to crop, copied unchanged",
+	BelowMinCrop:      "crop below minimum, copied unchanged",
+	FacesProtected:    "crop would cut a face, copied unchanged",
+	LargerOutput:      "crop output larger than input, copied unchanged",
+	SafeAreaProtected: "crop would cut into the safe area, copied unchanged",
+	BelowMinContrast:  "below contrast threshold, copied unchanged",
+}
+
+// StopCondition is why the iterative brightness search of findUniformCrop
+// ended, whether or not it cropped anything. It tells an image that stopped
+// at a clean boundary from one that ran into a limit.
+type StopCondition string
+
+const (
+	// StopUniform means every edge band matched the reference brightness
+	StopUniform StopCondition = "uniform"
+	// StopWithinTolerance means the most deviating edge sample still left
+	// to crop was within the tolerance
+	StopWithinTolerance StopCondition = "within_tolerance"
+	// StopCropLimit means the max crop budget of both dimensions was used up
+	StopCropLimit StopCondition = "crop_limit"
+	// StopNoCroppableEdges means every edge was at its own limit or without
+	// a flat border
+	StopNoCroppableEdges StopCondition = "no_croppable_edges"
+	// StopIterationCap means the search ran out of iterations
+	StopIterationCap StopCondition = "iteration_cap"
+	// StopTooSmall means the max crop budget rounds down to no pixels
+	StopTooSmall StopCondition = "too_small"
+	// StopBelowMinContrast means no edge stood out enough to start
+	StopBelowMinContrast StopCondition = "below_min_contrast"
+)
+
+// addNotes appends remarks about the operation to the result message
+func (r *CropResult) addNotes(notes []string) {
+	for _, note := range notes {
+		r.Message += "; " + note
+	}
+}
+
+// Mode selects how CropImage processes an image
+type Mode string
+
+const (
+	// ModeBrightness crops edges that deviate from the center brightness
+	ModeBrightness Mode = "brightness"
+	// ModeGIFAnimated crops every frame of an animated GIF with one shared
+	// rectangle. Other formats are processed as in ModeBrightness.
+	ModeGIFAnimated Mode = "gif-animated"
+	// ModeEdges crops to the bounding box of strong Sobel gradients, for
+	// subjects on textured backgrounds where brightness uniformity fails
+	ModeEdges Mode = "edges"
+	// ModeChannelVariance crops lines that are uniform in every RGB channel
+	// and differ from the center in at least one, catching colored frames
+	// with the same brightness as the content
+	ModeChannelVariance Mode = "channel-variance"
+	// ModeDocument first removes thin dark scanner lines at the extreme
+	// edges of document scans, then runs the brightness crop
+	ModeDocument Mode = "document"
+)
+
+// ThresholdMode selects how an edge's brightness deviation is compared
+// against the tolerance
+type ThresholdMode string
+
+const (
+	// ThresholdRelative treats the tolerance as a percentage of center brightness
+	ThresholdRelative ThresholdMode = "relative"
+	// ThresholdAbsolute treats the tolerance as a raw brightness difference (0-255)
+	ThresholdAbsolute ThresholdMode = "absolute"
+)
+
+// CenterShape selects the shape of the reference region edges are compared
+// against
+type CenterShape string
+
+const (
+	// CenterProportional insets each dimension by 20%, giving a region of
+	// the image's aspect ratio
+	CenterProportional CenterShape = "proportional"
+	// CenterBox is a square of 60% of the shorter dimension, so the
+	// reference of a wide panorama or tall strip is a block of its middle
+	// rather than a slice across most of the content
+	CenterBox CenterShape = "box"
+)
+
+// minRelativeBrightness is the center brightness below which relative
+// comparisons switch to an absolute threshold, avoiding division by zero on
+// black centers and hypersensitive percentages on nearly black ones
+const minRelativeBrightness = 10.0
+
+// defaultCropStepPercent is the brightness search step when
+// CropOptions.CropStepPercent is zero, 1% of the mean dimension
+const defaultCropStepPercent = 1.0
+
+// adaptiveReferencePercent is the size of the central patch, as a percentage
+// of each dimension, that CropOptions.AdaptiveReference falls back to
+const adaptiveReferencePercent = 10
+
+// lockedEdgeRatio is the share of the tolerance an edge's deviation must
+// stay below to be locked with CropOptions.LockEdges
+const lockedEdgeRatio = 0.5
+
+// minorCropPercent is the share of the image area below which
+// CropOptions.SkipIfLarger considers a crop not worth a larger file
+const minorCropPercent = 10.0
+
+// CropOptions controls how CropImage analyzes and crops an image
+type CropOptions struct {
+	// Tolerance is the allowed brightness deviation from the center, in percent
+	Tolerance float64
+	// MaxCropPercent is the maximum percentage removed from each dimension
+	MaxCropPercent float64
+	// MaskPath optionally names a mask image that replaces brightness analysis.
+	// White mask pixels mark croppable background, black pixels mark content to keep.
+	MaskPath string
+	// DecodeLimiter optionally bounds how many images are decoded at once.
+	// A slot is held from decode until the result is written.
+	DecodeLimiter Limiter
+	// FormatLimiters optionally bound how many images of each format, keyed
+	// by format name as reported by image.Decode, are processed at once.
+	// Formats without an entry are not limited.
+	FormatLimiters map[string]Limiter
+	// Mode selects the processing mode, empty means ModeBrightness
+	Mode Mode
+	// ThresholdMode selects how deviations are compared, empty means ThresholdRelative
+	ThresholdMode ThresholdMode
+	// Equalize runs brightness analysis on a histogram-equalized copy of the
+	// image, which helps on low-contrast images. Output pixels are unaffected.
+	Equalize bool
+	// Denoise runs brightness analysis on a lightly blurred copy of the
+	// image, steadying edge brightness on noisy photos such as high-ISO night
+	// shots. Output pixels are unaffected.
+	Denoise bool
+	// ForceSquare trims the longer side of the crop, centered, to make the
+	// output square. It is skipped when that would exceed MaxCropPercent.
+	ForceSquare bool
+	// PreserveDPI copies the JFIF resolution header of JPEG inputs to the output
+	PreserveDPI bool
+	// MaxCropPerEdgePercent optionally limits how much of a dimension may be
+	// removed from any single edge. Zero disables the per-edge limit.
+	MaxCropPerEdgePercent float64
+	// Progressive writes cropped JPEGs as progressive (SOF2) instead of
+	// baseline, so browsers can show a coarse version while loading
+	Progressive bool
+	// LosslessJPEG crops baseline JPEGs written as JPEG by copying the
+	// coefficients of whole blocks instead of compressing the pixels again.
+	// The top left corner of the crop moves up and left onto the block grid,
+	// at most 15 pixels. Progressive sources, rotated images and options that
+	// change the pixels (Normalize, Progressive, MaxFileSize) re-encode.
+	LosslessJPEG bool
+	// JPEGQuality is the quality, 1 to 100, of JPEG output and the highest
+	// one tried with MaxFileSize. Zero means jpegQuality.
+	JPEGQuality int
+	// MaxFileSize, when positive, lowers the JPEG quality until cropped JPEG
+	// output fits in this many bytes. Output that is still larger at the
+	// lowest quality is written anyway, with a note in the result message.
+	MaxFileSize int64
+	// MultiEdge crops every edge outside the tolerance in each iteration of
+	// the brightness search instead of only the worst one, which needs far
+	// fewer iterations on images bordered on several sides. It is a
+	// different search: edges are stepped in another order, so crops differ
+	// from the single-edge search by a step or two on hard borders and by
+	// more on gradients.
+	MultiEdge bool
+	// LockEdges stops sampling an edge in the brightness search once its
+	// deviation is below lockedEdgeRatio of the tolerance, saving a region
+	// average per iteration on edges that are clearly content. A locked edge
+	// is sampled again once the center brightness or its sample has moved
+	// enough that it might have left the tolerance, so the crop is the same
+	// as without locking.
+	LockEdges bool
+	// MinBorderWidth, when positive, only lets the brightness search crop
+	// edges whose outer band of this many pixels is a flat border: uniformly
+	// lighter or darker than the center along the whole edge and through the
+	// whole band. Busy edges such as grass or foliage that merely vary more
+	// than the tolerance are kept.
+	MinBorderWidth int
+	// AutoOrient turns JPEGs upright according to their EXIF orientation
+	// before analysis. Reoriented images are always re-encoded, cropped or
+	// not, and copied EXIF metadata gets orientation 1.
+	AutoOrient bool
+	// Rotate turns every decoded image clockwise by 90, 180 or 270 degrees
+	// before analysis, after any AutoOrient. Zero leaves images as they are.
+	// Rotated images are always re-encoded, cropped or not.
+	Rotate int
+	// ThumbnailSize is the longest side, in pixels, of the thumbnail written
+	// alongside the output when ThumbnailPath is set. Smaller images are not
+	// scaled up.
+	ThumbnailSize int
+	// ThumbnailPath, when set, receives a scaled-down copy of the output.
+	// Only CropImage writes it; like MaskPath it is set per image.
+	ThumbnailPath string
+	// BrightnessMapPath, when set, receives a grayscale PNG of the input's
+	// brightness as the analysis sees it, for diagnosing unexpected crops.
+	// Only CropImage and PreviewCrop write it; it is set per image.
+	BrightnessMapPath string
+	// Stats measures the brightness of each image's center, edge bands and
+	// histogram into CropResult.Stats. CropImage and PreviewCrop fill it in,
+	// except for animated GIFs.
+	Stats bool
+	// SkipIfLarger keeps the original instead of a crop removing less than
+	// minorCropPercent of the image area whose output is larger than the
+	// input file
+	SkipIfLarger bool
+	// PreserveMTime gives the output the modification time of the input
+	PreserveMTime bool
+	// CopyMetadata copies EXIF, XMP, ICC and IPTC segments of JPEG inputs to
+	// the output
+	CopyMetadata bool
+	// Deterministic blanks EXIF dates and drops XMP packets from copied
+	// metadata, so the output bytes depend only on the pixels and the
+	// remaining metadata, not on when a file was taken or edited
+	Deterministic bool
+	// EdgeThreshold is the Sobel gradient magnitude counted as an edge in
+	// ModeEdges. Zero picks a threshold from the image's gradient statistics.
+	EdgeThreshold float64
+	// EdgeMarginPercent is the padding kept around detected content in
+	// ModeEdges, as a percentage of each dimension. Zero keeps no padding, a
+	// negative value means 2%.
+	EdgeMarginPercent float64
+	// BitDepth selects the output sample depth, zero means BitDepthKeep
+	BitDepth BitDepth
+	// OutputFormat, when set to a format with an encoder ("jpeg", "png" or
+	// "gif"), replaces the input format as the output format. Images in
+	// another format are then re-encoded even when nothing is cropped.
+	OutputFormat string
+	// PNGCompression is the zlib level of PNG output. It changes encode time
+	// and file size, never pixels. Zero means png.DefaultCompression.
+	PNGCompression png.CompressionLevel
+	// Normalize stretches the brightness of cropped output to the full range.
+	// It alters pixel values and does not apply to unchanged copies.
+	Normalize bool
+	// FaceDetector, when set, keeps every detected face inside the crop
+	FaceDetector FaceDetector
+	// AutoTolerance replaces Tolerance with one picked per image from the
+	// brightness spread of its reference region, tight for clean images and
+	// loose for busy ones, see autoTolerance
+	AutoTolerance bool
+	// ToleranceFalloff, between 0 and 1, tightens the tolerance as the crop
+	// grows: once the whole max crop budget is used it is
+	// Tolerance*(1-ToleranceFalloff). Zero keeps the tolerance constant.
+	ToleranceFalloff float64
+	// Cache, when set, reuses analysis results for images with identical
+	// file contents
+	Cache *RectCache
+	// Refine backs the edges of a converged brightness crop out pixel by
+	// pixel while the image stays uniform, for pixel-accurate boundaries
+	Refine bool
+	// CropStepPercent is how much one step of the brightness search removes,
+	// as a percentage of the mean of the current width and height; zero
+	// means defaultCropStepPercent. Larger steps converge in fewer
+	// iterations but overshoot the border by more, which Refine takes back.
+	CropStepPercent float64
+	// ChannelVariance is the largest per-channel variance, in 8-bit units
+	// squared, of a border line in ModeChannelVariance. Zero means 100.
+	ChannelVariance float64
+	// MinCropPercent discards crops that remove less than this percentage of
+	// the image area, zero keeps every crop
+	MinCropPercent float64
+	// MinContrast, in 0-255 brightness units, is how far at least one edge
+	// band must be from the reference brightness for the brightness search
+	// to start, whatever the tolerance allows. Zero disables the gate.
+	MinContrast float64
+	// MarginPixels and MarginPercent pad the detected crop outward, capped on
+	// each edge to half of what was cropped there. Both may be set.
+	MarginPixels  int
+	MarginPercent float64
+	// SafeArea, when set, is a region that always stays inside the crop,
+	// even if the analysis would remove part of it
+	SafeArea *SafeArea
+	// SeedInsetPixels and SeedInsetPercent are a border known to be on every
+	// side. The brightness search starts inside it instead of finding it
+	// step by step, unless the whole image is uniform. It is limited to the
+	// max crop and per-edge limits; both may be set.
+	SeedInsetPixels  int
+	SeedInsetPercent float64
+	// ManualCrop, when set, replaces the analysis: exactly the given number
+	// of pixels is removed from each edge of every upright image, with no
+	// adjustments applied. A crop that leaves nothing is an error.
+	ManualCrop *ManualCrop
+	// FixedRect, when set, replaces the analysis: every image is cropped to
+	// this rectangle, clipped to its bounds, with no adjustments applied.
+	// It is meant for a rectangle computed over a whole batch.
+	FixedRect *image.Rectangle
+	// Luma selects the luminance coefficients, zero means LumaBT601
+	Luma LumaWeights
+	// SampleStride averages only every Nth pixel in x and y when comparing
+	// edge and reference brightness, trading accuracy for speed on large
+	// images. Zero or one visits every pixel.
+	SampleStride int
+	// Reference optionally moves the brightness reference region off the
+	// geometric center, e.g. onto an off-center subject
+	Reference *ReferencePoint
+	// CenterShape is the shape of the reference region; empty means
+	// CenterProportional
+	CenterShape CenterShape
+	// AdaptiveReference compares edges against a small patch at the center
+	// of the reference region when the region's own brightness varies by
+	// more than the tolerance and its mean disagrees with the patch, as when
+	// a border covers most of the frame and reaches into the region
+	AdaptiveReference bool
+	// Devignette replaces cropping with vignetting correction: the radial
+	// brightness falloff from the center to the corners is modeled and the
+	// whole image is written with the falloff undone. Images without a
+	// measurable falloff are copied unchanged.
+	Devignette bool
+	// BackgroundKey, when set, replaces the analysis with a color key: the
+	// crop is the bounding box of the pixels further than
+	// BackgroundTolerance from this color, within the max crop, and the
+	// pixels of the crop that do match are made transparent. Output is
+	// always an 8-bit RGBA PNG.
+	BackgroundKey color.Color
+	// BackgroundTolerance is the largest difference, in 0-255 units, any RGB
+	// channel of a pixel may have from BackgroundKey to count as background
+	BackgroundTolerance float64
+	// Tiled reads non-interlaced PNGs a strip of rows at a time instead of
+	// decoding them whole, for images too large for memory. The analysis
+	// runs on an overview downscaled while reading, at most
+	// tiledOverviewSize pixels on its longest side, so crop edges are only
+	// as precise as one overview pixel; the kept rows are then read again
+	// and written straight to the output. Other images, and options that need
+	// the whole image (Rotate, Normalize, Devignette, BackgroundKey,
+	// SkipIfLarger, Stats, Cache, ThumbnailPath, BrightnessMapPath, a
+	// non-PNG OutputFormat and BitDepth8 on 16-bit PNGs), decode as usual.
+	Tiled bool
+	// referenceAnchor centers the patch AdaptiveReference falls back to.
+	// findUniformCrop fixes it at the center of the uncropped reference
+	// region, so an uneven crop does not move the patch off the subject.
+	referenceAnchor *image.Point
+}
+
+// LumaWeights are the red, green and blue coefficients used to compute
+// brightness. They should sum to 1 to keep brightness on the 0-255 scale.
+type LumaWeights struct {
+	R, G, B float64
+}
+
+var (
+	// LumaBT601 are the Rec. 601 (SD video, JPEG) coefficients
+	LumaBT601 = LumaWeights{R: 0.299, G: 0.587, B: 0.114}
+	// LumaBT709 are the Rec. 709 (HD video, sRGB) coefficients
+	LumaBT709 = LumaWeights{R: 0.2126, G: 0.7152, B: 0.0722}
+)
+
+// luma returns the luminance coefficients to use, defaulting to BT.601
+func (o CropOptions) luma() LumaWeights {
+	if o.Luma == (LumaWeights{}) {
+		return LumaBT601
+	}
+	return o.Luma
+}
+
+// stride returns the sampling stride for brightness averages, at least 1
+func (o CropOptions) stride() int {
+	return max(o.SampleStride, 1)
+}
+
+// quality returns the JPEG quality to encode with, defaulting to jpegQuality
+func (o CropOptions) quality() int {
+	if o.JPEGQuality == 0 {
+		return jpegQuality
+	}
+	return o.JPEGQuality
+}
+
+// cropStep returns the pixels one brightness search step removes from an
+// edge of a width x height region, at least 1
+func (o CropOptions) cropStep(width, height int) int {
+	percent := o.CropStepPercent
+	if percent == 0 {
+		percent = defaultCropStepPercent
+	}
+	return max(1, int(float64(width+height)/2*percent/100))
+}
+
+// rotates reports whether Rotate turns images at all
+func (o CropOptions) rotates() bool {
+	return o.Rotate == 90 || o.Rotate == 180 || o.Rotate == 270
+}
+
+// BitDepth selects the sample depth of cropped output
+type BitDepth string
+
+const (
+	// BitDepthKeep writes 16-bit sources as 16-bit where the format allows
+	BitDepthKeep BitDepth = "keep"
+	// BitDepth8 narrows 16-bit sources to 8 bits per sample
+	BitDepth8 BitDepth = "8"
+)
+
+// ReferencePoint is a position in normalized image coordinates, with (0, 0)
+// the top-left and (1, 1) the bottom-right corner
+type ReferencePoint struct {
+	X, Y float64
+}
+
+// Inset is a distance from an image edge, in pixels plus a percentage of
+// the dimension across that edge
+type Inset struct {
+	Pixels  int
+	Percent float64
+}
+
+// ManualCrop is how many pixels CropOptions.ManualCrop removes from each edge
+type ManualCrop struct {
+	Top, Bottom, Left, Right int
+}
+
+// SafeArea is the region inside the given insets from each image edge
+type SafeArea struct {
+	Top, Right, Bottom, Left Inset
+}
+
+// rect returns the safe area of an image with the given bounds
+func (a SafeArea) rect(bounds image.Rectangle) image.Rectangle {
+	inset := func(in Inset, size int) int {
+		return in.Pixels + int(float64(size)*in.Percent/100.0)
+	}
+	return image.Rect(
+		bounds.Min.X+inset(a.Left, bounds.Dx()),
+		bounds.Min.Y+inset(a.Top, bounds.Dy()),
+		bounds.Max.X-inset(a.Right, bounds.Dx()),
+		bounds.Max.Y-inset(a.Bottom, bounds.Dy()),
+	).Intersect(bounds)
 }
 
 // CropImage analyzes an image's brightness and crops edges that are significantly
 // darker or brighter than the rest of the image to achieve uniform lighting
-func CropImage(inputPath, outputPath string, tolerance, maxCropPercent float64) (*CropResult, error) {
-	// Open the input file
-	file, err := os.Open(inputPath)
+func CropImage(inputPath, outputPath string, opts CropOptions) (*CropResult, error) {
+	out, err := prepareOutput(inputPath, outputPath, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open input file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
+	if err := out.write(); err != nil {
+		return nil, err
+	}
+	return out.result, nil
+}
 
-	// Decode the image (supports JPEG and PNG)
-	img, format, err := image.Decode(file)
+// CropImageStream is CropImage for images that do not live in files. It reads
+// the image from r and writes the cropped image, or the unchanged input, to
+// w. The extension of name picks the output format when the input format
+// has no encoder.
+func CropImageStream(r io.ReadSeeker, w io.Writer, name string, opts CropOptions) (*CropResult, error) {
+	// Per-format limits apply before a decode slot is taken, so a worker
+	// waiting for its format does not hold memory other formats could use
+	if opts.FormatLimiters != nil || opts.Mode == ModeGIFAnimated {
+		_, format, err := image.DecodeConfig(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %w", err)
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind input: %w", err)
+		}
+		limiter := opts.FormatLimiters[format]
+		limiter.acquire()
+		defer limiter.release()
+
+		// Animated GIFs need every frame, not just the first one
+		if opts.Mode == ModeGIFAnimated && format == "gif" {
+			opts.DecodeLimiter.acquire()
+			defer opts.DecodeLimiter.release()
+			result, err := cropAnimatedGIF(r, w, opts)
+			if err != nil {
+				return nil, err
+			}
+			result.Format = format
+			result.addNotes(extensionNotes(name, format))
+			return result, nil
+		}
+	}
+
+	// Huge PNGs are read and written a strip of rows at a time
+	var tiledNotes []string
+	if opts.Tiled {
+		result, note, err := cropTiled(r, w, name, opts)
+		if err != nil || result != nil {
+			return result, err
+		}
+		tiledNotes = append(tiledNotes, note)
+	}
+
+	// Decode the image (supports JPEG, PNG and GIF). The decoded pixels stay in
+	// memory until this call returns, so the limiter slot is held until then.
+	opts.DecodeLimiter.acquire()
+	defer opts.DecodeLimiter.release()
+
+	// Identical content is only analyzed once when caching
+	var key *[sha256.Size]byte
+	if opts.Cache != nil {
+		sum, err := hashContent(r)
+		if err != nil {
+			return nil, err
+		}
+		key = &sum
+	}
+
+	img, format, err := image.Decode(r)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode image: %w", err)
 	}
+	// No encoder writes CMYK, so a cropped print image comes out as RGB
+	_, cmyk := img.(*image.CMYK)
+
+	// Turn the image first, the crop is found and reported in display
+	// orientation
+	img, orientation, err := orientImage(img, format, r, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	bounds := img.Bounds()
 	width := bounds.Dx()
 	height := bounds.Dy()
 
-	// Check if image is already uniform
-	if isUniform(img, bounds, tolerance) {
-		// Copy unchanged
-		return copyImage(inputPath, outputPath)
+	// The map shows the whole upright image, cropped or not
+	var brightnessMap []byte
+	if opts.BrightnessMapPath != "" {
+		if brightnessMap, err = encodeBrightnessMap(img, opts); err != nil {
+			return nil, err
+		}
 	}
 
-	// Perform iterative cropping to achieve uniform brightness
-	cropRect, err := findUniformCrop(img, bounds, tolerance, maxCropPercent)
+	// A tolerance picked for this image is reported with the result
+	var tolerance float64
+	if opts.AutoTolerance {
+		opts = withAutoTolerance(img, opts)
+		tolerance = opts.Tolerance
+	}
+
+	var stats *ImageStats
+	if opts.Stats {
+		stats = imageStats(img, opts)
+	}
+
+	cropRect, reason, stop, err := cachedCropRect(img, key, opts)
 	if err != nil {
 		return nil, err
 	}
+	confidence := cropConfidence(img, bounds, cropRect, opts.luma(), opts.cropStep(bounds.Dx(), bounds.Dy()))
+	cropRect, reason, notes := adjustCropRect(cropRect, bounds, reason, opts)
+	notes = append(notes, toleranceNotes(tolerance, opts)...)
+	notes = append(notes, extensionNotes(name, format)...)
+	notes = append(notes, tiledNotes...)
 
-	// Check if we ended up cropping anything
-	if cropRect.Dx() == width && cropRect.Dy() == height {
+	// A lossless crop keeps whole blocks of the source, so its corner moves
+	// onto their grid
+	reoriented := orientation != 1 || opts.rotates()
+	var coefficients *jpegCoefficients
+	converts := opts.OutputFormat != "" && opts.OutputFormat != format
+	if opts.LosslessJPEG && format == "jpeg" && !converts && !cmyk && !reoriented && !opts.Normalize && !opts.Progressive && opts.MaxFileSize <= 0 && opts.BackgroundKey == nil && !cropRect.Eq(bounds) {
+		var note string
+		coefficients, note, err = readJPEGCoefficients(r)
+		if err != nil {
+			return nil, err
+		}
+		if coefficients != nil {
+			mcu := coefficients.mcuSize()
+			if snapped := snapToMCU(cropRect, bounds, mcu); !snapped.Eq(cropRect) {
+				cropRect = snapped
+				note = fmt.Sprintf("crop corner moved onto the %dx%d JPEG block grid", mcu.X, mcu.Y)
+				if cropRect.Eq(bounds) {
+					reason = BelowMinCrop
+					note = fmt.Sprintf("crop smaller than one %dx%d JPEG block", mcu.X, mcu.Y)
+				}
+			}
+		}
+		if note != "" {
+			notes = append(notes, note)
+		}
+	}
+
+	// Check if we ended up cropping anything. Reoriented images are written
+	// whole rather than copied, so their pixels are upright either way.
+	cropped := cropRect.Dx() != width || cropRect.Dy() != height
+	copyUnchanged := func(reason UnchangedReason, notes []string) (*CropResult, error) {
+		result, err := copyImage(r, w, reason)
+		if err != nil {
+			return nil, err
+		}
+		result.OriginalSize = bounds.Size()
+		result.CropRect = bounds
+		result.Format = format
+		result.Tolerance = tolerance
+		result.StopCondition = stop
+		result.Stats = stats
+		result.addNotes(notes)
+		result.brightnessMap = brightnessMap
+		if opts.ThumbnailPath != "" {
+			if result.thumbnail, err = encodeThumbnail(img, format, opts); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	// Devignetting writes the whole image corrected instead of a crop
+	var vignette *vignetteModel
+	if opts.Devignette {
+		var note string
+		vignette, note = fitVignette(img, opts)
+		notes = append(notes, note)
+	}
+
+	// Keyed, corrected and converted output always differs from the input,
+	// even when uncropped
+	keyed := opts.BackgroundKey != nil
+	if !cropped && !reoriented && !keyed && vignette == nil && !converts {
 		// No crop was possible while staying within limits
-		return copyImage(inputPath, outputPath)
+		return copyUnchanged(reason, notes)
 	}
 
 	// Create and save the cropped image
-	croppedImg := image.NewRGBA(image.Rect(0, 0, cropRect.Dx(), cropRect.Dy()))
-	for y := cropRect.Min.Y; y < cropRect.Max.Y; y++ {
-		for x := cropRect.Min.X; x < cropRect.Max.X; x++ {
-			croppedImg.Set(x-cropRect.Min.X, y-cropRect.Min.Y, img.At(x, y))
+	croppedImg := cropToRect(img, cropRect, opts.BitDepth == BitDepth8)
+	if opts.Normalize && cropped {
+		croppedImg = normalizeLevels(croppedImg, opts.luma())
+	}
+	if vignette != nil {
+		correctVignette(croppedImg.(draw.Image), *vignette)
+	}
+	// Transparency needs PNG whatever the input format
+	encodeFormat := format
+	if opts.OutputFormat != "" {
+		encodeFormat = opts.OutputFormat
+	}
+	if keyed {
+		var note string
+		croppedImg, note = keyOutBackground(croppedImg, opts)
+		notes = append(notes, note)
+		encodeFormat = "png"
+	}
+
+	// Encode based on detected format or output file extension
+	var buf bytes.Buffer
+	outFormat := "jpeg"
+	if coefficients != nil {
+		if err := coefficients.writeCrop(&buf, cropRect); err != nil {
+			return nil, fmt.Errorf("failed to crop JPEG losslessly: %w", err)
+		}
+		notes = append(notes, "cropped losslessly")
+	} else if outFormat, err = encodeImage(&buf, croppedImg, name, encodeFormat, opts); err != nil {
+		return nil, err
+	}
+	encoded := buf.Bytes()
+
+	// The encoder writes no metadata, copy what was asked for from the source
+	if outFormat == "jpeg" && format == "jpeg" && (opts.PreserveDPI || opts.CopyMetadata) {
+		encoded, err = transferJPEGMetadata(r, encoded, cmyk, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A minor crop is not worth a bigger file, e.g. a quality 70 source
+	// re-encoded at 95
+	if opts.SkipIfLarger && cropped && !reoriented && !converts && areaCropPercent(cropRect, bounds) < minorCropPercent {
+		inputSize, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure input: %w", err)
+		}
+		if int64(len(encoded)) > inputSize {
+			note := fmt.Sprintf("%.1f%% crop would grow %d bytes to %d", areaCropPercent(cropRect, bounds), inputSize, len(encoded))
+			return copyUnchanged(LargerOutput, append(notes, note))
 		}
 	}
 
+	if cmyk {
+		notes = append(notes, "converted from CMYK to RGB, print colors may shift")
+	}
+	if opts.MaxFileSize > 0 && outFormat == "jpeg" && int64(len(encoded)) > opts.MaxFileSize {
+		notes = append(notes, fmt.Sprintf("%d bytes exceeds max file size of %d even at lowest quality", len(encoded), opts.MaxFileSize))
+	}
+
 	// Save the cropped image
-	outFile, err := os.Create(outputPath)
+	if _, err := w.Write(encoded); err != nil {
+		return nil, fmt.Errorf("failed to write output: %w", err)
+	}
+
+	result := &CropResult{
+		WasCropped:    true,
+		Message:       fmt.Sprintf("cropped %.1f%% of image area", areaCropPercent(cropRect, bounds)),
+		OriginalSize:  bounds.Size(),
+		CropRect:      cropRect,
+		Format:        format,
+		Tolerance:     tolerance,
+		Confidence:    confidence,
+		StopCondition: stop,
+		Stats:         stats,
+	}
+	if !cropped && vignette != nil {
+		result.WasCropped = false
+		result.Message = "vignetting corrected, not cropped"
+		result.Corrected = true
+	} else if !cropped {
+		result.WasCropped = false
+		result.Message = unchangedMessages[reason]
+		result.UnchangedReason = reason
+	}
+	if orientation != 1 {
+		notes = append(notes, fmt.Sprintf("rotated upright from EXIF orientation %d", orientation))
+	}
+	if opts.rotates() {
+		notes = append(notes, fmt.Sprintf("rotated %d° clockwise", opts.Rotate))
+	}
+	result.addNotes(notes)
+	result.brightnessMap = brightnessMap
+	if opts.ThumbnailPath != "" {
+		if result.thumbnail, err = encodeThumbnail(croppedImg, encodeFormat, opts); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// toleranceNotes reports a tolerance picked with CropOptions.AutoTolerance,
+// in the units of opts.ThresholdMode; zero means none was picked
+func toleranceNotes(tolerance float64, opts CropOptions) []string {
+	if tolerance == 0 {
+		return nil
+	}
+	if opts.ThresholdMode == ThresholdAbsolute {
+		return []string{fmt.Sprintf("auto tolerance %g", tolerance)}
+	}
+	return []string{fmt.Sprintf("auto tolerance %g%%", tolerance)}
+}
+
+// extensionNotes reports a file name whose extension belongs to another
+// format than the content, as when a JPEG was saved as .png
+func extensionNotes(name, format string) []string {
+	if !ExtensionMismatch(name, format) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s content in a %s file", strings.ToUpper(format), filepath.Ext(name))}
+}
+
+// decodeFile opens and decodes an image file, turned as opts asks with
+// orientImage, returning the detected format
+func decodeFile(inputPath string, opts CropOptions) (image.Image, string, error) {
+	file, err := os.Open(inputPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create output file: %w", err)
+		return nil, "", fmt.Errorf("failed to open input file: %w", err)
 	}
-	defer outFile.Close()
+	defer file.Close()
 
-	// Encode based on detected format or output file extension
-	outputExt := strings.ToLower(filepath.Ext(outputPath))
-	if outputExt == ".png" || format == "png" {
-		if err := png.Encode(outFile, croppedImg); err != nil {
-			return nil, fmt.Errorf("failed to encode PNG image: %w", err)
+	img, format, err := image.Decode(file)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	img, _, err = orientImage(img, format, file, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return img, format, nil
+}
+
+// findCropRect determines the rectangle to keep. It returns the full image
+// bounds when no crop is needed, along with the reason the analysis stopped,
+// and the StopCondition of the brightness search when it ran.
+// Images one pixel wide or tall are uniform by definition in every mode; the
+// analyses' sample sizes and center regions degenerate on them.
+func findCropRect(img image.Image, opts CropOptions) (image.Rectangle, UnchangedReason, StopCondition, error) {
+	if opts.ManualCrop != nil {
+		return presetCropRect(img.Bounds(), opts)
+	}
+	if opts.Devignette {
+		return img.Bounds(), AlreadyUniform, "", nil
+	}
+	if opts.FixedRect != nil {
+		return presetCropRect(img.Bounds(), opts)
+	}
+	if bounds := img.Bounds(); bounds.Dx() <= 1 || bounds.Dy() <= 1 {
+		return bounds, AlreadyUniform, "", nil
+	}
+	opts = withAutoTolerance(img, opts)
+
+	rect, reason, stop, err := analyzeCropRect(img, opts)
+	if err != nil || opts.FaceDetector == nil || rect.Eq(img.Bounds()) {
+		return rect, reason, stop, err
+	}
+
+	// Faces are a keep-zone whatever the analysis found
+	protected := protectFaces(img, rect, opts.FaceDetector)
+	if protected.Eq(img.Bounds()) {
+		return protected, FacesProtected, stop, nil
+	}
+	return protected, reason, stop, nil
+}
+
+// presetCropRect returns the crop of opts.ManualCrop, or else of
+// opts.FixedRect, for an image with the given bounds. Neither looks at the
+// pixels.
+func presetCropRect(bounds image.Rectangle, opts CropOptions) (image.Rectangle, UnchangedReason, StopCondition, error) {
+	if m := opts.ManualCrop; m != nil {
+		rect := image.Rectangle{
+			Min: image.Pt(bounds.Min.X+m.Left, bounds.Min.Y+m.Top),
+			Max: image.Pt(bounds.Max.X-m.Right, bounds.Max.Y-m.Bottom),
 		}
-	} else {
-		// Default to JPEG
-		options := &jpeg.Options{Quality: 95}
-		if err := jpeg.Encode(outFile, croppedImg, options); err != nil {
-			return nil, fmt.Errorf("failed to encode JPEG image: %w", err)
+		if rect.Dx() <= 0 || rect.Dy() <= 0 {
+			return bounds, "", "", fmt.Errorf("manual crop of %d,%d,%d,%d pixels leaves nothing of the %dx%d image", m.Top, m.Bottom, m.Left, m.Right, bounds.Dx(), bounds.Dy())
 		}
+		return rect, NothingToCrop, "", nil
 	}
+	rect := opts.FixedRect.Intersect(bounds)
+	if rect.Empty() {
+		return bounds, "", "", fmt.Errorf("fixed crop rectangle %v lies outside the image", *opts.FixedRect)
+	}
+	return rect, NothingToCrop, "", nil
+}
 
-	cropPercent := (1.0 - float64(cropRect.Dx()*cropRect.Dy())/float64(width*height)) * 100
-	return &CropResult{
-		WasCropped: true,
-		Message:    fmt.Sprintf("cropped %.1f%% of image area", cropPercent),
-	}, nil
+// analyzeCropRect runs the analysis selected by opts. The stop condition is
+// only set by the brightness search.
+func analyzeCropRect(img image.Image, opts CropOptions) (image.Rectangle, UnchangedReason, StopCondition, error) {
+	bounds := img.Bounds()
+
+	if opts.MaskPath != "" {
+		// The mask decides what to keep, brightness is not analyzed
+		rect, reason, err := findMaskCrop(opts.MaskPath, bounds, opts.MaxCropPercent)
+		return rect, reason, "", err
+	}
+
+	if opts.BackgroundKey != nil {
+		// Colors are compared as they are, without preprocessing
+		rect, reason := findBackgroundCrop(img, bounds, opts)
+		return rect, reason, "", nil
+	}
+
+	img = analysisImage(img, opts)
+
+	switch opts.Mode {
+	case ModeEdges:
+		rect, reason := findEdgeCrop(img, opts)
+		return rect, reason, "", nil
+	case ModeChannelVariance:
+		rect, reason := findChannelVarianceCrop(img, bounds, opts)
+		return rect, reason, "", nil
+	}
+
+	// Check if image is already uniform. Scanner lines are too thin to fail
+	// this check, document mode always looks for them.
+	if opts.Mode != ModeDocument && isUniform(img, bounds, opts) {
+		return bounds, AlreadyUniform, StopUniform, nil
+	}
+
+	// Perform iterative cropping to achieve uniform brightness
+	return findUniformCrop(img, bounds, opts)
 }
 
-// copyImage copies an image file unchanged
-func copyImage(inputPath, outputPath string) (*CropResult, error) {
-	input, err := os.ReadFile(inputPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read input file: %w", err)
+// cropToRect copies the pixels inside rect into a new image anchored at the
+// origin. Paletted, grayscale, 16-bit and straight (non-premultiplied) alpha
+// sources keep their pixel type, so palettes, single-channel storage, bit
+// depth and semi-transparent edges survive the round trip unchanged. With
+// eightBit set, 16-bit sources are narrowed to their 8-bit counterparts.
+func cropToRect(img image.Image, rect image.Rectangle, eightBit bool) image.Image {
+	dst := image.Rect(0, 0, rect.Dx(), rect.Dy())
+
+	if eightBit {
+		switch img.(type) {
+		case *image.Gray16:
+			croppedImg := image.NewGray(dst)
+			draw.Draw(croppedImg, dst, img, rect.Min, draw.Src)
+			return croppedImg
+		case *image.RGBA64, *image.NRGBA64:
+			croppedImg := image.NewNRGBA(dst)
+			draw.Draw(croppedImg, dst, img, rect.Min, draw.Src)
+			return croppedImg
+		}
+	}
+
+	switch src := img.(type) {
+	case *image.Paletted:
+		// Keep the palette so GIF output is not re-quantized
+		croppedImg := image.NewPaletted(dst, src.Palette)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				croppedImg.SetColorIndex(x-rect.Min.X, y-rect.Min.Y, src.ColorIndexAt(x, y))
+			}
+		}
+		return croppedImg
+	case *image.Gray:
+		// Grayscale scans stay single-channel instead of growing to RGBA
+		croppedImg := image.NewGray(dst)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				croppedImg.SetGray(x-rect.Min.X, y-rect.Min.Y, src.GrayAt(x, y))
+			}
+		}
+		return croppedImg
+	case *image.Gray16:
+		croppedImg := image.NewGray16(dst)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				croppedImg.SetGray16(x-rect.Min.X, y-rect.Min.Y, src.Gray16At(x, y))
+			}
+		}
+		return croppedImg
+	case *image.RGBA64:
+		croppedImg := image.NewRGBA64(dst)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				croppedImg.SetRGBA64(x-rect.Min.X, y-rect.Min.Y, src.RGBA64At(x, y))
+			}
+		}
+		return croppedImg
+	case *image.NRGBA64:
+		croppedImg := image.NewNRGBA64(dst)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				croppedImg.SetNRGBA64(x-rect.Min.X, y-rect.Min.Y, src.NRGBA64At(x, y))
+			}
+		}
+		return croppedImg
+	case *image.NRGBA:
+		croppedImg := image.NewNRGBA(dst)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				croppedImg.SetNRGBA(x-rect.Min.X, y-rect.Min.Y, src.NRGBAAt(x, y))
+			}
+		}
+		return croppedImg
+	default:
+		croppedImg := image.NewRGBA(dst)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				croppedImg.Set(x-rect.Min.X, y-rect.Min.Y, img.At(x, y))
+			}
+		}
+		return croppedImg
 	}
+}
 
-	if err := os.WriteFile(outputPath, input, 0644); err != nil {
-		return nil, fmt.Errorf("failed to write output file: %w", err)
+// copyImage copies the input unchanged from the start, explaining why with
+// reason
+func copyImage(r io.ReadSeeker, w io.Writer, reason UnchangedReason) (*CropResult, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind input: %w", err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, fmt.Errorf("failed to copy image: %w", err)
 	}
 
 	return &CropResult{
-		WasCropped: false,
-		Message:    "already uniform, copied unchanged",
+		WasCropped:      false,
+		Message:         unchangedMessages[reason],
+		UnchangedReason: reason,
 	}, nil
 }
 
 // calculateBrightness calculates the perceived brightness of a color using luminance formula
-func calculateBrightness(c color.Color) float64 {
+func calculateBrightness(c color.Color, luma LumaWeights) float64 {
 	r, g, b, _ := c.RGBA()
-	// Convert from 16-bit to 8-bit and apply standard luminance formula
-	// Y = 0.299*R + 0.587*G + 0.114*B
-	return 0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(b>>8)
+	// Convert from 16-bit to 8-bit and apply the luminance formula
+	// Y = wR*R + wG*G + wB*B, e.g. Y = 0.299*R + 0.587*G + 0.114*B for BT.601
+	return luma.R*float64(r>>8) + luma.G*float64(g>>8) + luma.B*float64(b>>8)
 }
 
-// calculateRegionBrightness calculates average brightness for a region
-func calculateRegionBrightness(img image.Image, rect image.Rectangle) float64 {
+// calculateRegionBrightness calculates average brightness for a region from
+// every stride-th pixel in each direction
+func calculateRegionBrightness(img image.Image, rect image.Rectangle, luma LumaWeights, stride int) float64 {
 	var sum float64
 	count := 0
 
-	for y := rect.Min.Y; y < rect.Max.Y; y++ {
-		for x := rect.Min.X; x < rect.Max.X; x++ {
-			sum += calculateBrightness(img.At(x, y))
+	for y := rect.Min.Y; y < rect.Max.Y; y += stride {
+		for x := rect.Min.X; x < rect.Max.X; x += stride {
+			sum += calculateBrightness(img.At(x, y), luma)
 			count++
 		}
 	}
@@ -135,15 +1067,57 @@ func calculateRegionBrightness(img image.Image, rect image.Rectangle) float64 {
 	return sum / float64(count)
 }
 
-// isUniform checks if the image has uniform brightness within tolerance
-func isUniform(img image.Image, bounds image.Rectangle, tolerance float64) bool {
+// regionStdDev returns the standard deviation of the brightness of the
+// pixels in rect, visiting every stride-th pixel in x and y
+func regionStdDev(img image.Image, rect image.Rectangle, luma LumaWeights, stride int) float64 {
+	var sum, sumSq float64
+	count := 0
+	for y := rect.Min.Y; y < rect.Max.Y; y += stride {
+		for x := rect.Min.X; x < rect.Max.X; x += stride {
+			b := calculateBrightness(img.At(x, y), luma)
+			sum += b
+			sumSq += b * b
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	mean := sum / float64(count)
+	return math.Sqrt(math.Max(0, sumSq/float64(count)-mean*mean))
+}
+
+// withinTolerance reports whether an edge deviating from the center brightness
+// by deviation is acceptable. Relative comparisons on a center darker than
+// minRelativeBrightness compare against the absolute difference the tolerance
+// allows at minRelativeBrightness, so the threshold does not jump as the
+// center approaches black.
+func withinTolerance(deviation, centerBrightness float64, opts CropOptions) bool {
+	if opts.ThresholdMode == ThresholdAbsolute {
+		return deviation <= opts.Tolerance
+	}
+	if centerBrightness < minRelativeBrightness {
+		return deviation <= opts.Tolerance/100*minRelativeBrightness
+	}
+	return deviation/centerBrightness*100 <= opts.Tolerance
+}
+
+// referenceRect returns the region whose brightness serves as the reference
+// for edge comparisons: the inner 60% of bounds, or with CenterBox a square
+// of 60% of the shorter side, centered on the geometric center or on
+// opts.Reference, and kept inside bounds. Bounds too small for an inner
+// region are used whole.
+func referenceRect(bounds image.Rectangle, opts CropOptions) image.Rectangle {
 	width := bounds.Dx()
 	height := bounds.Dy()
 
-	// Calculate center region brightness (inner 60% of image)
-	// This prevents large dark edge regions from skewing the reference brightness
 	centerMarginX := width / 5 // 20% margin on each side = 60% center
 	centerMarginY := height / 5
+	if opts.CenterShape == CenterBox {
+		side := min(width, height) * 3 / 5
+		centerMarginX = (width - side) / 2
+		centerMarginY = (height - side) / 2
+	}
 	if centerMarginX < 1 {
 		centerMarginX = 1
 	}
@@ -161,10 +1135,60 @@ func isUniform(img image.Image, bounds image.Rectangle, tolerance float64) bool
 	// Ensure center rect is valid
 	if centerRect.Dx() <= 0 || centerRect.Dy() <= 0 {
 		// Image too small, fall back to overall average
-		centerRect = bounds
+		return bounds
+	}
+
+	if opts.Reference != nil {
+		// Move the region onto the reference point, clamped to the bounds
+		minX := bounds.Min.X + int(opts.Reference.X*float64(width)) - centerRect.Dx()/2
+		minY := bounds.Min.Y + int(opts.Reference.Y*float64(height)) - centerRect.Dy()/2
+		minX = max(bounds.Min.X, min(minX, bounds.Max.X-centerRect.Dx()))
+		minY = max(bounds.Min.Y, min(minY, bounds.Max.Y-centerRect.Dy()))
+		centerRect = centerRect.Add(image.Pt(minX, minY).Sub(centerRect.Min))
+	}
+
+	return centerRect
+}
+
+// referenceBrightness returns the brightness the edges of rect are compared
+// against, the mean of its referenceRect. With AdaptiveReference, a
+// reference region varying by more than the tolerance whose central patch of
+// adaptiveReferencePercent of each dimension is off its mean by more than
+// the tolerance is taken to still hold part of the border, as on images that
+// are mostly border, and the patch is used instead.
+func referenceBrightness(img image.Image, rect image.Rectangle, opts CropOptions) float64 {
+	luma := opts.luma()
+	ref := referenceRect(rect, opts)
+	brightness := calculateRegionBrightness(img, ref, luma, opts.stride())
+	if !opts.AdaptiveReference || withinTolerance(regionStdDev(img, ref, luma, opts.stride()), brightness, opts) {
+		return brightness
 	}
 
-	centerBrightness := calculateRegionBrightness(img, centerRect)
+	center := ref.Min.Add(ref.Max).Div(2)
+	if opts.referenceAnchor != nil {
+		center = *opts.referenceAnchor
+	}
+	half := image.Pt(max(rect.Dx()*adaptiveReferencePercent/200, 1), max(rect.Dy()*adaptiveReferencePercent/200, 1))
+	patch := image.Rectangle{center.Sub(half), center.Add(half)}.Intersect(rect)
+	if patch.Empty() {
+		return brightness
+	}
+	patchBrightness := calculateRegionBrightness(img, patch, luma, opts.stride())
+	if withinTolerance(math.Abs(patchBrightness-brightness), patchBrightness, opts) {
+		return brightness
+	}
+	return patchBrightness
+}
+
+// isUniform checks if the image has uniform brightness within tolerance
+func isUniform(img image.Image, bounds image.Rectangle, opts CropOptions) bool {
+	width := bounds.Dx()
+	height := bounds.Dy()
+	luma := opts.luma()
+
+	// Calculate center region brightness (inner 60% of image)
+	// This prevents large dark edge regions from skewing the reference brightness
+	centerBrightness := referenceBrightness(img, bounds, opts)
 
 	// Sample size for edge analysis (10% of dimension)
 	sampleWidth := width / 10
@@ -178,46 +1202,113 @@ func isUniform(img image.Image, bounds image.Rectangle, tolerance float64) bool
 
 	// Check top edge
 	topRect := image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+sampleHeight)
-	topBrightness := calculateRegionBrightness(img, topRect)
-	if math.Abs(topBrightness-centerBrightness)/centerBrightness*100 > tolerance {
+	topBrightness := calculateRegionBrightness(img, topRect, luma, opts.stride())
+	if !withinTolerance(math.Abs(topBrightness-centerBrightness), centerBrightness, opts) {
 		return false
 	}
 
 	// Check bottom edge
 	bottomRect := image.Rect(bounds.Min.X, bounds.Max.Y-sampleHeight, bounds.Max.X, bounds.Max.Y)
-	bottomBrightness := calculateRegionBrightness(img, bottomRect)
-	if math.Abs(bottomBrightness-centerBrightness)/centerBrightness*100 > tolerance {
+	bottomBrightness := calculateRegionBrightness(img, bottomRect, luma, opts.stride())
+	if !withinTolerance(math.Abs(bottomBrightness-centerBrightness), centerBrightness, opts) {
 		return false
 	}
 
 	// Check left edge
 	leftRect := image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Min.X+sampleWidth, bounds.Max.Y)
-	leftBrightness := calculateRegionBrightness(img, leftRect)
-	if math.Abs(leftBrightness-centerBrightness)/centerBrightness*100 > tolerance {
+	leftBrightness := calculateRegionBrightness(img, leftRect, luma, opts.stride())
+	if !withinTolerance(math.Abs(leftBrightness-centerBrightness), centerBrightness, opts) {
 		return false
 	}
 
 	// Check right edge
 	rightRect := image.Rect(bounds.Max.X-sampleWidth, bounds.Min.Y, bounds.Max.X, bounds.Max.Y)
-	rightBrightness := calculateRegionBrightness(img, rightRect)
-	if math.Abs(rightBrightness-centerBrightness)/centerBrightness*100 > tolerance {
+	rightBrightness := calculateRegionBrightness(img, rightRect, luma, opts.stride())
+	if !withinTolerance(math.Abs(rightBrightness-centerBrightness), centerBrightness, opts) {
 		return false
 	}
 
 	return true
 }
 
-// findUniformCrop progressively crops edges to achieve uniform brightness
-func findUniformCrop(img image.Image, bounds image.Rectangle, tolerance, maxCropPercent float64) (image.Rectangle, error) {
+// edgeBands returns the top, bottom, left and right bands of bounds, a tenth
+// of its height or width deep, that edges are first compared with
+func edgeBands(bounds image.Rectangle) [4]image.Rectangle {
+	sampleWidth := max(bounds.Dx()/10, 1)
+	sampleHeight := max(bounds.Dy()/10, 1)
+	return [4]image.Rectangle{
+		image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+sampleHeight),
+		image.Rect(bounds.Min.X, bounds.Max.Y-sampleHeight, bounds.Max.X, bounds.Max.Y),
+		image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Min.X+sampleWidth, bounds.Max.Y),
+		image.Rect(bounds.Max.X-sampleWidth, bounds.Min.Y, bounds.Max.X, bounds.Max.Y),
+	}
+}
+
+// maxEdgeContrast returns the largest absolute brightness difference between
+// an edge band and the reference region
+func maxEdgeContrast(img image.Image, bounds image.Rectangle, opts CropOptions) float64 {
+	center := referenceBrightness(img, bounds, opts)
+	contrast := 0.0
+	for _, band := range edgeBands(bounds) {
+		brightness := calculateRegionBrightness(img, band, opts.luma(), opts.stride())
+		contrast = math.Max(contrast, math.Abs(brightness-center))
+	}
+	return contrast
+}
+
+// findUniformCrop progressively crops edges to achieve uniform brightness. The
+// returned reason describes why cropping stopped and only matters when the
+// rectangle ends up equal to bounds.
+func findUniformCrop(img image.Image, bounds image.Rectangle, opts CropOptions) (image.Rectangle, UnchangedReason, StopCondition, error) {
 	width := bounds.Dx()
 	height := bounds.Dy()
+	maxCropPercent := opts.MaxCropPercent
+	luma := opts.luma()
 
 	// Calculate maximum pixels we can crop from each dimension
 	maxCropWidth := int(float64(width) * maxCropPercent / 100.0)
 	maxCropHeight := int(float64(height) * maxCropPercent / 100.0)
 
-	// Start with full image
+	// Optional per-edge limits stop one side from using a whole dimension's
+	// budget while the opposite side stays untouched
+	maxEdgeWidth := width
+	maxEdgeHeight := height
+	if opts.MaxCropPerEdgePercent > 0 {
+		maxEdgeWidth = int(float64(width) * opts.MaxCropPerEdgePercent / 100.0)
+		maxEdgeHeight = int(float64(height) * opts.MaxCropPerEdgePercent / 100.0)
+	}
+
+	// A limit that rounds down to zero pixels in both dimensions allows no crop
+	if maxCropWidth == 0 && maxCropHeight == 0 {
+		if maxCropPercent > 0 {
+			return bounds, TooSmall, StopTooSmall, nil
+		}
+		return bounds, CropLimitReached, StopCropLimit, nil
+	}
+
+	// Only a border that stands out by an absolute amount is worth a
+	// search; the tolerance alone lets marginal edges of dim images through
+	if opts.MinContrast > 0 && maxEdgeContrast(img, bounds, opts) <= opts.MinContrast {
+		return bounds, BelowMinContrast, StopBelowMinContrast, nil
+	}
+
+	if opts.AdaptiveReference {
+		ref := referenceRect(bounds, opts)
+		anchor := ref.Min.Add(ref.Max).Div(2)
+		opts.referenceAnchor = &anchor
+	}
+
+	// Start with full image, inset by a known minimum border, and in
+	// document mode with the scanner lines of what is left removed
 	cropRect := bounds
+	if opts.SeedInsetPixels > 0 || opts.SeedInsetPercent > 0 {
+		cropRect = seedInset(bounds, image.Pt(maxCropWidth, maxCropHeight), image.Pt(maxEdgeWidth, maxEdgeHeight), opts)
+	}
+	if opts.Mode == ModeDocument {
+		insetX := cropRect.Min.X - bounds.Min.X
+		insetY := cropRect.Min.Y - bounds.Min.Y
+		cropRect = stripScanLines(img, cropRect, image.Pt(maxEdgeWidth-insetX, maxEdgeHeight-insetY), image.Pt(maxCropWidth-2*insetX, maxCropHeight-2*insetY), luma)
+	}
 
 	// Iteratively crop edges that are non-uniform
 	// Allow enough iterations for large images (e.g., 4K images may need 2000+ iterations)
@@ -226,10 +1317,38 @@ func findUniformCrop(img image.Image, bounds image.Rectangle, tolerance, maxCrop
 		maxIterations = 100
 	}
 
+	// converged finishes a crop that passed the uniformity check at the
+	// tolerance in stepOpts
+	converged := func(rect image.Rectangle, stepOpts CropOptions, stop StopCondition) (image.Rectangle, UnchangedReason, StopCondition, error) {
+		if opts.Refine && !rect.Eq(bounds) {
+			rect = refineCrop(img, bounds, rect, stepOpts)
+		}
+		return rect, AlreadyUniform, stop, nil
+	}
+
+	// Edges locked with LockEdges, skipped while they are sure to be within
+	// the tolerance
+	locked := make(map[string]lockedEdge)
+	spread := 255 * (math.Abs(luma.R) + math.Abs(luma.G) + math.Abs(luma.B))
+
+	// With MinBorderWidth, edges that do not start with a flat border are
+	// never cropped
+	var flat map[string]bool
+	if opts.MinBorderWidth > 0 {
+		flat = flatBorderEdges(img, cropRect, opts.MinBorderWidth, opts)
+	}
+	skipped := func(edge string) bool {
+		return flat != nil && !flat[edge]
+	}
+
 	for i := 0; i < maxIterations; i++ {
+		// The tolerance tightens as the crop budget is used up
+		stepOpts := opts
+		stepOpts.Tolerance = effectiveTolerance(cropRect, bounds, maxCropWidth, maxCropHeight, opts)
+
 		// Check if current crop is uniform
-		if isUniform(img, cropRect, tolerance) {
-			return cropRect, nil
+		if isUniform(img, cropRect, stepOpts) {
+			return converged(cropRect, stepOpts, StopUniform)
 		}
 
 		// Calculate current crop dimensions
@@ -242,35 +1361,12 @@ func findUniformCrop(img image.Image, bounds image.Rectangle, tolerance, maxCrop
 
 		if croppedWidth >= maxCropWidth && croppedHeight >= maxCropHeight {
 			// Can't crop anymore
-			return cropRect, nil
+			return cropRect, CropLimitReached, StopCropLimit, nil
 		}
 
 		// Calculate center region brightness (inner 60% of current crop)
 		// This prevents large dark edge regions from skewing the reference brightness
-		centerMarginX := currentWidth / 5 // 20% margin on each side = 60% center
-		centerMarginY := currentHeight / 5
-		if centerMarginX < 1 {
-			centerMarginX = 1
-		}
-		if centerMarginY < 1 {
-			centerMarginY = 1
-		}
-
-		centerCropRect := image.Rect(
-			cropRect.Min.X+centerMarginX,
-			cropRect.Min.Y+centerMarginY,
-			cropRect.Max.X-centerMarginX,
-			cropRect.Max.Y-centerMarginY,
-		)
-
-		// Ensure center rect is valid
-		var centerBrightness float64
-		if centerCropRect.Dx() <= 0 || centerCropRect.Dy() <= 0 {
-			// Image too small, fall back to current crop area
-			centerBrightness = calculateRegionBrightness(img, cropRect)
-		} else {
-			centerBrightness = calculateRegionBrightness(img, centerCropRect)
-		}
+		centerBrightness := referenceBrightness(img, cropRect, opts)
 
 		// Sample size for edge detection (5% of current dimension)
 		sampleWidth := currentWidth / 20
@@ -282,77 +1378,237 @@ func findUniformCrop(img image.Image, bounds image.Rectangle, tolerance, maxCrop
 			sampleHeight = 1
 		}
 
-		// Check each edge and find the one that deviates most
-		edges := make(map[string]float64)
+		// Check each edge and find the one that deviates most. Edges are kept
+		// in a fixed order so ties always go to the same edge.
+		type edgeDeviation struct {
+			edge       string
+			rect       image.Rectangle
+			brightness float64
+			deviation  float64
+		}
+		var edges []edgeDeviation
+
+		// sample adds the deviation of the edge sampled over rect, unless
+		// the edge is locked and cannot have left the tolerance since it was
+		// last sampled. Skipping it then gives the same crop as sampling it:
+		// the worst edge is outside the tolerance whenever one is cropped.
+		lockedWithin := false
+		sample := func(edge string, rect image.Rectangle) {
+			if l, ok := locked[edge]; ok {
+				if withinTolerance(l.deviationBound(rect, centerBrightness, spread, opts.stride()), centerBrightness, stepOpts) {
+					lockedWithin = true
+					return
+				}
+				delete(locked, edge)
+			}
+			brightness := calculateRegionBrightness(img, rect, luma, opts.stride())
+			edges = append(edges, edgeDeviation{edge, rect, brightness, math.Abs(brightness - centerBrightness)})
+		}
+
+		// Edge samples span the crop. In multi-edge mode they only span the
+		// reference region's width or height instead, so the border of a
+		// neighboring edge does not darken them; every edge outside the
+		// tolerance is cropped at once, before the neighbor is gone.
+		span := cropRect
+		if opts.MultiEdge {
+			span = referenceRect(cropRect, opts)
+		}
+
+		// Pixels already removed from each edge
+		croppedTop := cropRect.Min.Y - bounds.Min.Y
+		croppedBottom := bounds.Max.Y - cropRect.Max.Y
+		croppedLeft := cropRect.Min.X - bounds.Min.X
+		croppedRight := bounds.Max.X - cropRect.Max.X
 
 		// Top edge
-		if croppedHeight < maxCropHeight {
-			topRect := image.Rect(cropRect.Min.X, cropRect.Min.Y, cropRect.Max.X, cropRect.Min.Y+sampleHeight)
-			topBrightness := calculateRegionBrightness(img, topRect)
-			edges["top"] = math.Abs(topBrightness - centerBrightness)
+		if croppedHeight < maxCropHeight && croppedTop < maxEdgeHeight && !skipped("top") {
+			topRect := image.Rect(span.Min.X, cropRect.Min.Y, span.Max.X, cropRect.Min.Y+sampleHeight)
+			sample("top", topRect)
 		}
 
 		// Bottom edge
-		if croppedHeight < maxCropHeight {
-			bottomRect := image.Rect(cropRect.Min.X, cropRect.Max.Y-sampleHeight, cropRect.Max.X, cropRect.Max.Y)
-			bottomBrightness := calculateRegionBrightness(img, bottomRect)
-			edges["bottom"] = math.Abs(bottomBrightness - centerBrightness)
+		if croppedHeight < maxCropHeight && croppedBottom < maxEdgeHeight && !skipped("bottom") {
+			bottomRect := image.Rect(span.Min.X, cropRect.Max.Y-sampleHeight, span.Max.X, cropRect.Max.Y)
+			sample("bottom", bottomRect)
 		}
 
 		// Left edge
-		if croppedWidth < maxCropWidth {
-			leftRect := image.Rect(cropRect.Min.X, cropRect.Min.Y, cropRect.Min.X+sampleWidth, cropRect.Max.Y)
-			leftBrightness := calculateRegionBrightness(img, leftRect)
-			edges["left"] = math.Abs(leftBrightness - centerBrightness)
+		if croppedWidth < maxCropWidth && croppedLeft < maxEdgeWidth && !skipped("left") {
+			leftRect := image.Rect(cropRect.Min.X, span.Min.Y, cropRect.Min.X+sampleWidth, span.Max.Y)
+			sample("left", leftRect)
 		}
 
 		// Right edge
-		if croppedWidth < maxCropWidth {
-			rightRect := image.Rect(cropRect.Max.X-sampleWidth, cropRect.Min.Y, cropRect.Max.X, cropRect.Max.Y)
-			rightBrightness := calculateRegionBrightness(img, rightRect)
-			edges["right"] = math.Abs(rightBrightness - centerBrightness)
+		if croppedWidth < maxCropWidth && croppedRight < maxEdgeWidth && !skipped("right") {
+			rightRect := image.Rect(cropRect.Max.X-sampleWidth, span.Min.Y, cropRect.Max.X, span.Max.Y)
+			sample("right", rightRect)
 		}
 
-		// If no edges can be cropped, we're done
+		// If no edges can be cropped, we're done. Edges skipped while locked
+		// are within the tolerance, as sampling them would have found.
 		if len(edges) == 0 {
-			return cropRect, nil
+			if lockedWithin {
+				return converged(cropRect, stepOpts, StopWithinTolerance)
+			}
+			return cropRect, CropLimitReached, StopNoCroppableEdges, nil
 		}
 
 		// Find edge with maximum deviation
 		var maxEdge string
 		var maxDeviation float64
-		for edge, deviation := range edges {
-			if deviation > maxDeviation {
-				maxDeviation = deviation
-				maxEdge = edge
+		for _, e := range edges {
+			if e.deviation > maxDeviation {
+				maxDeviation = e.deviation
+				maxEdge = e.edge
 			}
 		}
 
 		// If max deviation is within tolerance, we're done
-		if maxDeviation/centerBrightness*100 <= tolerance {
-			return cropRect, nil
+		if withinTolerance(maxDeviation, centerBrightness, stepOpts) {
+			return converged(cropRect, stepOpts, StopWithinTolerance)
+		}
+
+		// Edges well within the tolerance are taken to be content and not
+		// sampled again while they are sure to stay within it
+		if opts.LockEdges {
+			for _, e := range edges {
+				if withinTolerance(e.deviation/lockedEdgeRatio, centerBrightness, stepOpts) {
+					locked[e.edge] = lockedEdge{e.rect, e.brightness}
+				}
+			}
 		}
 
-		// Crop the edge with maximum deviation
-		// Crop more aggressively (1% of dimension or at least 1 pixel) to speed up processing
-		cropAmount := int(math.Max(1, float64(currentWidth+currentHeight)/200))
+		// Crop the edge with maximum deviation, or in multi-edge mode every
+		// edge outside the tolerance
+		stepEdges := []string{maxEdge}
+		if opts.MultiEdge {
+			stepEdges = stepEdges[:0]
+			for _, e := range edges {
+				if !withinTolerance(e.deviation, centerBrightness, stepOpts) {
+					stepEdges = append(stepEdges, e.edge)
+				}
+			}
+		}
+
+		// Crop more aggressively (1% of dimension or at least 1 pixel by
+		// default) to speed up processing
+		cropAmount := opts.cropStep(currentWidth, currentHeight)
 
-		switch maxEdge {
-		case "top":
-			cropRect.Min.Y += cropAmount
-		case "bottom":
-			cropRect.Max.Y -= cropAmount
-		case "left":
-			cropRect.Min.X += cropAmount
-		case "right":
-			cropRect.Max.X -= cropAmount
+		// Never step past an edge's own limit. Opposite edges cropped in the
+		// same iteration also share what is left of the dimension's budget.
+		heightLeft := maxCropHeight - croppedHeight
+		widthLeft := maxCropWidth - croppedWidth
+		for _, edge := range stepEdges {
+			switch edge {
+			case "top":
+				step := multiEdgeStep(min(cropAmount, maxEdgeHeight-croppedTop), &heightLeft, opts)
+				cropRect.Min.Y += step
+			case "bottom":
+				step := multiEdgeStep(min(cropAmount, maxEdgeHeight-croppedBottom), &heightLeft, opts)
+				cropRect.Max.Y -= step
+			case "left":
+				step := multiEdgeStep(min(cropAmount, maxEdgeWidth-croppedLeft), &widthLeft, opts)
+				cropRect.Min.X += step
+			case "right":
+				step := multiEdgeStep(min(cropAmount, maxEdgeWidth-croppedRight), &widthLeft, opts)
+				cropRect.Max.X -= step
+			}
 		}
 
 		// Sanity check
 		if cropRect.Dx() <= 0 || cropRect.Dy() <= 0 {
-			return bounds, fmt.Errorf("crop would result in empty image")
+			return bounds, "", "", fmt.Errorf("crop would result in empty image")
 		}
 	}
 
-	return cropRect, nil
+	return cropRect, NoConvergence, StopIterationCap, nil
+}
+
+// lockedEdge is an edge locked with CropOptions.LockEdges: the rectangle it
+// was last sampled over and the brightness found there
+type lockedEdge struct {
+	rect       image.Rectangle
+	brightness float64
+}
+
+// deviationBound returns the most the brightness of the edge sampled over
+// rect can deviate from centerBrightness. The averages over rect and over
+// the locked rectangle differ by at most spread, the brightness range of a
+// pixel, times the share of each rectangle outside the other. With a stride
+// another rectangle samples other pixels, so nothing is known.
+func (l lockedEdge) deviationBound(rect image.Rectangle, centerBrightness, spread float64, stride int) float64 {
+	deviation := math.Abs(l.brightness - centerBrightness)
+	if rect.Eq(l.rect) {
+		return deviation
+	}
+	if stride > 1 {
+		return math.Inf(1)
+	}
+	common := pixelCount(rect.Intersect(l.rect))
+	return deviation + spread*(2-common/pixelCount(l.rect)-common/pixelCount(rect))
+}
+
+// pixelCount returns the number of pixels in r
+func pixelCount(r image.Rectangle) float64 {
+	return float64(r.Dx()) * float64(r.Dy())
+}
+
+// seedInset returns bounds inset on every side by the minimum border given
+// in opts, limited so no edge passes maxEdge and no dimension loses more
+// than maxCrop
+func seedInset(bounds image.Rectangle, maxCrop, maxEdge image.Point, opts CropOptions) image.Rectangle {
+	x := opts.SeedInsetPixels + int(float64(bounds.Dx())*opts.SeedInsetPercent/100.0)
+	y := opts.SeedInsetPixels + int(float64(bounds.Dy())*opts.SeedInsetPercent/100.0)
+	x = min(x, maxCrop.X/2, maxEdge.X)
+	y = min(y, maxCrop.Y/2, maxEdge.Y)
+	return image.Rect(bounds.Min.X+x, bounds.Min.Y+y, bounds.Max.X-x, bounds.Max.Y-y)
+}
+
+// multiEdgeStep limits an edge's step to the budget left in its dimension
+// when several edges are cropped per iteration, and charges the step to it.
+// The single-edge search takes the step as is.
+func multiEdgeStep(step int, budgetLeft *int, opts CropOptions) int {
+	if !opts.MultiEdge {
+		return step
+	}
+	step = max(min(step, *budgetLeft), 0)
+	*budgetLeft -= step
+	return step
+}
+
+// effectiveTolerance lowers the tolerance linearly with the share of the crop
+// budget already used, by up to ToleranceFalloff of it once the budget is
+// spent. This removes obvious borders leniently and then stops nibbling at
+// soft gradients.
+func effectiveTolerance(rect, bounds image.Rectangle, maxCropWidth, maxCropHeight int, opts CropOptions) float64 {
+	if opts.ToleranceFalloff <= 0 || maxCropWidth+maxCropHeight == 0 {
+		return opts.Tolerance
+	}
+	cropped := bounds.Dx() - rect.Dx() + bounds.Dy() - rect.Dy()
+	used := math.Min(1, float64(cropped)/float64(maxCropWidth+maxCropHeight))
+	return opts.Tolerance * (1 - opts.ToleranceFalloff*used)
+}
+
+// refineCrop backs each cropped edge of rect out one pixel at a time while
+// the result stays uniform, undoing the overshoot of the coarse crop steps.
+// No edge moves by more than the largest coarse step.
+func refineCrop(img image.Image, bounds, rect image.Rectangle, opts CropOptions) image.Rectangle {
+	step := opts.cropStep(bounds.Dx(), bounds.Dy())
+
+	grow := []func(r image.Rectangle) (image.Rectangle, bool){
+		func(r image.Rectangle) (image.Rectangle, bool) { r.Min.Y--; return r, r.Min.Y >= bounds.Min.Y },
+		func(r image.Rectangle) (image.Rectangle, bool) { r.Max.Y++; return r, r.Max.Y <= bounds.Max.Y },
+		func(r image.Rectangle) (image.Rectangle, bool) { r.Min.X--; return r, r.Min.X >= bounds.Min.X },
+		func(r image.Rectangle) (image.Rectangle, bool) { r.Max.X++; return r, r.Max.X <= bounds.Max.X },
+	}
+	for _, expand := range grow {
+		for i := 0; i < step; i++ {
+			expanded, ok := expand(rect)
+			if !ok || !isUniform(img, expanded, opts) {
+				break
+			}
+			rect = expanded
+		}
+	}
+	return rect
 }
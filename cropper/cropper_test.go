@@ -0,0 +1,493 @@
+package cropper
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestSemiTransparentPNGKeepsAlpha(t *testing.T) {
+	// An opaque black frame around a gradient whose alpha runs from almost
+	// transparent to almost opaque; premultiplying would round the color of
+	// the faint pixels away
+	img := image.NewNRGBA(image.Rect(0, 0, 80, 60))
+	content := image.Rect(10, 10, 70, 50)
+	for y := range 60 {
+		for x := range 80 {
+			c := color.NRGBA{A: 255}
+			if image.Pt(x, y).In(content) {
+				c = color.NRGBA{200, uint8(100 + x), uint8(50 + y), uint8(1 + (x-10)*4)}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	result, out := cropBytes(t, pngBytes(t, img), "fade.png", CropOptions{Tolerance: 10, MaxCropPercent: 40})
+	if !result.WasCropped {
+		t.Fatalf("got %q, want a crop", result.Message)
+	}
+	rect, _, _, err := findUniformCrop(img, img.Bounds(), CropOptions{Tolerance: 10, MaxCropPercent: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nrgba, ok := decoded.(*image.NRGBA)
+	if !ok {
+		t.Fatalf("output decoded as %T, want *image.NRGBA", decoded)
+	}
+	if size := nrgba.Bounds().Size(); size != rect.Size() {
+		t.Fatalf("output size %v, want the crop %v", size, rect)
+	}
+	for y := range rect.Dy() {
+		for x := range rect.Dx() {
+			want := img.NRGBAAt(rect.Min.X+x, rect.Min.Y+y)
+			if got := nrgba.NRGBAAt(x, y); got != want {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+// framedGray returns a w x h grayscale image of brightness inner with a
+// frame of the given width and brightness on every side
+func framedGray(w, h, width int, inner, frame uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	content := image.Rect(width, width, w-width, h-width)
+	for y := range h {
+		for x := range w {
+			v := frame
+			if image.Pt(x, y).In(content) {
+				v = inner
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	return img
+}
+
+func TestGrayscaleKeepsType(t *testing.T) {
+	img := framedGray(120, 90, 10, 160, 0)
+	var jpegData bytes.Buffer
+	if err := encodeJPEG(&jpegData, img, CropOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"scan.png", pngBytes(t, img)},
+		{"scan.jpg", jpegData.Bytes()},
+	} {
+		result, out := cropBytes(t, tc.data, tc.name, CropOptions{Tolerance: 5, MaxCropPercent: 40})
+		if !result.WasCropped {
+			t.Errorf("%s: got %q, want a crop", tc.name, result.Message)
+			continue
+		}
+		decoded, _, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := decoded.Bounds().Size(), image.Pt(100, 70); got != want {
+			t.Errorf("%s: output size %v, want the dark border removed, %v", tc.name, got, want)
+		}
+		if _, ok := decoded.(*image.Gray); !ok {
+			t.Errorf("%s: output decoded as %T, want *image.Gray", tc.name, decoded)
+		}
+	}
+}
+
+func TestBlackCenter(t *testing.T) {
+	// At tolerance 20 a relative comparison on a black center allows a
+	// brightness difference of 2
+	for _, tc := range []struct {
+		name  string
+		img   *image.Gray
+		mode  ThresholdMode
+		crops bool
+	}{
+		{"all black", framedGray(120, 90, 0, 0, 0), ThresholdRelative, false},
+		{"all black absolute", framedGray(120, 90, 0, 0, 0), ThresholdAbsolute, false},
+		{"lit frame", framedGray(120, 90, 10, 0, 80), ThresholdRelative, true},
+		{"lit frame absolute", framedGray(120, 90, 10, 0, 80), ThresholdAbsolute, true},
+		{"dim frame", framedGray(120, 90, 10, 0, 6), ThresholdRelative, true},
+		{"nearly black frame", framedGray(120, 90, 10, 0, 1), ThresholdRelative, false},
+		{"nearly black center", framedGray(120, 90, 10, 2, 3), ThresholdRelative, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := CropOptions{Tolerance: 20, MaxCropPercent: 40, ThresholdMode: tc.mode}
+			result, _ := cropBytes(t, pngBytes(t, tc.img), "night.png", opts)
+			if result.WasCropped != tc.crops {
+				t.Fatalf("got %q, want cropped %v", result.Message, tc.crops)
+			}
+			if content := image.Rect(10, 10, 110, 80); tc.crops && !content.In(result.CropRect) {
+				t.Errorf("crop %v cuts into the content %v", result.CropRect, content)
+			}
+		})
+	}
+}
+
+func TestWithinToleranceDarkCenter(t *testing.T) {
+	opts := CropOptions{Tolerance: 20}
+	for _, center := range []float64{0, 0.001, 5, minRelativeBrightness} {
+		allowed := opts.Tolerance / 100 * minRelativeBrightness
+		if !withinTolerance(allowed, center, opts) {
+			t.Errorf("center %v: deviation %v rejected, want the threshold of a center at %v", center, allowed, minRelativeBrightness)
+		}
+		if withinTolerance(allowed*1.01, center, opts) {
+			t.Errorf("center %v: deviation %v accepted, want it over the threshold", center, allowed*1.01)
+		}
+		if withinTolerance(math.NaN(), center, opts) || withinTolerance(math.Inf(1), center, opts) {
+			t.Errorf("center %v: NaN or infinite deviation accepted", center)
+		}
+	}
+}
+
+func TestMultiEdgeMatchesSingleEdge(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	for range 12 {
+		w, h := 300+rng.IntN(300), 200+rng.IntN(200)
+		left, right, top, bottom := rng.IntN(w/6), rng.IntN(w/6), rng.IntN(h/6), rng.IntN(h/6)
+		content := image.Rect(left, top, w-right, h-bottom)
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := range h {
+			for x := range w {
+				v := 20 + rng.IntN(11)
+				if image.Pt(x, y).In(content) {
+					v = 130 + rng.IntN(41)
+				}
+				img.SetGray(x, y, color.Gray{uint8(v)})
+			}
+		}
+
+		opts := CropOptions{Tolerance: 15, MaxCropPercent: 40}
+		single, _, _, err := findUniformCrop(img, img.Bounds(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.MultiEdge = true
+		multi, _, _, err := findUniformCrop(img, img.Bounds(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Both stop within a step or so of the border, not always the same
+		// one: the edges are stepped in another order, from other crops
+		limit := 2 * opts.cropStep(w, h)
+		for _, d := range []int{single.Min.X - multi.Min.X, single.Min.Y - multi.Min.Y, single.Max.X - multi.Max.X, single.Max.Y - multi.Max.Y} {
+			if max(d, -d) > limit {
+				t.Errorf("%dx%d with content %v: multi-edge crop %v, single-edge %v, want them within %d pixels", w, h, content, multi, single, limit)
+				break
+			}
+		}
+	}
+}
+
+func TestMultiEdgeMixedBorders(t *testing.T) {
+	// Borders darker and lighter than the content on different sides. The
+	// two searches step them in another order and stop at other points, but
+	// neither cuts into the flat content or leaves more of a border than
+	// half of the band isUniform compares.
+	shades := [4]int{10, 235, 60, 200}
+	rng := rand.New(rand.NewPCG(3, 4))
+	for range 8 {
+		w, h := 300+rng.IntN(300), 200+rng.IntN(200)
+		left, right, top, bottom := 5+rng.IntN(w/6), 5+rng.IntN(w/6), 5+rng.IntN(h/6), 5+rng.IntN(h/6)
+		content := image.Rect(left, top, w-right, h-bottom)
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := range h {
+			for x := range w {
+				var v int
+				switch {
+				case image.Pt(x, y).In(content):
+					v = 130 + rng.IntN(21)
+				case x < left:
+					v = shades[0]
+				case x >= w-right:
+					v = shades[1]
+				case y < top:
+					v = shades[2]
+				default:
+					v = shades[3]
+				}
+				img.SetGray(x, y, color.Gray{uint8(v)})
+			}
+		}
+
+		for _, multiEdge := range []bool{false, true} {
+			opts := CropOptions{Tolerance: 15, MaxCropPercent: 40, MultiEdge: multiEdge}
+			rect, _, _, err := findUniformCrop(img, img.Bounds(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Border left on each side, and how much is allowed
+			for _, side := range []struct{ left, allowed int }{
+				{content.Min.X - rect.Min.X, w / 20}, {rect.Max.X - content.Max.X, w / 20},
+				{content.Min.Y - rect.Min.Y, h / 20}, {rect.Max.Y - content.Max.Y, h / 20},
+			} {
+				if side.left < 0 || side.left > side.allowed {
+					t.Errorf("%dx%d, multi-edge %v: crop %v, want the content %v with at most %d pixels of border across and %d down", w, h, multiEdge, rect, content, w/20, h/20)
+					break
+				}
+			}
+		}
+	}
+}
+
+// noisyImage returns a w x h image with a brightness gradient and seeded
+// noise of up to 20 either way, with a dark border of the given width
+func noisyImage(w, h, border int) *image.RGBA {
+	rng := rand.New(rand.NewPCG(1, 2))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	inner := image.Rect(border, border, w-border, h-border)
+	for y := range h {
+		for x := range w {
+			base := 40
+			if image.Pt(x, y).In(inner) {
+				base = 100 + 60*x/w
+			}
+			v := uint8(min(max(base+rng.IntN(41)-20, 0), 255))
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func TestSampleStrideError(t *testing.T) {
+	img := noisyImage(400, 300, 0)
+	regions := []image.Rectangle{
+		image.Rect(0, 0, 400, 300),
+		image.Rect(0, 0, 400, 30),    // a 10% edge band
+		image.Rect(370, 0, 400, 300), // the right band
+		image.Rect(80, 60, 320, 240), // the center region
+		image.Rect(13, 7, 50, 41),    // small and unaligned
+	}
+	for _, rect := range regions {
+		exact := calculateRegionBrightness(img, rect, LumaBT601, 1)
+		sampled := calculateRegionBrightness(img, rect, LumaBT601, 4)
+		if d := math.Abs(sampled - exact); d > 2 {
+			t.Errorf("region %v: stride 4 mean %.2f, exact %.2f, off by %.2f, want at most 2", rect, sampled, exact, d)
+		}
+	}
+
+	// The crop found with stride 4 stays within one search step of the exact
+	// one
+	data := pngBytes(t, noisyImage(400, 300, 30))
+	opts := CropOptions{Tolerance: 15, MaxCropPercent: 40}
+	exact, _ := cropBytes(t, data, "exact.png", opts)
+	if !exact.WasCropped {
+		t.Fatalf("stride 1: got %q, want a crop", exact.Message)
+	}
+	opts.SampleStride = 4
+	sampled, _ := cropBytes(t, data, "sampled.png", opts)
+	step := opts.cropStep(400, 300)
+	for _, d := range []int{
+		sampled.CropRect.Min.X - exact.CropRect.Min.X, sampled.CropRect.Min.Y - exact.CropRect.Min.Y,
+		sampled.CropRect.Max.X - exact.CropRect.Max.X, sampled.CropRect.Max.Y - exact.CropRect.Max.Y,
+	} {
+		if max(d, -d) > step {
+			t.Errorf("stride 4 crop %v, exact crop %v, more than %d pixels apart", sampled.CropRect, exact.CropRect, step)
+			break
+		}
+	}
+}
+
+func BenchmarkCalculateRegionBrightness(b *testing.B) {
+	img := noisyImage(2000, 1500, 0)
+	for _, stride := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("stride %d", stride), func(b *testing.B) {
+			for b.Loop() {
+				calculateRegionBrightness(img, img.Bounds(), LumaBT601, stride)
+			}
+		})
+	}
+}
+
+func TestDegenerateSizesCopiedUnchanged(t *testing.T) {
+	for _, size := range []image.Point{{1, 1}, {1, 100}, {100, 1}} {
+		// Dark ends, so there would be something to crop if the image had
+		// any width to crop from
+		img := image.NewGray(image.Rectangle{Max: size})
+		for y := range size.Y {
+			for x := range size.X {
+				v := uint8(128)
+				if x < 10 || y < 10 || x >= size.X-10 || y >= size.Y-10 {
+					v = 0
+				}
+				img.SetGray(x, y, color.Gray{v})
+			}
+		}
+		data := pngBytes(t, img)
+
+		for _, mode := range []Mode{ModeBrightness, ModeEdges, ModeChannelVariance, ModeDocument} {
+			t.Run(fmt.Sprintf("%dx%d %s", size.X, size.Y, mode), func(t *testing.T) {
+				opts := CropOptions{Tolerance: 10, MaxCropPercent: 40, Mode: mode, MultiEdge: true, Refine: true}
+				result, out := cropBytes(t, data, "thin.png", opts)
+				if result.WasCropped {
+					t.Errorf("got a crop to %v, want none", result.CropRect)
+				}
+				if !result.CropRect.Eq(img.Bounds()) {
+					t.Errorf("crop rect %v, want the bounds %v", result.CropRect, img.Bounds())
+				}
+				if !bytes.Equal(out, data) {
+					t.Errorf("output differs from the input, want an unchanged copy")
+				}
+			})
+		}
+	}
+}
+
+func TestDeterministicOutput(t *testing.T) {
+	// Equal borders on every side tie the edges in each search step, which
+	// once resolved in random map order
+	data := pngBytes(t, borderedImage(160, 160, 16, 0))
+	opts := CropOptions{Tolerance: 10, MaxCropPercent: 40, Deterministic: true}
+
+	first, want := cropBytes(t, data, "tie.png", opts)
+	if !first.WasCropped {
+		t.Fatalf("got %q, want a crop", first.Message)
+	}
+	for i := range 20 {
+		result, got := cropBytes(t, data, "tie.png", opts)
+		if !result.CropRect.Eq(first.CropRect) {
+			t.Fatalf("run %d: crop %v, first run %v", i+2, result.CropRect, first.CropRect)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("run %d: output bytes differ from the first run", i+2)
+		}
+	}
+}
+
+func TestCMYKSource(t *testing.T) {
+	ink := color.CMYK{C: 20, M: 40, Y: 60, K: 10}
+	img := image.NewCMYK(image.Rect(0, 0, 64, 48))
+	content := image.Rect(8, 8, 56, 40)
+	for y := range 48 {
+		for x := range 64 {
+			if image.Pt(x, y).In(content) {
+				img.SetCMYK(x, y, ink)
+			} else {
+				img.SetCMYK(x, y, color.CMYK{K: 255})
+			}
+		}
+	}
+	data := cmykJPEG(t, img)
+	if decoded, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("test image does not decode: %v", err)
+	} else if cmyk, ok := decoded.(*image.CMYK); !ok {
+		t.Fatalf("test image decodes as %T, want *image.CMYK", decoded)
+	} else if c := cmyk.CMYKAt(32, 24); max(c.C, ink.C)-min(c.C, ink.C) > 3 || max(c.K, ink.K)-min(c.K, ink.K) > 3 {
+		t.Fatalf("test image decodes with ink %v, want about %v", c, ink)
+	}
+
+	// The ink profile is dropped with the conversion, other APP2 data is not
+	icc := jpegSegment{marker: markerAPP2, payload: []byte(iccProfileHeader + "\x01\x01ink profile")}
+	mpf := jpegSegment{marker: markerAPP2, payload: []byte("MPF\x00II*\x00")}
+	data = insertJPEGSegments(data, []jpegSegment{icc, mpf})
+
+	result, out := cropBytes(t, data, "print.jpg", CropOptions{Tolerance: 10, MaxCropPercent: 40, CopyMetadata: true})
+	if !result.CropRect.Eq(content) {
+		t.Fatalf("crop %v (%q), want the black frame removed, %v", result.CropRect, result.Message, content)
+	}
+	if !strings.Contains(result.Message, "converted from CMYK to RGB") {
+		t.Errorf("message %q does not warn about the color space conversion", result.Message)
+	}
+
+	decoded, format, err := image.Decode(bytes.NewReader(out))
+	if err != nil || format != "jpeg" {
+		t.Fatalf("output does not decode as JPEG: %v, %s", err, format)
+	}
+	if size := decoded.Bounds().Size(); size != content.Size() {
+		t.Errorf("output size %v, want %v", size, content.Size())
+	}
+	// The RGB output shows the color the ink converts to
+	want := color.RGBAModel.Convert(ink).(color.RGBA)
+	got := color.RGBAModel.Convert(decoded.At(decoded.Bounds().Dx()/2, decoded.Bounds().Dy()/2)).(color.RGBA)
+	for _, d := range []int{int(got.R) - int(want.R), int(got.G) - int(want.G), int(got.B) - int(want.B)} {
+		if max(d, -d) > 8 {
+			t.Errorf("center color %v, want about %v", got, want)
+			break
+		}
+	}
+
+	segments, err := readJPEGSegments(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var app2 []string
+	for _, s := range segments {
+		if s.marker == markerAPP2 {
+			app2 = append(app2, string(s.payload[:3]))
+		}
+	}
+	if len(app2) != 1 || app2[0] != "MPF" {
+		t.Errorf("APP2 segments %q, want only MPF", app2)
+	}
+
+	// An uncropped CMYK image keeps its ink values byte for byte
+	flat := image.NewCMYK(image.Rect(0, 0, 64, 48))
+	for i := 0; i < len(flat.Pix); i += 4 {
+		copy(flat.Pix[i:], []byte{ink.C, ink.M, ink.Y, ink.K})
+	}
+	flatData := cmykJPEG(t, flat)
+	if result, out := cropBytes(t, flatData, "flat.jpg", CropOptions{Tolerance: 10, MaxCropPercent: 40}); result.WasCropped || !bytes.Equal(out, flatData) {
+		t.Errorf("uncropped CMYK image not copied unchanged: %q", result.Message)
+	}
+}
+
+func TestLockEdgesMatchesUnlocked(t *testing.T) {
+	// A dark band on the left only, so the other edges lock early
+	oneSided := noisyImage(250, 150, 0)
+	for y := range 150 {
+		for x := range 22 {
+			oneSided.Set(x, y, color.RGBA{30, 30, 30, 255})
+		}
+	}
+	images := []struct {
+		name string
+		img  image.Image
+	}{
+		{"bordered", borderedImage(160, 120, 12, 0)},
+		{"noisy", noisyImage(200, 150, 15)},
+		{"noisy without border", noisyImage(200, 150, 0)},
+		{"gradient", gradientImage(150, 100)},
+		{"one-sided", oneSided},
+		{"frame", framedGray(160, 120, 10, 90, 200)},
+	}
+	variants := []struct {
+		name string
+		opts CropOptions
+	}{
+		{"default", CropOptions{Tolerance: 10, MaxCropPercent: 40}},
+		{"loose", CropOptions{Tolerance: 25, MaxCropPercent: 40}},
+		{"multi-edge", CropOptions{Tolerance: 10, MaxCropPercent: 40, MultiEdge: true}},
+		{"stride", CropOptions{Tolerance: 10, MaxCropPercent: 40, SampleStride: 3}},
+		{"falloff", CropOptions{Tolerance: 15, MaxCropPercent: 40, ToleranceFalloff: 0.8}},
+		{"absolute", CropOptions{Tolerance: 12, MaxCropPercent: 40, ThresholdMode: ThresholdAbsolute}},
+	}
+	for _, im := range images {
+		for _, v := range variants {
+			opts := v.opts
+			rect, reason, stop, err := findUniformCrop(im.img, im.img.Bounds(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.LockEdges = true
+			lockedRect, lockedReason, lockedStop, err := findUniformCrop(im.img, im.img.Bounds(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !lockedRect.Eq(rect) || lockedReason != reason || lockedStop != stop {
+				t.Errorf("%s, %s: with locked edges %v, %q, %q, without %v, %q, %q", im.name, v.name, lockedRect, lockedReason, lockedStop, rect, reason, stop)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package cropper
+
+import (
+	"image"
+)
+
+// scanLineDepthPercent is how deep into each edge ModeDocument looks for
+// scanner lines, as a percentage of the dimension
+const scanLineDepthPercent = 3.0
+
+// scanLineDarkness is the share of the page brightness below which a line
+// counts as a scanner line. A skewed shadow only covers part of a line, so
+// this is well above the brightness of the shadow itself.
+const scanLineDarkness = 0.75
+
+// stripScanLines removes thin dark scanner-bed lines from the extreme edges
+// of a document scan. Within the outer scanLineDepthPercent of each edge,
+// everything up to the innermost line darker than scanLineDarkness of the
+// page just inside that band is removed. The page, not the center, is the
+// reference, so lines are found however the rest of the image is lit.
+// maxEdge limits each edge and maxCrop each dimension, in pixels.
+func stripScanLines(img image.Image, bounds image.Rectangle, maxEdge, maxCrop image.Point, luma LumaWeights) image.Rectangle {
+	width := bounds.Dx()
+	height := bounds.Dy()
+	depthX := min(max(int(float64(width)*scanLineDepthPercent/100), 1), maxEdge.X, maxCrop.X)
+	depthY := min(max(int(float64(height)*scanLineDepthPercent/100), 1), maxEdge.Y, maxCrop.Y)
+	if width < 4*depthX || height < 4*depthY {
+		return bounds
+	}
+
+	// Each edge searches depth lines, line(i) being the i-th counted inward
+	type edge struct {
+		depth int
+		line  func(i int) image.Rectangle
+	}
+	edges := [4]edge{
+		{depthY, func(i int) image.Rectangle { // top
+			return image.Rect(bounds.Min.X, bounds.Min.Y+i, bounds.Max.X, bounds.Min.Y+i+1)
+		}},
+		{depthY, func(i int) image.Rectangle { // bottom
+			return image.Rect(bounds.Min.X, bounds.Max.Y-i-1, bounds.Max.X, bounds.Max.Y-i)
+		}},
+		{depthX, func(i int) image.Rectangle { // left
+			return image.Rect(bounds.Min.X+i, bounds.Min.Y, bounds.Min.X+i+1, bounds.Max.Y)
+		}},
+		{depthX, func(i int) image.Rectangle { // right
+			return image.Rect(bounds.Max.X-i-1, bounds.Min.Y, bounds.Max.X-i, bounds.Max.Y)
+		}},
+	}
+
+	var strip [4]int
+	for e, edge := range edges {
+		if edge.depth == 0 {
+			continue
+		}
+		// The page is the band of the same depth just inside the searched one
+		page := edge.line(edge.depth).Union(edge.line(2*edge.depth - 1))
+		threshold := calculateRegionBrightness(img, page, luma, 1) * scanLineDarkness
+		for i := 0; i < edge.depth; i++ {
+			if calculateRegionBrightness(img, edge.line(i), luma, 1) < threshold {
+				strip[e] = i + 1
+			}
+		}
+	}
+
+	// Opposite edges share the dimension's crop budget
+	strip[1] = min(strip[1], maxCrop.Y-strip[0])
+	strip[3] = min(strip[3], maxCrop.X-strip[2])
+
+	return image.Rect(bounds.Min.X+strip[2], bounds.Min.Y+strip[0], bounds.Max.X-strip[3], bounds.Max.Y-strip[1])
+}
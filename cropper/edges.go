@@ -0,0 +1,127 @@
+package cropper
+
+import (
+	"image"
+	"math"
+)
+
+// defaultEdgeMarginPercent is the padding kept around detected content when
+// CropOptions.EdgeMarginPercent is negative
+const defaultEdgeMarginPercent = 2.0
+
+// findEdgeCrop crops to the bounding box of significant Sobel gradients plus a
+// margin. This finds a subject on a textured but featureless background,
+// where brightness uniformity does not apply.
+func findEdgeCrop(img image.Image, opts CropOptions) (image.Rectangle, UnchangedReason) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	if width < 3 || height < 3 {
+		return bounds, TooSmall
+	}
+
+	magnitude := sobelMagnitude(img, opts.luma())
+
+	threshold := opts.EdgeThreshold
+	if threshold <= 0 {
+		threshold = autoEdgeThreshold(magnitude)
+	}
+
+	// Count strong gradient pixels per row and column
+	rowCounts := make([]int, height)
+	colCounts := make([]int, width)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if magnitude[y*width+x] > threshold {
+				rowCounts[y]++
+				colCounts[x]++
+			}
+		}
+	}
+
+	// Rows and columns with only a few stray edge pixels are noise, not content
+	top, bottom, ok := busySpan(rowCounts, max(1, width/100))
+	if !ok {
+		return bounds, NothingToCrop
+	}
+	left, right, _ := busySpan(colCounts, max(1, height/100))
+
+	marginPercent := opts.EdgeMarginPercent
+	if marginPercent < 0 {
+		marginPercent = defaultEdgeMarginPercent
+	}
+	marginX := int(float64(width) * marginPercent / 100.0)
+	marginY := int(float64(height) * marginPercent / 100.0)
+
+	content := image.Rect(
+		bounds.Min.X+left-marginX,
+		bounds.Min.Y+top-marginY,
+		bounds.Min.X+right+1+marginX,
+		bounds.Min.Y+bottom+1+marginY,
+	).Intersect(bounds)
+
+	maxCropWidth := int(float64(width) * opts.MaxCropPercent / 100.0)
+	maxCropHeight := int(float64(height) * opts.MaxCropPercent / 100.0)
+	content.Min.X, content.Max.X = limitCrop(bounds.Min.X, bounds.Max.X, content.Min.X, content.Max.X, maxCropWidth)
+	content.Min.Y, content.Max.Y = limitCrop(bounds.Min.Y, bounds.Max.Y, content.Min.Y, content.Max.Y, maxCropHeight)
+
+	if content.Eq(bounds) {
+		return bounds, NothingToCrop
+	}
+	return content, ""
+}
+
+// sobelMagnitude returns the Sobel gradient magnitude of the image brightness
+// as a row-major slice. Border pixels have no full neighborhood and are zero.
+func sobelMagnitude(img image.Image, luma LumaWeights) []float64 {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	brightness := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			brightness[y*width+x] = calculateBrightness(img.At(bounds.Min.X+x, bounds.Min.Y+y), luma)
+		}
+	}
+
+	magnitude := make([]float64, width*height)
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			at := func(dx, dy int) float64 { return brightness[(y+dy)*width+x+dx] }
+			gx := at(1, -1) + 2*at(1, 0) + at(1, 1) - at(-1, -1) - 2*at(-1, 0) - at(-1, 1)
+			gy := at(-1, 1) + 2*at(0, 1) + at(1, 1) - at(-1, -1) - 2*at(0, -1) - at(1, -1)
+			magnitude[y*width+x] = math.Hypot(gx, gy)
+		}
+	}
+	return magnitude
+}
+
+// autoEdgeThreshold picks a gradient threshold two standard deviations above
+// the mean, so only edges that stand out from the background texture count
+func autoEdgeThreshold(magnitude []float64) float64 {
+	var sum, sumSquares float64
+	for _, m := range magnitude {
+		sum += m
+		sumSquares += m * m
+	}
+	n := float64(len(magnitude))
+	mean := sum / n
+	variance := math.Max(0, sumSquares/n-mean*mean)
+	return mean + 2*math.Sqrt(variance)
+}
+
+// busySpan returns the first and last index whose count reaches minCount. It
+// reports false when no index does.
+func busySpan(counts []int, minCount int) (int, int, bool) {
+	first, last := -1, -1
+	for i, c := range counts {
+		if c >= minCount {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	return first, last, first >= 0
+}
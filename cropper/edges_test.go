@@ -0,0 +1,48 @@
+package cropper
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEdgeMargin(t *testing.T) {
+	// A dark square on a flat background
+	img := image.NewGray(image.Rect(0, 0, 200, 100))
+	subject := image.Rect(80, 30, 120, 70)
+	for y := range 100 {
+		for x := range 200 {
+			v := uint8(128)
+			if image.Pt(x, y).In(subject) {
+				v = 20
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+
+	crop := func(margin float64) image.Rectangle {
+		rect, reason := findEdgeCrop(img, CropOptions{Mode: ModeEdges, MaxCropPercent: 90, EdgeMarginPercent: margin})
+		if rect.Eq(img.Bounds()) {
+			t.Fatalf("margin %g: not cropped (%s)", margin, reason)
+		}
+		return rect
+	}
+
+	tight := crop(0)
+	if !subject.In(tight) || tight.Dx() > subject.Dx()+4 || tight.Dy() > subject.Dy()+4 {
+		t.Errorf("crop %v without a margin, want the subject %v and its edge pixels", tight, subject)
+	}
+	for _, tc := range []struct {
+		margin float64
+		dx, dy int // padding on each side, in pixels
+	}{
+		{-1, 4, 2}, // the default of 2%
+		{5, 10, 5},
+	} {
+		want := tight.Inset(-tc.dx)
+		want.Min.Y, want.Max.Y = tight.Min.Y-tc.dy, tight.Max.Y+tc.dy
+		if got := crop(tc.margin); !got.Eq(want) {
+			t.Errorf("margin %g: crop %v, want %v", tc.margin, got, want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package cropper
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// encodeFunc writes img to w in a specific format
+type encodeFunc func(w io.Writer, img image.Image, opts CropOptions) error
+
+// encoders maps a format name, as reported by image.Decode, to its encoder.
+// Adding an output format only requires an entry here and in formatExtensions.
+var encoders = map[string]encodeFunc{
+	"jpeg": encodeJPEG,
+	"png":  encodePNG,
+	"gif":  encodeGIF,
+}
+
+// formatExtensions maps lowercase file extensions to format names
+var formatExtensions = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".jfif": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+}
+
+// canonicalExtensions are the usual extensions of each format, given to
+// outputs whose name is corrected with CorrectExtension
+var canonicalExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+}
+
+// ExtensionMismatch reports whether the extension of name belongs to a
+// format other than format, as detected by image.Decode. Extensions of no
+// supported format never mismatch.
+func ExtensionMismatch(name, format string) bool {
+	extFormat, ok := formatExtensions[strings.ToLower(filepath.Ext(name))]
+	return ok && extFormat != format
+}
+
+// CorrectExtension returns name with its extension replaced by the usual one
+// of format when the two mismatch, and name unchanged otherwise
+func CorrectExtension(name, format string) string {
+	ext, ok := canonicalExtensions[format]
+	if !ok || !ExtensionMismatch(name, format) {
+		return name
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ext
+}
+
+// SupportedExtensions returns the lowercase file extensions, with leading dot,
+// of the formats that can be decoded and written, in sorted order
+func SupportedExtensions() []string {
+	exts := make([]string, 0, len(formatExtensions))
+	for ext := range formatExtensions {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// encoderFor selects the output format. The format detected while decoding
+// wins, so a mislabeled file keeps its true format, then the output file
+// extension, and JPEG is the fallback.
+func encoderFor(outputPath, format string) (string, encodeFunc) {
+	if enc, ok := encoders[format]; ok {
+		return format, enc
+	}
+	if extFormat, ok := formatExtensions[strings.ToLower(filepath.Ext(outputPath))]; ok {
+		return extFormat, encoders[extFormat]
+	}
+	return "jpeg", encoders["jpeg"]
+}
+
+// encodeImage writes img to w in the format chosen by encoderFor and returns
+// the name of that format
+func encodeImage(w io.Writer, img image.Image, outputPath, format string, opts CropOptions) (string, error) {
+	name, enc := encoderFor(outputPath, format)
+	if err := enc(w, img, opts); err != nil {
+		return name, fmt.Errorf("failed to encode %s image: %w", strings.ToUpper(name), err)
+	}
+	return name, nil
+}
+
+// maxQualitySearchSteps bounds the binary search over JPEG qualities below
+// the configured quality, enough to cover all of them
+const maxQualitySearchSteps = 7
+
+func encodeJPEG(w io.Writer, img image.Image, opts CropOptions) error {
+	// JPEG is 8-bit, narrow 16-bit grayscale so it is still written as a
+	// single-channel JPEG rather than converted to color
+	if gray16, ok := img.(*image.Gray16); ok {
+		gray := image.NewGray(gray16.Bounds())
+		draw.Draw(gray, gray.Bounds(), gray16, gray16.Bounds().Min, draw.Src)
+		img = gray
+	}
+	if opts.MaxFileSize <= 0 {
+		return encodeJPEGQuality(w, img, opts.quality(), opts.Progressive)
+	}
+
+	encoded, err := fitJPEG(img, opts.MaxFileSize, opts.quality(), opts.Progressive)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	return err
+}
+
+// encodeJPEGQuality writes img as a baseline or progressive JPEG
+func encodeJPEGQuality(w io.Writer, img image.Image, quality int, progressive bool) error {
+	if progressive {
+		return encodeProgressiveJPEG(w, img, quality)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
+
+// fitJPEG encodes img at the highest quality, up to quality, whose output
+// is at most maxSize bytes. When not even quality 1 fits it returns the
+// quality 1 encoding, the smallest there is.
+func fitJPEG(img image.Image, maxSize int64, quality int, progressive bool) ([]byte, error) {
+	encode := func(quality int) ([]byte, error) {
+		var buf bytes.Buffer
+		err := encodeJPEGQuality(&buf, img, quality, progressive)
+		return buf.Bytes(), err
+	}
+
+	encoded, err := encode(quality)
+	if err != nil || int64(len(encoded)) <= maxSize {
+		return encoded, err
+	}
+
+	var best, smallest []byte
+	lo, hi := 1, quality-1
+	for step := 0; step < maxQualitySearchSteps && lo <= hi; step++ {
+		quality := (lo + hi) / 2
+		encoded, err := encode(quality)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(encoded)) <= maxSize {
+			best = encoded
+			lo = quality + 1
+		} else {
+			if quality == 1 {
+				smallest = encoded
+			}
+			hi = quality - 1
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if smallest != nil {
+		return smallest, nil
+	}
+	return encode(1)
+}
+
+func encodePNG(w io.Writer, img image.Image, opts CropOptions) error {
+	enc := png.Encoder{CompressionLevel: opts.PNGCompression}
+	return enc.Encode(w, img)
+}
+
+func encodeGIF(w io.Writer, img image.Image, opts CropOptions) error {
+	return gif.Encode(w, img, nil)
+}
@@ -0,0 +1,47 @@
+package cropper
+
+import (
+	"bytes"
+	"image"
+	"strings"
+	"testing"
+)
+
+func TestEncoderFor(t *testing.T) {
+	for _, tc := range []struct {
+		path, format, want string
+	}{
+		{"photo.jpg", "jpeg", "jpeg"},
+		{"photo.PNG", "png", "png"},
+		{"photo.png", "jpeg", "jpeg"},
+		{"photo.jpg", "gif", "gif"},
+		{"photo.gif", "bmp", "gif"},
+		{"", "png", "png"},
+		{"photo", "bmp", "jpeg"},
+	} {
+		if got, _ := encoderFor(tc.path, tc.format); got != tc.want {
+			t.Errorf("encoderFor(%q, %q) = %s, want %s", tc.path, tc.format, got, tc.want)
+		}
+	}
+}
+
+func TestMislabeledKeepsFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := encodeJPEG(&buf, borderedImage(120, 90, 10, 0), CropOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, out := cropBytes(t, buf.Bytes(), "photo.png", CropOptions{Tolerance: 10, MaxCropPercent: 40})
+	if !result.WasCropped {
+		t.Fatalf("got %q, want a crop", result.Message)
+	}
+	if !strings.Contains(result.Message, "JPEG content in a .png file") {
+		t.Errorf("message %q does not report the mismatch", result.Message)
+	}
+	if _, format, err := image.Decode(bytes.NewReader(out)); err != nil || format != "jpeg" {
+		t.Errorf("output decodes as %q (%v), want jpeg", format, err)
+	}
+	if got := CorrectExtension("photo.png", result.Format); got != "photo.jpg" {
+		t.Errorf("corrected name %s, want photo.jpg", got)
+	}
+}
@@ -0,0 +1,171 @@
+package cropper
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// exifHeader starts the payload of an EXIF APP1 segment
+const exifHeader = "Exif\x00\x00"
+
+// EXIF tags edited when copying metadata
+const (
+	exifTagOrientation = 0x0112
+	exifTagDateTime    = 0x0132
+	exifTagExifIFD     = 0x8769 // pointer to the Exif sub-IFD
+	exifTagGPSIFD      = 0x8825 // pointer to the GPS sub-IFD
+)
+
+// exifTimestampTags are the date and time tags of the Exif sub-IFD:
+// DateTimeOriginal, DateTimeDigitized, OffsetTime*, and SubSecTime*
+var exifTimestampTags = []uint16{0x9003, 0x9004, 0x9010, 0x9011, 0x9012, 0x9290, 0x9291, 0x9292}
+
+// gpsTimestampTags are GPSTimeStamp and GPSDateStamp of the GPS sub-IFD
+var gpsTimestampTags = []uint16{0x0007, 0x001D}
+
+// exifTypeSizes is the size in bytes of one value of each TIFF field type
+var exifTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// exifData is the TIFF structure inside an EXIF APP1 payload. It shares
+// memory with the payload, so values can be edited in place.
+type exifData struct {
+	tiff  []byte
+	order binary.ByteOrder
+}
+
+// parseEXIF finds the TIFF structure of an EXIF APP1 payload. It reports
+// false for other APP1 payloads, such as XMP, and for malformed headers.
+func parseEXIF(payload []byte) (exifData, bool) {
+	if !bytes.HasPrefix(payload, []byte(exifHeader)) {
+		return exifData{}, false
+	}
+	tiff := payload[len(exifHeader):]
+	if len(tiff) < 8 {
+		return exifData{}, false
+	}
+
+	switch string(tiff[:2]) {
+	case "II":
+		return exifData{tiff, binary.LittleEndian}, true
+	case "MM":
+		return exifData{tiff, binary.BigEndian}, true
+	}
+	return exifData{}, false
+}
+
+// ifd0 returns the offset of the first IFD
+func (e exifData) ifd0() int {
+	return int(e.order.Uint32(e.tiff[4:8]))
+}
+
+// entry returns the offset of the 12-byte entry for tag in the IFD at ifd,
+// or false when the tag is missing or the IFD is out of range. Each entry
+// is tag (2), type (2), count (4) and value or value offset (4).
+func (e exifData) entry(ifd int, tag uint16) (int, bool) {
+	if ifd < 8 || ifd+2 > len(e.tiff) {
+		return 0, false
+	}
+	count := int(e.order.Uint16(e.tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(e.tiff) {
+			return 0, false
+		}
+		if e.order.Uint16(e.tiff[entry:]) == tag {
+			return entry, true
+		}
+	}
+	return 0, false
+}
+
+// subIFD returns the offset of the IFD that the pointer tag in ifd refers to
+func (e exifData) subIFD(ifd int, tag uint16) (int, bool) {
+	entry, ok := e.entry(ifd, tag)
+	if !ok {
+		return 0, false
+	}
+	return int(e.order.Uint32(e.tiff[entry+8:])), true
+}
+
+// value returns the bytes of an entry's value, stored in the entry itself
+// when it fits in four bytes and at its offset otherwise, or nil when the
+// type is unknown or the value is out of range
+func (e exifData) value(entry int) []byte {
+	size, ok := exifTypeSizes[e.order.Uint16(e.tiff[entry+2:])]
+	if !ok {
+		return nil
+	}
+	n := int64(size) * int64(e.order.Uint32(e.tiff[entry+4:]))
+	if n <= 4 {
+		return e.tiff[entry+8 : entry+8+int(n)]
+	}
+	offset := int64(e.order.Uint32(e.tiff[entry+8:]))
+	if offset+n > int64(len(e.tiff)) {
+		return nil
+	}
+	return e.tiff[offset : offset+n]
+}
+
+// blank clears the value of tag in the IFD at ifd. Text becomes spaces, the
+// EXIF convention for an unknown value, and anything else zeros.
+func (e exifData) blank(ifd int, tag uint16) {
+	entry, ok := e.entry(ifd, tag)
+	if !ok {
+		return
+	}
+	value := e.value(entry)
+	fill := byte(0)
+	if e.order.Uint16(e.tiff[entry+2:]) == 2 {
+		fill = ' '
+	}
+	for i := range value {
+		value[i] = fill
+	}
+	// Text keeps its terminating NUL
+	if fill == ' ' && len(value) > 0 {
+		value[len(value)-1] = 0
+	}
+}
+
+// isXMP reports whether an APP1 payload is an XMP packet or an extended XMP
+// chunk
+func isXMP(payload []byte) bool {
+	return bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xap/1.0/\x00")) ||
+		bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xmp/extension/\x00"))
+}
+
+// stripTimestamps returns segments with the date and time tags of every
+// EXIF segment blanked and XMP packets, whose dates are embedded in XML,
+// dropped. The input segments are not modified.
+func stripTimestamps(segments []jpegSegment) []jpegSegment {
+	var out []jpegSegment
+	for _, s := range segments {
+		if s.marker != markerAPP1 {
+			out = append(out, s)
+			continue
+		}
+		if isXMP(s.payload) {
+			continue
+		}
+
+		payload := append([]byte(nil), s.payload...)
+		if e, ok := parseEXIF(payload); ok {
+			ifd0 := e.ifd0()
+			e.blank(ifd0, exifTagDateTime)
+			if ifd, ok := e.subIFD(ifd0, exifTagExifIFD); ok {
+				for _, tag := range exifTimestampTags {
+					e.blank(ifd, tag)
+				}
+			}
+			if ifd, ok := e.subIFD(ifd0, exifTagGPSIFD); ok {
+				for _, tag := range gpsTimestampTags {
+					e.blank(ifd, tag)
+				}
+			}
+		}
+		out = append(out, jpegSegment{marker: s.marker, payload: payload})
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+package cropper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// exifPayload returns a little-endian EXIF APP1 payload with date as both
+// DateTime in IFD0 and DateTimeOriginal in the Exif sub-IFD
+func exifPayload(date string) []byte {
+	value := make([]byte, 20) // "YYYY:MM:DD HH:MM:SS" and a NUL
+	copy(value, date)
+
+	le := binary.LittleEndian
+	tiff := le.AppendUint32([]byte("II*\x00"), 8)
+	entry := func(tag, typ uint16, count, value uint32) {
+		tiff = le.AppendUint16(tiff, tag)
+		tiff = le.AppendUint16(tiff, typ)
+		tiff = le.AppendUint32(tiff, count)
+		tiff = le.AppendUint32(tiff, value)
+	}
+
+	// IFD0 at 8: DateTime at 38 and the Exif IFD pointer to 58
+	tiff = le.AppendUint16(tiff, 2)
+	entry(exifTagDateTime, 2, 20, 38)
+	entry(exifTagExifIFD, 4, 1, 58)
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = append(tiff, value...)
+
+	// Exif IFD at 58: DateTimeOriginal at 76
+	tiff = le.AppendUint16(tiff, 1)
+	entry(0x9003, 2, 20, 76)
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = append(tiff, value...)
+
+	return append([]byte(exifHeader), tiff...)
+}
+
+// jpegWithEXIF returns a bordered JPEG carrying exifPayload(date) and an XMP
+// packet mentioning the date
+func jpegWithEXIF(t *testing.T, date string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encodeJPEG(&buf, borderedImage(160, 120, 16, 0), CropOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	xmp := "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta><xmp:CreateDate>" + date + "</xmp:CreateDate></x:xmpmeta>"
+	return insertJPEGSegments(buf.Bytes(), []jpegSegment{
+		{marker: markerAPP1, payload: exifPayload(date)},
+		{marker: markerAPP1, payload: []byte(xmp)},
+	})
+}
+
+func TestDeterministicStripsTimestamps(t *testing.T) {
+	morning := jpegWithEXIF(t, "2024:05:01 08:00:00")
+	evening := jpegWithEXIF(t, "2025:11:30 21:45:12")
+	opts := CropOptions{Tolerance: 10, MaxCropPercent: 40, CopyMetadata: true, Deterministic: true}
+
+	result, first := cropBytes(t, morning, "a.jpg", opts)
+	if !result.WasCropped {
+		t.Fatalf("got %q, want a crop", result.Message)
+	}
+	if _, again := cropBytes(t, morning, "a.jpg", opts); !bytes.Equal(again, first) {
+		t.Error("same input twice gave different output bytes")
+	}
+	if _, other := cropBytes(t, evening, "b.jpg", opts); !bytes.Equal(other, first) {
+		t.Error("inputs differing only in their dates gave different output bytes")
+	}
+	for _, date := range []string{"2024:05:01", "08:00:00", "xap/1.0"} {
+		if bytes.Contains(first, []byte(date)) {
+			t.Errorf("output still contains %q", date)
+		}
+	}
+
+	// The EXIF segment itself is kept, only its dates are blanked
+	segments, err := readJPEGSegments(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range segments {
+		if e, ok := parseEXIF(s.payload); ok {
+			found = true
+			entry, ok := e.entry(e.ifd0(), exifTagDateTime)
+			if !ok {
+				t.Fatal("DateTime entry dropped, want it blanked")
+			}
+			if got := string(e.value(entry)); got != "                   \x00" {
+				t.Errorf("DateTime = %q, want spaces", got)
+			}
+		}
+	}
+	if !found {
+		t.Error("EXIF segment not copied")
+	}
+
+	// Without Deterministic the dates are copied as they are
+	opts.Deterministic = false
+	if _, kept := cropBytes(t, morning, "a.jpg", opts); !bytes.Contains(kept, []byte("2024:05:01 08:00:00")) {
+		t.Error("without Deterministic the EXIF date was not copied")
+	}
+}
@@ -0,0 +1,30 @@
+package cropper
+
+import (
+	"image"
+)
+
+// FaceDetector finds faces in an image. Implementations wrap a detector such
+// as a Haar cascade. None ships with this package by default.
+type FaceDetector interface {
+	DetectFaces(img image.Image) []image.Rectangle
+}
+
+// DefaultFaceDetector is the detector the CLI uses for --protect-faces. It is
+// nil unless a build-tagged integration registers one from an init
+// function, such as the skin-tone one built with -tags faces.
+var DefaultFaceDetector FaceDetector
+
+// protectFaces grows rect until it contains every face found by the
+// detector, so a crop never cuts into a face near the frame edge. Faces are
+// clipped to bounds first.
+func protectFaces(img image.Image, rect image.Rectangle, detector FaceDetector) image.Rectangle {
+	bounds := img.Bounds()
+	for _, face := range detector.DetectFaces(img) {
+		face = face.Intersect(bounds)
+		if !face.Empty() {
+			rect = rect.Union(face)
+		}
+	}
+	return rect
+}
@@ -0,0 +1,110 @@
+//go:build faces
+
+package cropper
+
+import (
+	"image"
+	"image/color"
+)
+
+// skinGrid is the number of cells along the longer side of the grid the
+// skin detector classifies, so detection time does not grow with the image
+const skinGrid = 128
+
+// skinMinCells is the fewest skin cells a face can have, about a 5x5 block
+// of the grid: smaller patches are noise or too far away to matter
+const skinMinCells = 25
+
+// skinMinFill is the smallest share of its bounding box a face's skin cells
+// fill. Faces are compact blobs; hair, glasses and eyes leave holes, but a
+// thin diagonal streak of skin-colored background fills far less.
+const skinMinFill = 0.4
+
+// skinDetector finds faces as compact, roughly upright blobs of skin-colored
+// pixels. It needs no model data, but it is a heuristic: bare arms and
+// skin-colored backgrounds count as faces too, and faces in grayscale or
+// strongly tinted images are missed. Both err toward keeping too much.
+type skinDetector struct{}
+
+func init() {
+	DefaultFaceDetector = skinDetector{}
+}
+
+// DetectFaces classifies img on a grid of at most skinGrid cells along its
+// longer side, a cell being skin when most of its pixels are, and returns
+// the bounds of every face-shaped group of connected skin cells
+func (skinDetector) DetectFaces(img image.Image) []image.Rectangle {
+	bounds := img.Bounds()
+	cell := max((max(bounds.Dx(), bounds.Dy())+skinGrid-1)/skinGrid, 1)
+	cols, rows := (bounds.Dx()+cell-1)/cell, (bounds.Dy()+cell-1)/cell
+
+	skin := make([]bool, cols*rows)
+	for cy := range rows {
+		for cx := range cols {
+			r := image.Rect(cx*cell, cy*cell, (cx+1)*cell, (cy+1)*cell).Add(bounds.Min).Intersect(bounds)
+			count := 0
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					if isSkin(img.At(x, y)) {
+						count++
+					}
+				}
+			}
+			skin[cy*cols+cx] = 2*count > r.Dx()*r.Dy()
+		}
+	}
+
+	// Group 4-connected skin cells, clearing them as they are visited
+	var faces []image.Rectangle
+	var stack []int
+	for start := range skin {
+		if !skin[start] {
+			continue
+		}
+		skin[start] = false
+		stack = append(stack[:0], start)
+		blob := image.Rect(start%cols, start/cols, start%cols+1, start/cols+1)
+		cells := 0
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			cells++
+			x, y := i%cols, i/cols
+			blob = blob.Union(image.Rect(x, y, x+1, y+1))
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] >= 0 && n[0] < cols && n[1] >= 0 && n[1] < rows && skin[n[1]*cols+n[0]] {
+					skin[n[1]*cols+n[0]] = false
+					stack = append(stack, n[1]*cols+n[0])
+				}
+			}
+		}
+		if isFaceShaped(blob, cells) {
+			face := image.Rect(blob.Min.X*cell, blob.Min.Y*cell, blob.Max.X*cell, blob.Max.Y*cell)
+			faces = append(faces, face.Add(bounds.Min).Intersect(bounds))
+		}
+	}
+	return faces
+}
+
+// isFaceShaped reports whether a blob of cells skin cells with the given
+// bounding box, in grid cells, is large and compact enough for a face and
+// between a little wider than tall and twice as tall as wide, which leaves
+// room for a neck
+func isFaceShaped(blob image.Rectangle, cells int) bool {
+	w, h := blob.Dx(), blob.Dy()
+	return cells >= skinMinCells &&
+		float64(cells) >= skinMinFill*float64(w*h) &&
+		4*h >= 3*w && h <= 2*w
+}
+
+// isSkin reports whether c is a skin tone, using the chroma box of Chai and
+// Ngan that holds most skin whatever its brightness. Very dark and
+// transparent pixels have no reliable chroma and are never skin.
+func isSkin(c color.Color) bool {
+	nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if nc.A < 128 {
+		return false
+	}
+	y, cb, cr := color.RGBToYCbCr(nc.R, nc.G, nc.B)
+	return y >= 40 && cb >= 77 && cb <= 127 && cr >= 133 && cr <= 173
+}
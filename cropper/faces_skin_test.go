@@ -0,0 +1,54 @@
+//go:build faces
+
+package cropper
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSkinDetector(t *testing.T) {
+	skin := color.RGBA{224, 172, 140, 255}
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for y := range 300 {
+		for x := range 400 {
+			c := color.RGBA{0, 0, 0, 255}
+			switch {
+			// An oval face reaching into the left border
+			case sq(x-30)*sq(50)+sq(y-150)*sq(35) <= sq(35)*sq(50):
+				c = skin
+			// A thin skin-colored streak is not face-shaped
+			case x >= 200 && x < 380 && y >= 40 && y < 46:
+				c = skin
+			case x >= 40 && x < 360 && y >= 30 && y < 270:
+				c = color.RGBA{40, 90, 200, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	faces := DefaultFaceDetector.DetectFaces(img)
+	if len(faces) != 1 {
+		t.Fatalf("found faces %v, want one", faces)
+	}
+	if oval := image.Rect(0, 100, 65, 200); !oval.In(faces[0].Inset(-4)) {
+		t.Errorf("face %v does not cover the oval %v", faces[0], oval)
+	}
+
+	data := pngBytes(t, img)
+	opts := CropOptions{Tolerance: 10, MaxCropPercent: 40}
+	result, _ := cropBytes(t, data, "portrait.png", opts)
+	if result.CropRect.Min.X <= 0 {
+		t.Fatalf("crop %v without faces, the test image needs a left border", result.CropRect)
+	}
+	opts.FaceDetector = DefaultFaceDetector
+	result, _ = cropBytes(t, data, "portrait.png", opts)
+	if !result.WasCropped || result.CropRect.Min.X > 0 {
+		t.Errorf("crop %v (%s), want the face at the left edge kept", result.CropRect, result.Message)
+	}
+}
+
+func sq(v int) int {
+	return v * v
+}
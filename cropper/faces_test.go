@@ -0,0 +1,41 @@
+package cropper
+
+import (
+	"image"
+	"testing"
+)
+
+// stubDetector reports the same faces for every image
+type stubDetector []image.Rectangle
+
+func (d stubDetector) DetectFaces(image.Image) []image.Rectangle {
+	return d
+}
+
+func TestFaceDetectorKeepsFaces(t *testing.T) {
+	data := pngBytes(t, borderedImage(200, 100, 20, 0))
+	opts := CropOptions{Tolerance: 10, MaxCropPercent: 40}
+
+	result, _ := cropBytes(t, data, "plain.png", opts)
+	if !result.WasCropped {
+		t.Fatalf("without faces: got %q, want a crop", result.Message)
+	}
+
+	// A face reaching into the left border keeps that part of it
+	face := image.Rect(5, 40, 30, 60)
+	opts.FaceDetector = stubDetector{face}
+	result, _ = cropBytes(t, data, "face.png", opts)
+	if !result.WasCropped {
+		t.Fatalf("with a face: got %q, want a crop", result.Message)
+	}
+	if !face.In(result.CropRect) {
+		t.Errorf("crop %v cuts into face %v", result.CropRect, face)
+	}
+
+	// Faces in opposite corners leave nothing to crop
+	opts.FaceDetector = stubDetector{image.Rect(0, 0, 10, 10), image.Rect(190, 90, 200, 100)}
+	result, _ = cropBytes(t, data, "faces.png", opts)
+	if result.WasCropped || result.UnchangedReason != FacesProtected {
+		t.Errorf("with faces in the corners: got %v, %q, want %s", result.WasCropped, result.UnchangedReason, FacesProtected)
+	}
+}
@@ -0,0 +1,42 @@
+package cropper
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Decoders are registered by the import side effects of this package. No
+// test file of the package may import an image format package itself, as
+// the tests share one binary and that would register the decoder a dropped
+// import should have lost; tests encode with the package's encoders.
+
+func TestSupportedExtensionsDecode(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.SetNRGBA(1, 1, color.NRGBA{R: 255, A: 255})
+
+	for _, ext := range SupportedExtensions() {
+		t.Run(ext, func(t *testing.T) {
+			format := formatExtensions[ext]
+			encode, ok := encoders[format]
+			if !ok {
+				t.Fatalf("extension %s maps to %q, which has no encoder", ext, format)
+			}
+			var buf bytes.Buffer
+			if err := encode(&buf, img, CropOptions{}); err != nil {
+				t.Fatalf("failed to encode %s: %v", format, err)
+			}
+			decoded, decodedFormat, err := image.Decode(&buf)
+			if err != nil {
+				t.Fatalf("no decoder registered for %s: %v", format, err)
+			}
+			if decodedFormat != format {
+				t.Errorf("%s data decoded as %s", format, decodedFormat)
+			}
+			if decoded.Bounds().Size() != img.Bounds().Size() {
+				t.Errorf("decoded size %v, want %v", decoded.Bounds().Size(), img.Bounds().Size())
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package cropper
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// cropAnimatedGIF crops every frame of an animated GIF with a single shared
+// rectangle, keeping frame count, delays, disposal and loop count. The
+// rectangle is determined from the fully composed first frame.
+func cropAnimatedGIF(r io.ReadSeeker, w io.Writer, opts CropOptions) (*CropResult, error) {
+	anim, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode GIF animation: %w", err)
+	}
+	if len(anim.Image) == 0 {
+		return nil, fmt.Errorf("GIF contains no frames")
+	}
+
+	// Compose the first frame onto the logical screen, frames may cover only
+	// part of it
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if bounds.Empty() {
+		bounds = anim.Image[0].Bounds()
+	}
+	first := image.NewRGBA(bounds)
+	draw.Draw(first, anim.Image[0].Bounds(), anim.Image[0], anim.Image[0].Bounds().Min, draw.Over)
+
+	cropRect, reason, stop, err := findCropRect(first, opts)
+	if err != nil {
+		return nil, err
+	}
+	cropRect, reason, notes := adjustCropRect(cropRect, bounds, reason, opts)
+
+	if cropRect.Eq(bounds) {
+		result, err := copyImage(r, w, reason)
+		if err != nil {
+			return nil, err
+		}
+		result.OriginalSize = bounds.Size()
+		result.CropRect = bounds
+		result.StopCondition = stop
+		result.addNotes(notes)
+		return result, nil
+	}
+
+	for i, frame := range anim.Image {
+		anim.Image[i] = cropFrame(frame, cropRect)
+	}
+	anim.Config.Width = cropRect.Dx()
+	anim.Config.Height = cropRect.Dy()
+
+	if err := gif.EncodeAll(w, anim); err != nil {
+		return nil, fmt.Errorf("failed to encode GIF animation: %w", err)
+	}
+
+	result := &CropResult{
+		WasCropped:    true,
+		Message:       fmt.Sprintf("cropped %.1f%% of image area across %d frames", areaCropPercent(cropRect, bounds), len(anim.Image)),
+		OriginalSize:  bounds.Size(),
+		CropRect:      cropRect,
+		StopCondition: stop,
+	}
+	result.addNotes(notes)
+	return result, nil
+}
+
+// cropFrame clips a GIF frame to rect and moves it into the cropped
+// coordinate space. Frames entirely outside rect become a single transparent
+// pixel so the frame, and its delay, are kept.
+func cropFrame(frame *image.Paletted, rect image.Rectangle) *image.Paletted {
+	visible := frame.Bounds().Intersect(rect)
+	if visible.Empty() {
+		blank := image.NewPaletted(image.Rect(0, 0, 1, 1), frame.Palette)
+		blank.SetColorIndex(0, 0, transparentIndex(frame.Palette))
+		return blank
+	}
+
+	cropped := image.NewPaletted(visible.Sub(rect.Min), frame.Palette)
+	for y := visible.Min.Y; y < visible.Max.Y; y++ {
+		for x := visible.Min.X; x < visible.Max.X; x++ {
+			cropped.SetColorIndex(x-rect.Min.X, y-rect.Min.Y, frame.ColorIndexAt(x, y))
+		}
+	}
+	return cropped
+}
+
+// transparentIndex returns the first fully transparent palette entry, or 0 if
+// the palette has none
+func transparentIndex(p []color.Color) uint8 {
+	for i, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return uint8(i)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package cropper
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// borderedImage returns a w x h image of brightness 128 with a border of the
+// given width and brightness on every side
+func borderedImage(w, h, border int, borderGray uint8) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	inner := image.Rect(border, border, w-border, h-border)
+	for y := range h {
+		for x := range w {
+			v := borderGray
+			if image.Pt(x, y).In(inner) {
+				v = 128
+			}
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+// pngBytes returns img encoded as PNG by the package's own encoder
+func pngBytes(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encodePNG(&buf, img, CropOptions{}); err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// cropBytes runs CropImageStream on data and returns the result and output
+func cropBytes(t testing.TB, data []byte, name string, opts CropOptions) (*CropResult, []byte) {
+	t.Helper()
+	var out bytes.Buffer
+	result, err := CropImageStream(bytes.NewReader(data), &out, name, opts)
+	if err != nil {
+		t.Fatalf("CropImageStream(%s): %v", name, err)
+	}
+	return result, out.Bytes()
+}
+
+// cmykJPEG returns img as a baseline four-component Adobe CMYK JPEG, which
+// image/jpeg cannot write. It reuses the tables, DCT and entropy coder of the
+// progressive encoder, with the luminance tables for every component at
+// quality 50 and one interleaved scan.
+func cmykJPEG(t testing.TB, img *image.CMYK) []byte {
+	t.Helper()
+	b := img.Bounds()
+	var quant [64]int
+	for k := range quant {
+		quant[k] = int(unscaledQuant[0][k])
+	}
+
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	out.Write([]byte{0xff, 0xd8})
+
+	// Adobe APP14 with transform 0: inverted CMYK, not YCCK
+	adobe := []byte("Adobe\x00\x64\x00\x00\x00\x00\x00")
+	writeMarker(out, 0xee, len(adobe))
+	out.Write(adobe)
+
+	writeMarker(out, 0xdb, 65)
+	out.WriteByte(0)
+	for _, q := range quant {
+		out.WriteByte(byte(q))
+	}
+
+	writeMarker(out, 0xc0, 6+3*4)
+	out.Write([]byte{8, byte(b.Dy() >> 8), byte(b.Dy()), byte(b.Dx() >> 8), byte(b.Dx()), 4})
+	for c := range 4 {
+		out.Write([]byte{byte(c + 1), 0x11, 0})
+	}
+
+	writeMarker(out, 0xc4, 34+len(huffmanSpecs[0].values)+len(huffmanSpecs[1].values))
+	for class, spec := range huffmanSpecs[:2] {
+		out.WriteByte(byte(class << 4))
+		out.Write(spec.counts[:])
+		out.Write(spec.values)
+	}
+	dc, ac := huffmanSpecs[0].codes(), huffmanSpecs[1].codes()
+
+	writeMarker(out, 0xda, 4+2*4)
+	out.WriteByte(4)
+	for c := range 4 {
+		out.Write([]byte{byte(c + 1), 0})
+	}
+	out.Write([]byte{0, 63, 0})
+
+	e := entropyWriter{w: out}
+	var pred [4]int
+	var samples [64]float64
+	for by := 0; by < (b.Dy()+7)/8; by++ {
+		for bx := 0; bx < (b.Dx()+7)/8; bx++ {
+			for c := range 4 {
+				for i := range 64 {
+					x := min(b.Min.X+bx*8+i%8, b.Max.X-1)
+					y := min(b.Min.Y+by*8+i/8, b.Max.Y-1)
+					samples[i] = float64(255-img.Pix[img.PixOffset(x, y)+c]) - 128
+				}
+				block := quantizeBlock(&samples, &quant)
+				e.emitValue(&dc, 0, int(block[0])-pred[c])
+				pred[c] = int(block[0])
+				run := 0
+				for k := 1; k < 64; k++ {
+					if block[k] == 0 {
+						run++
+						continue
+					}
+					for ; run > 15; run -= 16 {
+						e.emit(ac[0xf0])
+					}
+					e.emitValue(&ac, run, int(block[k]))
+					run = 0
+				}
+				if run > 0 {
+					e.emit(ac[0x00])
+				}
+			}
+		}
+	}
+	e.flush()
+
+	out.Write([]byte{0xff, 0xd9})
+	if err := out.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sameImage reports whether a and b have the same size and, in 16-bit
+// non-premultiplied color, the same pixels
+func sameImage(a, b image.Image) bool {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return false
+	}
+	da := a.Bounds().Min.Sub(b.Bounds().Min)
+	for y := b.Bounds().Min.Y; y < b.Bounds().Max.Y; y++ {
+		for x := b.Bounds().Min.X; x < b.Bounds().Max.X; x++ {
+			if color.NRGBA64Model.Convert(a.At(x+da.X, y+da.Y)) != color.NRGBA64Model.Convert(b.At(x, y)) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,185 @@
+package cropper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// JPEG marker codes used when copying metadata between files
+const (
+	markerSOI   = 0xD8
+	markerEOI   = 0xD9
+	markerSOS   = 0xDA
+	markerAPP0  = 0xE0
+	markerAPP1  = 0xE1 // EXIF and XMP
+	markerAPP2  = 0xE2 // ICC profile
+	markerAPP13 = 0xED // IPTC
+)
+
+// jpegSegment is a marker segment from the header of a JPEG file
+type jpegSegment struct {
+	marker  byte
+	payload []byte // segment contents after the length field
+}
+
+// bytes serializes the segment including its marker and length
+func (s jpegSegment) bytes() []byte {
+	out := make([]byte, 4, 4+len(s.payload))
+	out[0] = 0xFF
+	out[1] = s.marker
+	binary.BigEndian.PutUint16(out[2:], uint16(len(s.payload)+2))
+	return append(out, s.payload...)
+}
+
+// readJPEGSegments reads the marker segments that precede the image data
+func readJPEGSegments(r io.Reader) ([]jpegSegment, error) {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xFF || soi[1] != markerSOI {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+
+	var segments []jpegSegment
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0xFF {
+			return nil, fmt.Errorf("invalid JPEG marker")
+		}
+
+		// Markers may be preceded by any number of fill bytes
+		marker := byte(0xFF)
+		for marker == 0xFF {
+			if marker, err = br.ReadByte(); err != nil {
+				return nil, err
+			}
+		}
+		if marker == markerSOS || marker == markerEOI {
+			return segments, nil
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return nil, fmt.Errorf("invalid JPEG segment length")
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return nil, err
+		}
+		segments = append(segments, jpegSegment{marker: marker, payload: payload})
+	}
+}
+
+// insertJPEGSegments returns encoded with the given segments placed directly
+// after the start-of-image marker
+func insertJPEGSegments(encoded []byte, segments []jpegSegment) []byte {
+	if len(segments) == 0 || len(encoded) < 2 {
+		return encoded
+	}
+
+	var buf bytes.Buffer
+	buf.Write(encoded[:2])
+	for _, s := range segments {
+		buf.Write(s.bytes())
+	}
+	buf.Write(encoded[2:])
+	return buf.Bytes()
+}
+
+// jfifDensity returns a JFIF APP0 segment carrying the source's resolution
+// units and density, without its thumbnail. It reports false when the source
+// has no JFIF header.
+func jfifDensity(segments []jpegSegment) (jpegSegment, bool) {
+	for _, s := range segments {
+		// "JFIF\0", version (2), units (1), X density (2), Y density (2)
+		if s.marker != markerAPP0 || len(s.payload) < 12 || !bytes.HasPrefix(s.payload, []byte("JFIF\x00")) {
+			continue
+		}
+		payload := make([]byte, 14)
+		copy(payload, s.payload[:12])
+		// Thumbnail width and height stay zero
+		return jpegSegment{marker: markerAPP0, payload: payload}, true
+	}
+	return jpegSegment{}, false
+}
+
+// metadataSegments returns the descriptive metadata segments of a JPEG: EXIF
+// and XMP (APP1), ICC profiles (APP2) and IPTC (APP13). Segments that affect
+// decoding, such as Adobe APP14 color transforms, are left out because the
+// encoder writes its own.
+func metadataSegments(segments []jpegSegment) []jpegSegment {
+	var metadata []jpegSegment
+	for _, s := range segments {
+		switch s.marker {
+		case markerAPP1, markerAPP2, markerAPP13:
+			metadata = append(metadata, s)
+		}
+	}
+	return metadata
+}
+
+// iccProfileHeader starts the payload of each APP2 segment carrying a chunk
+// of an ICC profile. Other APP2 segments, such as FlashPix or MPF, do not.
+const iccProfileHeader = "ICC_PROFILE\x00"
+
+// withoutICCProfile returns segments without the APP2 segments that carry
+// an ICC profile
+func withoutICCProfile(segments []jpegSegment) []jpegSegment {
+	var out []jpegSegment
+	for _, s := range segments {
+		if s.marker != markerAPP2 || !bytes.HasPrefix(s.payload, []byte(iccProfileHeader)) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// transferJPEGMetadata copies header metadata selected in opts from the JPEG
+// read from r into freshly encoded JPEG data. The ICC profile of a CMYK
+// source describes ink, not the RGB data that was encoded, and is dropped.
+func transferJPEGMetadata(r io.ReadSeeker, encoded []byte, cmyk bool, opts CropOptions) ([]byte, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind input: %w", err)
+	}
+
+	segments, err := readJPEGSegments(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JPEG metadata: %w", err)
+	}
+
+	var keep []jpegSegment
+	if opts.PreserveDPI {
+		if density, ok := jfifDensity(segments); ok {
+			keep = append(keep, density)
+		}
+	}
+
+	if opts.CopyMetadata {
+		metadata := metadataSegments(segments)
+		if cmyk {
+			metadata = withoutICCProfile(metadata)
+		}
+		if opts.AutoOrient {
+			metadata = resetOrientation(metadata)
+		}
+		if opts.Deterministic {
+			metadata = stripTimestamps(metadata)
+		}
+		keep = append(keep, metadata...)
+	}
+
+	return insertJPEGSegments(encoded, keep), nil
+}
@@ -0,0 +1,81 @@
+package cropper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// readDensity returns the resolution units and density of the JFIF header of
+// a JPEG, or false when it has none
+func readDensity(t *testing.T, data []byte) (units byte, x, y uint16, ok bool) {
+	t.Helper()
+	segments, err := readJPEGSegments(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := jfifDensity(segments)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return s.payload[7], binary.BigEndian.Uint16(s.payload[8:]), binary.BigEndian.Uint16(s.payload[10:]), true
+}
+
+func TestPreserveDPI(t *testing.T) {
+	var buf bytes.Buffer
+	if err := encodeJPEG(&buf, borderedImage(160, 120, 16, 0), CropOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// 300 by 600 dots per inch, with a 1x1 thumbnail that is not copied
+	jfif := []byte("JFIF\x00\x01\x02\x01\x01\x2C\x02\x58\x01\x01\x00\x00\x00")
+	data := insertJPEGSegments(buf.Bytes(), []jpegSegment{{marker: markerAPP0, payload: jfif}})
+	if units, x, y, ok := readDensity(t, data); !ok || units != 1 || x != 300 || y != 600 {
+		t.Fatalf("test image density %d %dx%d, want 300x600 DPI", units, x, y)
+	}
+
+	for _, preserve := range []bool{false, true} {
+		result, out := cropBytes(t, data, "print.jpg", CropOptions{Tolerance: 10, MaxCropPercent: 40, PreserveDPI: preserve})
+		if !result.WasCropped {
+			t.Fatalf("got %q, want a crop", result.Message)
+		}
+		units, x, y, ok := readDensity(t, out)
+		if !preserve {
+			if ok && x == 300 {
+				t.Error("density copied without PreserveDPI")
+			}
+			continue
+		}
+		if !ok || units != 1 || x != 300 || y != 600 {
+			t.Errorf("output density %d %dx%d (found %v), want 300x600 DPI", units, x, y, ok)
+		}
+		segments, err := readJPEGSegments(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range segments {
+			if s.marker == markerAPP0 && len(s.payload) != 14 {
+				t.Errorf("JFIF header of %d bytes, want 14 without the thumbnail", len(s.payload))
+			}
+		}
+	}
+}
+
+func TestWithoutICCProfile(t *testing.T) {
+	exif := jpegSegment{marker: markerAPP1, payload: exifPayload("2024:05:01 08:00:00")}
+	icc1 := jpegSegment{marker: markerAPP2, payload: []byte(iccProfileHeader + "\x01\x02profile part one")}
+	icc2 := jpegSegment{marker: markerAPP2, payload: []byte(iccProfileHeader + "\x02\x02profile part two")}
+	mpf := jpegSegment{marker: markerAPP2, payload: []byte("MPF\x00II*\x00")}
+	flashPix := jpegSegment{marker: markerAPP2, payload: []byte("FPXR\x00\x00\x01")}
+
+	got := withoutICCProfile([]jpegSegment{exif, icc1, mpf, icc2, flashPix})
+	want := []jpegSegment{exif, mpf, flashPix}
+	if !slices.EqualFunc(got, want, func(a, b jpegSegment) bool {
+		return a.marker == b.marker && string(a.payload) == string(b.payload)
+	}) {
+		t.Errorf("kept %d segments, want EXIF, MPF and FlashPix", len(got))
+		for _, s := range got {
+			t.Logf("  %X %q", s.marker, s.payload[:min(len(s.payload), 12)])
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package cropper
+
+// Limiter bounds how many images are decoded and held in memory at once.
+// A nil Limiter imposes no limit.
+type Limiter chan struct{}
+
+// NewLimiter creates a Limiter allowing n images to be resident concurrently
+func NewLimiter(n int) Limiter {
+	return make(Limiter, n)
+}
+
+// acquire blocks until a slot is free
+func (l Limiter) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+// release frees a slot taken by acquire
+func (l Limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
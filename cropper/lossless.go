@@ -0,0 +1,508 @@
+package cropper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// A baseline JPEG stores quantized DCT coefficients for 8x8 blocks, grouped
+// into MCUs (minimum coded units) of up to 16x16 pixels when chroma is
+// subsampled. A crop whose top left corner lies on an MCU boundary keeps
+// whole blocks, so CropOptions.LosslessJPEG copies their coefficients into
+// a smaller JPEG instead of decoding and compressing the pixels again. Only
+// the Huffman coding is redone, with the standard tables.
+
+// markerAPP14 carries the Adobe color transform, which tells decoders
+// whether three components are YCbCr or RGB
+const markerAPP14 = 0xEE
+
+// errLosslessUnsupported marks JPEGs whose coding this package cannot crop
+// losslessly; they are re-encoded instead
+var errLosslessUnsupported = errors.New("lossless crop not supported")
+
+// coefComponent is one color component of a decoded baseline JPEG
+type coefComponent struct {
+	id    byte
+	h, v  int  // sampling factors, blocks per MCU across and down
+	quant byte // quantization table selector
+	// bw and bh are the blocks per row and rows of blocks, covering whole
+	// MCUs; blocks holds their coefficients in raster order, each in zig-zag
+	// order with the DC value undifferenced
+	bw, bh int
+	blocks [][64]int16
+}
+
+// jpegCoefficients is the quantized coefficient data of a baseline JPEG
+type jpegCoefficients struct {
+	width, height int
+	sof           byte            // SOF0 or SOF1 frame marker
+	quant         map[byte][]byte // DQT entries by selector, precision byte included
+	adobe         []byte          // APP14 payload, if present
+	hmax, vmax    int
+	comps         []coefComponent
+}
+
+// mcuSize returns the size in pixels of an MCU, the grid a lossless crop's
+// top left corner must lie on
+func (c *jpegCoefficients) mcuSize() image.Point {
+	return image.Pt(8*c.hmax, 8*c.vmax)
+}
+
+// snapToMCU moves the top left corner of rect up and left onto the MCU grid
+// of bounds, keeping a little more of the image rather than less
+func snapToMCU(rect, bounds image.Rectangle, mcu image.Point) image.Rectangle {
+	rect.Min.X = bounds.Min.X + (rect.Min.X-bounds.Min.X)/mcu.X*mcu.X
+	rect.Min.Y = bounds.Min.Y + (rect.Min.Y-bounds.Min.Y)/mcu.Y*mcu.Y
+	return rect
+}
+
+// readJPEGCoefficients decodes the coefficients of the JPEG in r for a
+// lossless crop and rewinds r. A JPEG that cannot be cropped losslessly
+// returns nil and a note saying why it is re-encoded instead.
+func readJPEGCoefficients(r io.ReadSeeker) (*jpegCoefficients, string, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", fmt.Errorf("failed to rewind input: %w", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read input: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", fmt.Errorf("failed to rewind input: %w", err)
+	}
+
+	c, err := decodeJPEGCoefficients(data)
+	if err != nil {
+		return nil, fmt.Sprintf("re-encoded, %v", err), nil
+	}
+	return c, "", nil
+}
+
+// huffmanDecoder decodes the canonical Huffman codes of a DHT table
+type huffmanDecoder struct {
+	maxCode [17]int32 // largest code of each length, -1 when there is none
+	minCode [17]int32
+	valPtr  [17]int32
+	values  []byte
+}
+
+func newHuffmanDecoder(counts []byte, values []byte) *huffmanDecoder {
+	h := &huffmanDecoder{values: values}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		h.maxCode[l] = -1
+		if n > 0 {
+			h.valPtr[l] = k
+			h.minCode[l] = code
+			code += n
+			k += n
+			h.maxCode[l] = code - 1
+		}
+		code <<= 1
+	}
+	return h
+}
+
+// entropyReader reads the bits of entropy-coded data MSB first, skipping the
+// zero byte stuffed after every 0xff. At a marker it supplies zero bits
+// until the restart is consumed.
+type entropyReader struct {
+	data   []byte
+	pos    int
+	acc    uint32
+	bits   uint
+	marker bool
+}
+
+func (r *entropyReader) readBit() (uint32, error) {
+	if r.bits == 0 {
+		b := byte(0)
+		switch {
+		case r.marker:
+		case r.pos >= len(r.data):
+			return 0, fmt.Errorf("truncated JPEG data")
+		case r.data[r.pos] != 0xff:
+			b = r.data[r.pos]
+			r.pos++
+		case r.pos+1 < len(r.data) && r.data[r.pos+1] == 0:
+			b = 0xff
+			r.pos += 2
+		default:
+			r.marker = true
+		}
+		r.acc, r.bits = uint32(b), 8
+	}
+	r.bits--
+	return r.acc >> r.bits & 1, nil
+}
+
+func (r *entropyReader) receive(n int) (int, error) {
+	v := 0
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | int(bit)
+	}
+	// Values below half the category's range are negative
+	if n > 0 && v < 1<<(n-1) {
+		v += -(1 << n) + 1
+	}
+	return v, nil
+}
+
+func (r *entropyReader) decode(h *huffmanDecoder) (byte, error) {
+	if h == nil {
+		return 0, fmt.Errorf("missing Huffman table")
+	}
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int32(bit)
+		if code <= h.maxCode[l] {
+			return h.values[h.valPtr[l]+code-h.minCode[l]], nil
+		}
+	}
+	return 0, fmt.Errorf("invalid Huffman code")
+}
+
+// restart discards the bits left before a restart marker and consumes it
+func (r *entropyReader) restart() error {
+	r.acc, r.bits, r.marker = 0, 0, false
+	if r.pos+1 >= len(r.data) || r.data[r.pos] != 0xff || r.data[r.pos+1] < 0xd0 || r.data[r.pos+1] > 0xd7 {
+		return fmt.Errorf("missing restart marker")
+	}
+	r.pos += 2
+	return nil
+}
+
+// decodeJPEGCoefficients reads the coefficients of a baseline or extended
+// sequential, Huffman-coded 8-bit JPEG with one scan holding every
+// component. Other codings return an error wrapping errLosslessUnsupported.
+func decodeJPEGCoefficients(data []byte) (*jpegCoefficients, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+
+	c := &jpegCoefficients{quant: make(map[byte][]byte)}
+	var dc, ac [4]*huffmanDecoder
+	restartInterval := 0
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, fmt.Errorf("invalid JPEG marker")
+		}
+		marker := data[pos+1]
+		pos += 2
+		// Markers may be preceded by any number of fill bytes
+		for marker == 0xff && pos < len(data) {
+			marker = data[pos]
+			pos++
+		}
+		if marker == markerEOI || pos+2 > len(data) {
+			return nil, fmt.Errorf("no image data")
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			return nil, fmt.Errorf("invalid JPEG segment length")
+		}
+		p := data[pos+2 : pos+length]
+		pos += length
+
+		switch {
+		case marker == 0xc0 || marker == 0xc1:
+			if err := c.readFrame(marker, p); err != nil {
+				return nil, err
+			}
+		case marker == 0xc2 || marker == 0xc6 || marker == 0xca || marker == 0xce:
+			return nil, fmt.Errorf("progressive JPEG: %w", errLosslessUnsupported)
+		case marker >= 0xc3 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			return nil, fmt.Errorf("JPEG frame type 0x%x: %w", marker, errLosslessUnsupported)
+		case marker == 0xdb:
+			for len(p) > 0 {
+				n := 1 + 64*(1+int(p[0]>>4))
+				if len(p) < n {
+					return nil, fmt.Errorf("invalid quantization table")
+				}
+				c.quant[p[0]&0x0f] = p[:n]
+				p = p[n:]
+			}
+		case marker == 0xc4:
+			for len(p) > 0 {
+				if len(p) < 17 {
+					return nil, fmt.Errorf("invalid Huffman table")
+				}
+				n := 0
+				for _, count := range p[1:17] {
+					n += int(count)
+				}
+				if len(p) < 17+n || p[0]&0x0f > 3 {
+					return nil, fmt.Errorf("invalid Huffman table")
+				}
+				h := newHuffmanDecoder(p[1:17], p[17:17+n])
+				if p[0]>>4 == 0 {
+					dc[p[0]&0x0f] = h
+				} else {
+					ac[p[0]&0x0f] = h
+				}
+				p = p[17+n:]
+			}
+		case marker == 0xdd:
+			if len(p) < 2 {
+				return nil, fmt.Errorf("invalid restart interval")
+			}
+			restartInterval = int(binary.BigEndian.Uint16(p))
+		case marker == markerAPP14:
+			c.adobe = p
+		case marker == markerSOS:
+			if c.comps == nil {
+				return nil, fmt.Errorf("scan before frame header")
+			}
+			if len(p) < 1 || int(p[0]) != len(c.comps) || len(p) < 4+2*len(c.comps) {
+				return nil, fmt.Errorf("scan of some components: %w", errLosslessUnsupported)
+			}
+			tables := make([][2]*huffmanDecoder, len(c.comps))
+			for i := range c.comps {
+				id, sel := p[1+2*i], p[2+2*i]
+				if id != c.comps[i].id {
+					return nil, fmt.Errorf("scan components out of order: %w", errLosslessUnsupported)
+				}
+				tables[i] = [2]*huffmanDecoder{dc[sel>>4&3], ac[sel&3]}
+			}
+			r := &entropyReader{data: data, pos: pos}
+			if err := c.readScan(r, tables, restartInterval); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+}
+
+// readFrame reads the frame header and sizes the component block grids
+func (c *jpegCoefficients) readFrame(marker byte, p []byte) error {
+	if len(p) < 6 {
+		return fmt.Errorf("invalid frame header")
+	}
+	if p[0] != 8 {
+		return fmt.Errorf("%d-bit JPEG: %w", p[0], errLosslessUnsupported)
+	}
+	c.sof = marker
+	c.height = int(binary.BigEndian.Uint16(p[1:]))
+	c.width = int(binary.BigEndian.Uint16(p[3:]))
+	n := int(p[5])
+	if n != 1 && n != 3 {
+		return fmt.Errorf("%d-component JPEG: %w", n, errLosslessUnsupported)
+	}
+	if c.width == 0 || c.height == 0 || len(p) < 6+3*n {
+		return fmt.Errorf("invalid frame header")
+	}
+
+	c.comps = make([]coefComponent, n)
+	c.hmax, c.vmax = 1, 1
+	for i := range c.comps {
+		comp := &c.comps[i]
+		comp.id = p[6+3*i]
+		comp.h, comp.v = int(p[7+3*i]>>4), int(p[7+3*i]&0x0f)
+		comp.quant = p[8+3*i] & 3
+		if comp.h < 1 || comp.h > 4 || comp.v < 1 || comp.v > 4 {
+			return fmt.Errorf("invalid sampling factors")
+		}
+		c.hmax, c.vmax = max(c.hmax, comp.h), max(c.vmax, comp.v)
+	}
+	// A single component is coded block by block whatever its sampling
+	// factors say
+	if n == 1 {
+		c.comps[0].h, c.comps[0].v = 1, 1
+		c.hmax, c.vmax = 1, 1
+	}
+
+	mcu := c.mcuSize()
+	mcusX, mcusY := (c.width+mcu.X-1)/mcu.X, (c.height+mcu.Y-1)/mcu.Y
+	for i := range c.comps {
+		comp := &c.comps[i]
+		comp.bw, comp.bh = mcusX*comp.h, mcusY*comp.v
+		comp.blocks = make([][64]int16, comp.bw*comp.bh)
+	}
+	return nil
+}
+
+// readScan decodes the coefficients of every MCU of an interleaved scan
+func (c *jpegCoefficients) readScan(r *entropyReader, tables [][2]*huffmanDecoder, restartInterval int) error {
+	mcusX, mcusY := c.comps[0].bw/c.comps[0].h, c.comps[0].bh/c.comps[0].v
+	pred := make([]int, len(c.comps))
+	for m := 0; m < mcusX*mcusY; m++ {
+		if restartInterval > 0 && m > 0 && m%restartInterval == 0 {
+			if err := r.restart(); err != nil {
+				return err
+			}
+			clear(pred)
+		}
+		mx, my := m%mcusX, m/mcusX
+		for i := range c.comps {
+			comp := &c.comps[i]
+			for y := 0; y < comp.v; y++ {
+				for x := 0; x < comp.h; x++ {
+					block := &comp.blocks[(my*comp.v+y)*comp.bw+mx*comp.h+x]
+					if err := readBlock(r, block, tables[i], &pred[i]); err != nil {
+						return fmt.Errorf("failed to decode JPEG block: %w", err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// readBlock decodes one block's DC difference and AC run lengths
+func readBlock(r *entropyReader, block *[64]int16, tables [2]*huffmanDecoder, pred *int) error {
+	t, err := r.decode(tables[0])
+	if err != nil {
+		return err
+	}
+	// Categories beyond 8-bit precision have no standard code to write
+	if t > 11 {
+		return fmt.Errorf("DC category %d out of range", t)
+	}
+	diff, err := r.receive(int(t))
+	if err != nil {
+		return err
+	}
+	*pred += diff
+	block[0] = int16(*pred)
+
+	for k := 1; k < 64; {
+		rs, err := r.decode(tables[1])
+		if err != nil {
+			return err
+		}
+		run, size := int(rs>>4), int(rs&0x0f)
+		if size == 0 {
+			if run != 15 {
+				break // end of block
+			}
+			k += 16
+			continue
+		}
+		k += run
+		if k > 63 || size > 10 {
+			return fmt.Errorf("coefficient index out of range")
+		}
+		v, err := r.receive(size)
+		if err != nil {
+			return err
+		}
+		block[k] = int16(v)
+		k++
+	}
+	return nil
+}
+
+// writeCrop writes the blocks inside rect as a new baseline JPEG. The top
+// left corner of rect must lie on the MCU grid; partial MCUs at the right
+// and bottom are kept and hidden by the smaller frame size.
+func (c *jpegCoefficients) writeCrop(w io.Writer, rect image.Rectangle) error {
+	mcu := c.mcuSize()
+	if rect.Min.X%mcu.X != 0 || rect.Min.Y%mcu.Y != 0 {
+		return fmt.Errorf("crop at %d,%d is not on the %dx%d block grid", rect.Min.X, rect.Min.Y, mcu.X, mcu.Y)
+	}
+	if rect.Empty() || !rect.In(image.Rect(0, 0, c.width, c.height)) {
+		return fmt.Errorf("crop %v outside the %dx%d image", rect, c.width, c.height)
+	}
+	offX, offY := rect.Min.X/mcu.X, rect.Min.Y/mcu.Y
+	mcusX, mcusY := (rect.Dx()+mcu.X-1)/mcu.X, (rect.Dy()+mcu.Y-1)/mcu.Y
+
+	out := bufio.NewWriter(w)
+	out.Write([]byte{0xff, markerSOI})
+	if c.adobe != nil {
+		writeMarker(out, markerAPP14, len(c.adobe))
+		out.Write(c.adobe)
+	}
+
+	// The source's quantization tables, so the coefficients keep their
+	// meaning
+	for sel := byte(0); sel < 4; sel++ {
+		if table, ok := c.quant[sel]; ok {
+			writeMarker(out, 0xdb, len(table))
+			out.Write(table)
+		}
+	}
+
+	writeMarker(out, c.sof, 6+3*len(c.comps))
+	out.Write([]byte{8, byte(rect.Dy() >> 8), byte(rect.Dy()), byte(rect.Dx() >> 8), byte(rect.Dx()), byte(len(c.comps))})
+	for _, comp := range c.comps {
+		out.Write([]byte{comp.id, byte(comp.h<<4 | comp.v), comp.quant})
+	}
+
+	// Standard Huffman tables, luminance for the first component and
+	// chrominance for the others
+	nTables := min(len(c.comps), 2)
+	length := 0
+	for t := 0; t < 2*nTables; t++ {
+		length += 17 + len(huffmanSpecs[t].values)
+	}
+	writeMarker(out, 0xc4, length)
+	for t := 0; t < 2*nTables; t++ {
+		out.WriteByte(byte((t%2)<<4 | t/2))
+		out.Write(huffmanSpecs[t].counts[:])
+		out.Write(huffmanSpecs[t].values)
+	}
+	var codes [4][256]huffmanCode
+	for t := range codes {
+		codes[t] = huffmanSpecs[t].codes()
+	}
+
+	writeMarker(out, markerSOS, 4+2*len(c.comps))
+	out.WriteByte(byte(len(c.comps)))
+	for i, comp := range c.comps {
+		t := byte(min(i, 1))
+		out.Write([]byte{comp.id, t<<4 | t})
+	}
+	out.Write([]byte{0, 63, 0})
+
+	e := entropyWriter{w: out}
+	pred := make([]int, len(c.comps))
+	for my := 0; my < mcusY; my++ {
+		for mx := 0; mx < mcusX; mx++ {
+			for i, comp := range c.comps {
+				dcCodes, acCodes := &codes[2*min(i, 1)], &codes[2*min(i, 1)+1]
+				for y := 0; y < comp.v; y++ {
+					for x := 0; x < comp.h; x++ {
+						block := &comp.blocks[((offY+my)*comp.v+y)*comp.bw+(offX+mx)*comp.h+x]
+						e.emitValue(dcCodes, 0, int(block[0])-pred[i])
+						pred[i] = int(block[0])
+
+						run := 0
+						for k := 1; k < 64; k++ {
+							v := int(block[k])
+							if v == 0 {
+								run++
+								continue
+							}
+							for ; run > 15; run -= 16 {
+								e.emit(acCodes[0xf0])
+							}
+							e.emitValue(acCodes, run, v)
+							run = 0
+						}
+						if run > 0 {
+							e.emit(acCodes[0x00])
+						}
+					}
+				}
+			}
+		}
+	}
+	e.flush()
+
+	out.Write([]byte{0xff, markerEOI})
+	return out.Flush()
+}
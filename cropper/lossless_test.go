@@ -0,0 +1,257 @@
+package cropper
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// baselineJPEG returns img as a baseline JPEG at quality 50 with one
+// interleaved scan, which image/jpeg cannot write with 4:4:4 chroma or
+// restart markers. Color chroma is subsampled 2x2 when subsample is set,
+// and a restart marker follows every restart MCUs when it is positive.
+// *image.Gray is written with one component.
+func baselineJPEG(t testing.TB, img image.Image, subsample bool, restart int) []byte {
+	t.Helper()
+	b := img.Bounds()
+
+	// Full-resolution Y, Cb and Cr planes, or Y alone for grayscale
+	gray, isGray := img.(*image.Gray)
+	planes := make([][]float64, 3)
+	if isGray {
+		planes = planes[:1]
+	}
+	for i := range planes {
+		planes[i] = make([]float64, b.Dx()*b.Dy())
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := (y-b.Min.Y)*b.Dx() + x - b.Min.X
+			if isGray {
+				planes[0][i] = float64(gray.GrayAt(x, y).Y)
+				continue
+			}
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			planes[0][i], planes[1][i], planes[2][i] = float64(yy), float64(cb), float64(cr)
+		}
+	}
+
+	// Luma is sampled 2x2 against chroma when it is subsampled
+	factor := 1
+	if subsample && !isGray {
+		factor = 2
+	}
+	var quant [2][64]int
+	for tbl := range quant {
+		for k := range quant[tbl] {
+			quant[tbl][k] = int(unscaledQuant[tbl][k])
+		}
+	}
+
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	out.Write([]byte{0xff, markerSOI})
+	writeMarker(out, 0xdb, 2*65)
+	for tbl := range quant {
+		out.WriteByte(byte(tbl))
+		for _, q := range quant[tbl] {
+			out.WriteByte(byte(q))
+		}
+	}
+
+	writeMarker(out, 0xc0, 6+3*len(planes))
+	out.Write([]byte{8, byte(b.Dy() >> 8), byte(b.Dy()), byte(b.Dx() >> 8), byte(b.Dx()), byte(len(planes))})
+	for c := range planes {
+		sampling, tbl := byte(0x11), byte(min(c, 1))
+		if c == 0 {
+			sampling = byte(factor<<4 | factor)
+		}
+		out.Write([]byte{byte(c + 1), sampling, tbl})
+	}
+
+	writeMarker(out, 0xc4, 4*17+len(huffmanSpecs[0].values)+len(huffmanSpecs[1].values)+len(huffmanSpecs[2].values)+len(huffmanSpecs[3].values))
+	for tbl, spec := range huffmanSpecs {
+		out.WriteByte(byte((tbl%2)<<4 | tbl/2))
+		out.Write(spec.counts[:])
+		out.Write(spec.values)
+	}
+	var codes [4][256]huffmanCode
+	for tbl := range codes {
+		codes[tbl] = huffmanSpecs[tbl].codes()
+	}
+
+	if restart > 0 {
+		writeMarker(out, 0xdd, 2)
+		out.Write([]byte{byte(restart >> 8), byte(restart)})
+	}
+
+	writeMarker(out, markerSOS, 4+2*len(planes))
+	out.WriteByte(byte(len(planes)))
+	for c := range planes {
+		tbl := byte(min(c, 1))
+		out.Write([]byte{byte(c + 1), tbl<<4 | tbl})
+	}
+	out.Write([]byte{0, 63, 0})
+
+	e := entropyWriter{w: out}
+	mcu := 8 * factor
+	mcusX, mcusY := (b.Dx()+mcu-1)/mcu, (b.Dy()+mcu-1)/mcu
+	pred := make([]int, len(planes))
+	var samples [64]float64
+	for m := range mcusX * mcusY {
+		if restart > 0 && m > 0 && m%restart == 0 {
+			e.flush()
+			out.Write([]byte{0xff, 0xd0 + byte((m/restart-1)%8)})
+			clear(pred)
+		}
+		mx, my := m%mcusX, m/mcusX
+		for c, plane := range planes {
+			// Blocks of the component per MCU across and down, and source
+			// pixels per sample
+			blocks, scale := 1, factor
+			if c == 0 {
+				blocks, scale = factor, 1
+			}
+			tbl := min(c, 1)
+			for by := range blocks {
+				for bx := range blocks {
+					for i := range samples {
+						var sum float64
+						for dy := range scale {
+							for dx := range scale {
+								x := min(mx*mcu+(bx*8+i%8)*scale+dx, b.Dx()-1)
+								y := min(my*mcu+(by*8+i/8)*scale+dy, b.Dy()-1)
+								sum += plane[y*b.Dx()+x]
+							}
+						}
+						samples[i] = sum/float64(scale*scale) - 128
+					}
+					block := quantizeBlock(&samples, &quant[tbl])
+					e.emitValue(&codes[2*tbl], 0, int(block[0])-pred[c])
+					pred[c] = int(block[0])
+					run := 0
+					for k := 1; k < 64; k++ {
+						if block[k] == 0 {
+							run++
+							continue
+						}
+						for ; run > 15; run -= 16 {
+							e.emit(codes[2*tbl+1][0xf0])
+						}
+						e.emitValue(&codes[2*tbl+1], run, int(block[k]))
+						run = 0
+					}
+					if run > 0 {
+						e.emit(codes[2*tbl+1][0x00])
+					}
+				}
+			}
+		}
+	}
+	e.flush()
+
+	out.Write([]byte{0xff, markerEOI})
+	if err := out.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// texturedImage returns a w x h image with a black border of the given width
+// around colored texture, so every block has coefficients to copy
+func texturedImage(w, h, border int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	inner := image.Rect(border, border, w-border, h-border)
+	for y := range h {
+		for x := range w {
+			c := color.RGBA{0, 0, 0, 255}
+			if image.Pt(x, y).In(inner) {
+				c = color.RGBA{uint8(100 + x%37*3), uint8(90 + (x+2*y)%29*4), uint8(120 + y%23*5), 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestLosslessJPEGRoundTrip(t *testing.T) {
+	rgb := texturedImage(203, 157, 27)
+	gray := image.NewGray(rgb.Rect)
+	for i := range gray.Pix {
+		gray.Pix[i] = rgb.Pix[4*i+1]
+	}
+	var stdlib bytes.Buffer
+	if err := encodeJPEG(&stdlib, rgb, CropOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		mcu  int
+	}{
+		{"4:4:4", baselineJPEG(t, rgb, false, 0), 8},
+		{"4:2:0", baselineJPEG(t, rgb, true, 0), 16},
+		{"4:2:0 from image/jpeg", stdlib.Bytes(), 16},
+		{"grayscale", baselineJPEG(t, gray, false, 0), 8},
+		{"restart interval", baselineJPEG(t, rgb, true, 5), 16},
+		{"grayscale restart interval", baselineJPEG(t, gray, false, 7), 8},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, _, err := image.Decode(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatalf("test source does not decode: %v", err)
+			}
+
+			opts := CropOptions{Tolerance: 10, MaxCropPercent: 40, LosslessJPEG: true}
+			result, out := cropBytes(t, tc.data, "photo.jpg", opts)
+			if !result.WasCropped || !strings.Contains(result.Message, "cropped losslessly") {
+				t.Fatalf("got %q, want a lossless crop", result.Message)
+			}
+			if rect := result.CropRect; rect.Min.X%tc.mcu != 0 || rect.Min.Y%tc.mcu != 0 || rect.Min.X == 0 || rect.Min.Y == 0 {
+				t.Fatalf("crop %v, want its corner on the %dx%[2]d block grid inside the border", rect, tc.mcu)
+			}
+
+			decoded, format, err := image.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("output does not decode: %v", err)
+			}
+			if format != "jpeg" {
+				t.Fatalf("output decodes as %s, want jpeg", format)
+			}
+			if _, isGray := src.(*image.Gray); isGray != (decoded.ColorModel() == color.GrayModel) {
+				t.Errorf("output decodes as %T from a %T source", decoded, src)
+			}
+			// Only the Huffman coding is redone, so the kept blocks decode to
+			// exactly the source's pixels
+			kept := src.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(result.CropRect)
+			if !sameImage(decoded, kept) {
+				t.Error("output pixels differ from the kept region of the source")
+			}
+		})
+	}
+}
+
+func TestLosslessJPEGFallback(t *testing.T) {
+	var progressive bytes.Buffer
+	if err := encodeProgressiveJPEG(&progressive, texturedImage(203, 157, 27), 90); err != nil {
+		t.Fatal(err)
+	}
+	result, out := cropBytes(t, progressive.Bytes(), "photo.jpg", CropOptions{Tolerance: 10, MaxCropPercent: 40, LosslessJPEG: true})
+	if !result.WasCropped || !strings.Contains(result.Message, "re-encoded, progressive JPEG") || strings.Contains(result.Message, "cropped losslessly") {
+		t.Errorf("got %q, want a crop re-encoded because the source is progressive", result.Message)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds().Size() != result.CropRect.Size() {
+		t.Errorf("output is %v, want the crop %v", decoded.Bounds().Size(), result.CropRect.Size())
+	}
+}
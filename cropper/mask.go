@@ -0,0 +1,90 @@
+package cropper
+
+import (
+	"fmt"
+	"image"
+	"os"
+)
+
+// maskThreshold is the brightness below which a mask pixel marks content to keep
+const maskThreshold = 128
+
+// findMaskCrop computes the crop rectangle from a mask image. The result is the
+// tight bounding box of the black (keep) mask pixels, widened where necessary so
+// that no dimension loses more than maxCropPercent. Masks whose size differs
+// from the image are scaled to the image bounds. The reason is
+// CropLimitReached when maxCropPercent cut the crop short.
+func findMaskCrop(maskPath string, bounds image.Rectangle, maxCropPercent float64) (image.Rectangle, UnchangedReason, error) {
+	file, err := os.Open(maskPath)
+	if err != nil {
+		return bounds, "", fmt.Errorf("failed to open mask file: %w", err)
+	}
+	defer file.Close()
+
+	mask, _, err := image.Decode(file)
+	if err != nil {
+		return bounds, "", fmt.Errorf("failed to decode mask: %w", err)
+	}
+
+	maskBounds := mask.Bounds()
+	if maskBounds.Empty() {
+		return bounds, "", fmt.Errorf("mask image is empty")
+	}
+
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	// Find the bounding box of keep pixels, mapping image coordinates onto the
+	// mask with nearest-neighbor scaling
+	keep := image.Rectangle{}
+	found := false
+	for y := 0; y < height; y++ {
+		my := maskBounds.Min.Y + y*maskBounds.Dy()/height
+		for x := 0; x < width; x++ {
+			mx := maskBounds.Min.X + x*maskBounds.Dx()/width
+			if calculateBrightness(mask.At(mx, my), LumaBT601) >= maskThreshold {
+				continue
+			}
+
+			px := image.Rect(bounds.Min.X+x, bounds.Min.Y+y, bounds.Min.X+x+1, bounds.Min.Y+y+1)
+			if !found {
+				keep = px
+				found = true
+			} else {
+				keep = keep.Union(px)
+			}
+		}
+	}
+
+	// A mask without any content to keep leaves the image unchanged
+	if !found {
+		return bounds, NothingToCrop, nil
+	}
+
+	maxCropWidth := int(float64(width) * maxCropPercent / 100.0)
+	maxCropHeight := int(float64(height) * maxCropPercent / 100.0)
+
+	rect := keep
+	rect.Min.X, rect.Max.X = limitCrop(bounds.Min.X, bounds.Max.X, keep.Min.X, keep.Max.X, maxCropWidth)
+	rect.Min.Y, rect.Max.Y = limitCrop(bounds.Min.Y, bounds.Max.Y, keep.Min.Y, keep.Max.Y, maxCropHeight)
+	if !rect.Eq(keep) {
+		return rect, CropLimitReached, nil
+	}
+	return rect, NothingToCrop, nil
+}
+
+// limitCrop widens the span [lo, hi) inside [min, max) so that at most maxCrop
+// pixels are removed in total. The allowance is shared between both sides in
+// proportion to how much each side wanted to remove.
+func limitCrop(min, max, lo, hi, maxCrop int) (int, int) {
+	before := lo - min
+	after := max - hi
+	total := before + after
+	if total <= maxCrop {
+		return lo, hi
+	}
+
+	allowedBefore := before * maxCrop / total
+	allowedAfter := maxCrop - allowedBefore
+	return min + allowedBefore, max - allowedAfter
+}
@@ -0,0 +1,58 @@
+package cropper
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeMask writes a w x h white mask with keep painted black to a
+// temporary PNG file and returns its path
+func writeMask(t *testing.T, w, h int, keep image.Rectangle) string {
+	t.Helper()
+	mask := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			if !image.Pt(x, y).In(keep) {
+				mask.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	path := filepath.Join(t.TempDir(), "mask.png")
+	if err := os.WriteFile(path, pngBytes(t, mask), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMaskUnchangedReason(t *testing.T) {
+	data := pngBytes(t, borderedImage(120, 90, 10, 0))
+	keep := image.Rect(20, 20, 100, 70)
+
+	for _, tc := range []struct {
+		name       string
+		keep       image.Rectangle
+		maxCrop    float64
+		wantSize   image.Point
+		wantReason UnchangedReason
+	}{
+		{"within limit", keep, 50, keep.Size(), ""},
+		{"no crop allowed", keep, 0, image.Pt(120, 90), CropLimitReached},
+		{"nothing to keep", image.Rectangle{}, 50, image.Pt(120, 90), NothingToCrop},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := CropOptions{MaskPath: writeMask(t, 120, 90, tc.keep), MaxCropPercent: tc.maxCrop}
+			result, out := cropBytes(t, data, "photo.png", opts)
+			decoded, _, err := image.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := decoded.Bounds().Size(); size != tc.wantSize || result.UnchangedReason != tc.wantReason {
+				t.Errorf("output size %v, reason %q, want %v, reason %q", size, result.UnchangedReason, tc.wantSize, tc.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package cropper
+
+import (
+	"image"
+	"image/color"
+)
+
+// normalizeClipPercent is the share of the darkest and brightest pixels
+// ignored when picking the stretch range, so a few outliers do not pin it
+const normalizeClipPercent = 0.5
+
+// normalizeLevels stretches the brightness of the cropped image so its
+// percentile range spans 0-255, removing a mild overall cast. Every channel
+// goes through the same linear mapping, so hues are kept. Grayscale images
+// stay grayscale, everything else becomes NRGBA. Images with nearly no
+// brightness range are returned unchanged.
+func normalizeLevels(img image.Image, luma LumaWeights) image.Image {
+	bounds := img.Bounds()
+
+	var histogram [256]int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			histogram[uint8(calculateBrightness(img.At(x, y), luma)+0.5)]++
+		}
+	}
+
+	// Find the brightness levels at the clip percentiles
+	clip := int(float64(bounds.Dx()*bounds.Dy()) * normalizeClipPercent / 100.0)
+	low, high := 0, 255
+	for count := 0; low < 255; low++ {
+		count += histogram[low]
+		if count > clip {
+			break
+		}
+	}
+	for count := 0; high > 0; high-- {
+		count += histogram[high]
+		if count > clip {
+			break
+		}
+	}
+	if high-low < 2 {
+		return img
+	}
+
+	var lookup [256]uint8
+	for i := range lookup {
+		v := (i - low) * 255 / (high - low)
+		lookup[i] = uint8(max(0, min(255, v)))
+	}
+
+	if gray, ok := img.(*image.Gray); ok {
+		out := image.NewGray(bounds)
+		for i, v := range gray.Pix {
+			out.Pix[i] = lookup[v]
+		}
+		return out
+	}
+
+	out := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			out.SetNRGBA(x, y, color.NRGBA{R: lookup[c.R], G: lookup[c.G], B: lookup[c.B], A: c.A})
+		}
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package cropper
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// lowContrastImage returns a w x h image of alternating 100 and 150
+// brightness columns, so every region averages 125, inside a black border of
+// the given width
+func lowContrastImage(w, h, border int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	inner := image.Rect(border, border, w-border, h-border)
+	for y := range h {
+		for x := range w {
+			if image.Pt(x, y).In(inner) {
+				img.SetGray(x, y, color.Gray{uint8(100 + 50*(x%2))})
+			}
+		}
+	}
+	return img
+}
+
+// grayRange returns the lowest and highest brightness in img
+func grayRange(img image.Image) (low, high uint8) {
+	low = 255
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+			low, high = min(low, v), max(high, v)
+		}
+	}
+	return low, high
+}
+
+func TestNormalizeStretchesLowContrast(t *testing.T) {
+	data := pngBytes(t, lowContrastImage(120, 90, 10))
+	opts := CropOptions{Tolerance: 5, MaxCropPercent: 40}
+
+	for _, normalize := range []bool{false, true} {
+		opts.Normalize = normalize
+		result, out := cropBytes(t, data, "flat.png", opts)
+		if want := image.Rect(10, 10, 110, 80); !result.CropRect.Eq(want) {
+			t.Fatalf("normalize %v: crop %v, want exactly the border removed, %v", normalize, result.CropRect, want)
+		}
+		decoded, _, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := decoded.(*image.Gray); !ok {
+			t.Errorf("normalize %v: output decoded as %T, want grayscale kept", normalize, decoded)
+		}
+
+		low, high := grayRange(decoded)
+		if normalize && (low != 0 || high != 255) {
+			t.Errorf("normalized range %d-%d, want 0-255", low, high)
+		}
+		if !normalize && (low != 100 || high != 150) {
+			t.Errorf("range without normalize %d-%d, want 100-150", low, high)
+		}
+	}
+}
+
+func TestNormalizeLeavesUnchangedCopies(t *testing.T) {
+	data := pngBytes(t, lowContrastImage(120, 90, 0))
+	result, out := cropBytes(t, data, "flat.png", CropOptions{Tolerance: 10, MaxCropPercent: 40, Normalize: true})
+	if result.WasCropped {
+		t.Fatalf("got a crop to %v, want none", result.CropRect)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("uncropped image was not copied unchanged")
+	}
+}
+
+func TestNormalizeLevels(t *testing.T) {
+	flat := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range flat.Pix {
+		flat.Pix[i] = 90
+	}
+	if got := normalizeLevels(flat, LumaBT601); got != image.Image(flat) {
+		t.Error("image without a brightness range was not returned as it is")
+	}
+
+	// Colors go through one mapping for all channels, so hues are kept
+	tinted := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	tinted.Set(0, 0, color.RGBA{60, 60, 60, 255})
+	tinted.Set(1, 0, color.RGBA{110, 130, 150, 255})
+	tinted.Set(2, 0, color.RGBA{200, 200, 200, 255})
+	out := normalizeLevels(tinted, LumaBT601)
+	black := color.NRGBAModel.Convert(out.At(0, 0)).(color.NRGBA)
+	tint := color.NRGBAModel.Convert(out.At(1, 0)).(color.NRGBA)
+	white := color.NRGBAModel.Convert(out.At(2, 0)).(color.NRGBA)
+	if black != (color.NRGBA{0, 0, 0, 255}) || white != (color.NRGBA{255, 255, 255, 255}) {
+		t.Errorf("range ends map to %v and %v, want black and white", black, white)
+	}
+	if tint.B-tint.G != tint.G-tint.R || tint.G-tint.R <= 20 {
+		t.Errorf("tint %v, want evenly spaced channels further apart than 20", tint)
+	}
+}
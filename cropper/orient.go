@@ -0,0 +1,168 @@
+package cropper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// orientationValue returns the 16-bit orientation value of an EXIF APP1
+// payload, sharing memory with it, and its byte order, or nil when there is
+// none
+func orientationValue(payload []byte) ([]byte, binary.ByteOrder) {
+	e, ok := parseEXIF(payload)
+	if !ok {
+		return nil, nil
+	}
+	entry, ok := e.entry(e.ifd0(), exifTagOrientation)
+	if !ok {
+		return nil, nil
+	}
+	if value := e.value(entry); len(value) == 2 {
+		return value, e.order
+	}
+	return nil, nil
+}
+
+// exifOrientation returns the EXIF orientation, 1 to 8, found in the header
+// segments of a JPEG, or 1 when there is none
+func exifOrientation(segments []jpegSegment) int {
+	for _, s := range segments {
+		if s.marker != markerAPP1 {
+			continue
+		}
+		if value, order := orientationValue(s.payload); value != nil {
+			if orientation := int(order.Uint16(value)); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+		}
+	}
+	return 1
+}
+
+// resetOrientation returns segments with the EXIF orientation of every APP1
+// segment set to 1, for pixels that were already turned upright. The input
+// segments are not modified.
+func resetOrientation(segments []jpegSegment) []jpegSegment {
+	out := make([]jpegSegment, len(segments))
+	for i, s := range segments {
+		out[i] = s
+		if s.marker != markerAPP1 {
+			continue
+		}
+		payload := append([]byte(nil), s.payload...)
+		if value, order := orientationValue(payload); value != nil {
+			order.PutUint16(value, 1)
+			out[i].payload = payload
+		}
+	}
+	return out
+}
+
+// readOrientation reads the EXIF orientation of the JPEG in r and rewinds it
+func readOrientation(r io.ReadSeeker) (int, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to rewind input: %w", err)
+	}
+	segments, err := readJPEGSegments(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read JPEG metadata: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to rewind input: %w", err)
+	}
+	return exifOrientation(segments), nil
+}
+
+// orientImage turns a decoded image the way opts asks: upright from the
+// EXIF orientation of JPEGs with AutoOrient, then by the fixed Rotate. r
+// holds the encoded image and is rewound. The EXIF orientation that was
+// applied is returned, 1 when none was.
+func orientImage(img image.Image, format string, r io.ReadSeeker, opts CropOptions) (image.Image, int, error) {
+	orientation := 1
+	if opts.AutoOrient && format == "jpeg" {
+		var err error
+		if orientation, err = readOrientation(r); err != nil {
+			return nil, 0, err
+		}
+		img = applyOrientation(img, orientation)
+	}
+	return rotateImage(img, opts.Rotate), orientation, nil
+}
+
+// rotateImage returns img rotated clockwise by degrees. Only 90, 180 and 270
+// rotate; any other value returns img itself.
+func rotateImage(img image.Image, degrees int) image.Image {
+	switch degrees {
+	case 90:
+		return applyOrientation(img, 6)
+	case 180:
+		return applyOrientation(img, 3)
+	case 270:
+		return applyOrientation(img, 8)
+	}
+	return img
+}
+
+// applyOrientation returns img flipped and rotated so that an image stored
+// with the given EXIF orientation appears upright. Orientation 1 and values
+// outside 1-8 return img itself. Grayscale and non-premultiplied sources keep
+// their pixel type, anything else becomes RGBA.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Orientations 5-8 swap the axes
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dstRect := image.Rect(0, 0, dstW, dstH)
+
+	var dst draw.Image
+	switch img.(type) {
+	case *image.Gray:
+		dst = image.NewGray(dstRect)
+	case *image.Gray16:
+		dst = image.NewGray16(dstRect)
+	case *image.NRGBA:
+		dst = image.NewNRGBA(dstRect)
+	case *image.NRGBA64:
+		dst = image.NewNRGBA64(dstRect)
+	case *image.RGBA64:
+		dst = image.NewRGBA64(dstRect)
+	default:
+		dst = image.NewRGBA(dstRect)
+	}
+
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			// Source pixel shown at (x, y) once upright
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs 90° clockwise rotation
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs 90° counter-clockwise rotation
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
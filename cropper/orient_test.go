@@ -0,0 +1,90 @@
+package cropper
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestApplyOrientation(t *testing.T) {
+	// A 4x2 image with a distinct value in every pixel, cut out of a larger
+	// one so its bounds do not start at the origin
+	full := image.NewGray(image.Rect(0, 0, 6, 4))
+	for y := range 4 {
+		for x := range 6 {
+			full.SetGray(x, y, color.Gray{uint8(10*y + x)})
+		}
+	}
+	src := full.SubImage(image.Rect(1, 1, 5, 3)).(*image.Gray)
+	const w, h = 4, 2
+
+	// Stored corners, and where the EXIF orientation says they are shown
+	corner := func(name string, w, h int) image.Point {
+		return map[string]image.Point{
+			"TL": {0, 0}, "TR": {w - 1, 0}, "BL": {0, h - 1}, "BR": {w - 1, h - 1},
+		}[name]
+	}
+	for _, tc := range []struct {
+		orientation int
+		tl, tr, bl  string // upright corner of the stored TL, TR and BL pixels
+	}{
+		{1, "TL", "TR", "BL"},
+		{2, "TR", "TL", "BR"},
+		{3, "BR", "BL", "TR"},
+		{4, "BL", "BR", "TL"},
+		{5, "TL", "BL", "TR"},
+		{6, "TR", "BR", "TL"},
+		{7, "BR", "TR", "BL"},
+		{8, "BL", "TL", "BR"},
+	} {
+		got := applyOrientation(src, tc.orientation)
+
+		dstW, dstH := w, h
+		if tc.orientation >= 5 {
+			dstW, dstH = h, w
+		}
+		if size := got.Bounds().Size(); size != image.Pt(dstW, dstH) {
+			t.Errorf("orientation %d: size %v, want %v", tc.orientation, size, image.Pt(dstW, dstH))
+			continue
+		}
+		if _, ok := got.(*image.Gray); !ok {
+			t.Errorf("orientation %d: got %T, want *image.Gray", tc.orientation, got)
+		}
+
+		for _, c := range []struct{ stored, upright string }{{"TL", tc.tl}, {"TR", tc.tr}, {"BL", tc.bl}} {
+			s := corner(c.stored, w, h).Add(src.Bounds().Min)
+			u := corner(c.upright, dstW, dstH).Add(got.Bounds().Min)
+			want := src.GrayAt(s.X, s.Y)
+			if g := color.GrayModel.Convert(got.At(u.X, u.Y)).(color.Gray); g != want {
+				t.Errorf("orientation %d: stored %s pixel %d should show at %s, found %d there",
+					tc.orientation, c.stored, want.Y, c.upright, g.Y)
+			}
+		}
+	}
+}
+
+func TestRotateImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	red := color.RGBA{255, 0, 0, 255}
+	src.Set(0, 0, red)
+
+	for _, tc := range []struct {
+		degrees int
+		size    image.Point
+		red     image.Point
+	}{
+		{0, image.Pt(3, 2), image.Pt(0, 0)},
+		{90, image.Pt(2, 3), image.Pt(1, 0)},
+		{180, image.Pt(3, 2), image.Pt(2, 1)},
+		{270, image.Pt(2, 3), image.Pt(0, 2)},
+	} {
+		got := rotateImage(src, tc.degrees)
+		if size := got.Bounds().Size(); size != tc.size {
+			t.Errorf("%d degrees: size %v, want %v", tc.degrees, size, tc.size)
+			continue
+		}
+		if c := color.RGBAModel.Convert(got.At(tc.red.X, tc.red.Y)); c != red {
+			t.Errorf("%d degrees: top left pixel not at %v", tc.degrees, tc.red)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package cropper
+
+import (
+	"image"
+)
+
+// PDFRasterizer renders every page of a PDF file to an image at the given
+// resolution in dots per inch. None ships with this package by default.
+type PDFRasterizer interface {
+	RasterizePDF(path string, dpi int) ([]image.Image, error)
+}
+
+// DefaultPDFRasterizer is the rasterizer the CLI uses for PDF input. It is
+// nil unless a build-tagged integration registers one from an init
+// function, such as the pdftoppm one built with -tags pdf.
+var DefaultPDFRasterizer PDFRasterizer
@@ -0,0 +1,64 @@
+//go:build pdf
+
+package cropper
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// pdftoppm rasterizes PDFs with the pdftoppm tool of poppler-utils, which
+// must be on the PATH. Running it as a separate program keeps a PDF
+// renderer out of the Go build.
+type pdftoppm struct{}
+
+func init() {
+	DefaultPDFRasterizer = pdftoppm{}
+}
+
+// RasterizePDF renders every page of the PDF at path to a PNG in a
+// temporary directory and decodes them in page order
+func (pdftoppm) RasterizePDF(path string, dpi int) ([]image.Image, error) {
+	dir, err := os.MkdirTemp("", "imagecrop-pdftoppm-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command("pdftoppm", "-r", strconv.Itoa(dpi), "-png", path, filepath.Join(dir, "page"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to rasterize PDF: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	// Page numbers are zero-padded to the width of the page count, so the
+	// names sort in page order
+	names, err := filepath.Glob(filepath.Join(dir, "page-*.png"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rasterized pages: %w", err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("failed to rasterize PDF: no pages")
+	}
+	sort.Strings(names)
+
+	pages := make([]image.Image, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rasterized page: %w", err)
+		}
+		page, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode rasterized page: %w", err)
+		}
+		pages = append(pages, page)
+	}
+	return pages, nil
+}
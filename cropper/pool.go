@@ -0,0 +1,185 @@
+package cropper
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Job is one image for a Pool to process
+type Job struct {
+	// ID identifies the job in its JobResult, e.g. an index or request number
+	ID         int
+	InputPath  string
+	OutputPath string
+	Opts       CropOptions
+	// Preview, when set, writes an outlined preview to OutputPath with
+	// PreviewCrop instead of cropping
+	Preview *PreviewStyle
+	// BackupPath, when set, receives a copy of the input before anything is
+	// written. If the copy fails the job fails without cropping.
+	BackupPath string
+}
+
+// JobResult is the outcome of a Job. Exactly one of Result and Err is set.
+type JobResult struct {
+	Job    Job
+	Result *CropResult
+	Err    error
+	// Duration is how long the worker spent on the job
+	Duration time.Duration
+	// Worker numbers the worker goroutine that processed the job, from 0
+	Worker int
+	// WorkerTime is how long that worker was busy with the job. It equals
+	// Duration unless a separate writer wrote the output, whose time, and
+	// the wait for it, it leaves out.
+	WorkerTime time.Duration
+}
+
+// Pool crops images on a fixed number of worker goroutines. Jobs are handed
+// in with Submit and their outcomes arrive on Results, in completion order.
+// Close must be called once all jobs are submitted; Results is closed when
+// the last of them is done.
+type Pool struct {
+	// OnStart, if set before the first Submit, is called on the worker
+	// goroutine as each job starts
+	OnStart func(Job)
+
+	jobs    chan Job
+	writes  chan pendingWrite // nil when workers write their own outputs
+	results chan JobResult
+	wg      sync.WaitGroup
+}
+
+// pendingWrite is a finished job waiting for a writer
+type pendingWrite struct {
+	result JobResult
+	output *pendingOutput
+	start  time.Time
+}
+
+// NewPool starts a pool with the given number of workers, at least one
+func NewPool(workers int) *Pool {
+	return NewWriterPool(workers, 0)
+}
+
+// NewWriterPool starts a pool whose workers only crop and encode into
+// memory, handing each output to one of writers separate goroutines that
+// write it. On slow storage the workers then keep cropping while earlier
+// outputs are written. Once writers outputs are queued, workers wait for a
+// writer, bounding the memory held by finished images. With writers below
+// one it is NewPool.
+func NewWriterPool(workers, writers int) *Pool {
+	workers = max(workers, 1)
+	p := &Pool{
+		jobs:    make(chan Job),
+		results: make(chan JobResult, workers),
+	}
+
+	var writerWG sync.WaitGroup
+	if writers > 0 {
+		p.writes = make(chan pendingWrite, writers)
+		writerWG.Add(writers)
+		for i := 0; i < writers; i++ {
+			go func() {
+				defer writerWG.Done()
+				p.write()
+			}()
+		}
+	}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work(i)
+	}
+	go func() {
+		p.wg.Wait()
+		if p.writes != nil {
+			close(p.writes)
+			writerWG.Wait()
+		}
+		close(p.results)
+	}()
+	return p
+}
+
+// work processes jobs until the pool is closed, as the worker numbered id
+func (p *Pool) work(id int) {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		if p.OnStart != nil {
+			p.OnStart(job)
+		}
+
+		start := time.Now()
+		var r JobResult
+		r.Job = job
+		r.Worker = id
+		if job.BackupPath != "" && job.Preview == nil {
+			if err := backupFile(job.InputPath, job.BackupPath); err != nil {
+				r.Err = err
+				r.Duration = time.Since(start)
+				r.WorkerTime = r.Duration
+				p.results <- r
+				continue
+			}
+		}
+		if job.Preview != nil {
+			r.Result, r.Err = PreviewCrop(job.InputPath, job.OutputPath, job.Opts, *job.Preview)
+		} else if p.writes != nil {
+			out, err := prepareOutput(job.InputPath, job.OutputPath, job.Opts)
+			r.WorkerTime = time.Since(start)
+			if err == nil {
+				p.writes <- pendingWrite{result: r, output: out, start: start}
+				continue
+			}
+			r.Err = err
+		} else {
+			r.Result, r.Err = CropImage(job.InputPath, job.OutputPath, job.Opts)
+		}
+		r.Duration = time.Since(start)
+		r.WorkerTime = r.Duration
+		p.results <- r
+	}
+}
+
+// write saves outputs handed over by workers until the pool is done
+func (p *Pool) write() {
+	for w := range p.writes {
+		r := w.result
+		if err := w.output.write(); err != nil {
+			r.Err = err
+		} else {
+			r.Result = w.output.result
+		}
+		r.Duration = time.Since(w.start)
+		p.results <- r
+	}
+}
+
+// Submit queues a job, blocking until a worker takes it. Results must be
+// drained concurrently or Submit may block forever.
+func (p *Pool) Submit(job Job) {
+	p.jobs <- job
+}
+
+// SubmitContext is Submit that gives up once ctx is done. It reports whether
+// the job was queued.
+func (p *Pool) SubmitContext(ctx context.Context, job Job) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Close tells the pool no more jobs are coming
+func (p *Pool) Close() {
+	close(p.jobs)
+}
+
+// Results returns the channel job outcomes are delivered on
+func (p *Pool) Results() <-chan JobResult {
+	return p.results
+}
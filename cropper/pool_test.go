@@ -0,0 +1,74 @@
+package cropper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPoolReturnsEveryResult(t *testing.T) {
+	const n = 32
+
+	for _, tc := range []struct {
+		name             string
+		workers, writers int
+	}{
+		{"one worker", 1, 0},
+		{"workers", 4, 0},
+		{"separate writers", 4, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := pngBytes(t, borderedImage(64, 48, 6, 0))
+			var jobs []Job
+			for i := range n {
+				in := filepath.Join(dir, fmt.Sprintf("in%d.png", i))
+				if err := os.WriteFile(in, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+				jobs = append(jobs, Job{
+					ID:         i,
+					InputPath:  in,
+					OutputPath: filepath.Join(dir, fmt.Sprintf("out%d.png", i)),
+					Opts:       CropOptions{Tolerance: 10, MaxCropPercent: 40},
+				})
+			}
+
+			pool := NewWriterPool(tc.workers, tc.writers)
+			go func() {
+				defer pool.Close()
+				for _, j := range jobs {
+					pool.Submit(j)
+				}
+			}()
+
+			seen := make(map[int]int)
+			for r := range pool.Results() {
+				seen[r.Job.ID]++
+				if r.Err != nil {
+					t.Errorf("job %d: %v", r.Job.ID, r.Err)
+					continue
+				}
+				if r.Result == nil || !r.Result.WasCropped {
+					t.Errorf("job %d: got %+v, want a crop", r.Job.ID, r.Result)
+				}
+				if r.Worker < 0 || r.Worker >= tc.workers {
+					t.Errorf("job %d: worker %d out of range", r.Job.ID, r.Worker)
+				}
+				if _, err := os.Stat(r.Job.OutputPath); err != nil {
+					t.Errorf("job %d: output missing: %v", r.Job.ID, err)
+				}
+			}
+
+			if len(seen) != n {
+				t.Errorf("got results for %d jobs, want %d", len(seen), n)
+			}
+			for id, count := range seen {
+				if count != 1 {
+					t.Errorf("job %d returned %d times, want once", id, count)
+				}
+			}
+		})
+	}
+}
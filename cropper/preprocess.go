@@ -0,0 +1,123 @@
+package cropper
+
+import (
+	"image"
+	"image/draw"
+)
+
+// denoiseRadius is the radius in pixels of the box blur CropOptions.Denoise
+// applies, a 5x5 window: enough to average out sensor noise while leaving
+// border boundaries within a couple of pixels of where they were
+const denoiseRadius = 2
+
+// analysisImage returns the image that brightness analysis should run on.
+// Preprocessing only ever affects this working copy; cropped output pixels
+// always come from the original image.
+func analysisImage(img image.Image, opts CropOptions) image.Image {
+	// Blur first so equalizing does not stretch the noise along with the
+	// image
+	if opts.Denoise {
+		img = boxBlur(img, denoiseRadius)
+	}
+	if opts.Equalize {
+		img = equalizeHistogram(img, opts.luma())
+	}
+	return img
+}
+
+// equalizeHistogram builds a grayscale copy of img whose brightness histogram
+// is spread over the full 0-255 range. This amplifies small differences
+// between edges and center on low-contrast images.
+func equalizeHistogram(img image.Image, luma LumaWeights) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+
+	var histogram [256]int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			v := uint8(calculateBrightness(img.At(x, y), luma) + 0.5)
+			gray.Pix[gray.PixOffset(x, y)] = v
+			histogram[v]++
+		}
+	}
+
+	// Build the cumulative distribution, ignoring the empty bins below the
+	// darkest pixel so it maps to 0
+	total := bounds.Dx() * bounds.Dy()
+	var cdf [256]int
+	running := 0
+	cdfMin := 0
+	for i, count := range histogram {
+		running += count
+		cdf[i] = running
+		if cdfMin == 0 && running > 0 {
+			cdfMin = running
+		}
+	}
+
+	// A single-valued image has nothing to stretch
+	if total == cdfMin {
+		return gray
+	}
+
+	var lookup [256]uint8
+	for i := range lookup {
+		if cdf[i] < cdfMin {
+			continue
+		}
+		lookup[i] = uint8((cdf[i] - cdfMin) * 255 / (total - cdfMin))
+	}
+
+	for i, v := range gray.Pix {
+		gray.Pix[i] = lookup[v]
+	}
+	return gray
+}
+
+// boxBlur returns a copy of img with each pixel replaced by the average of
+// the (2*radius+1)-pixel square around it, computed as a horizontal and a
+// vertical pass of running sums. Near the image edges the window only
+// covers pixels inside the image, so borders are not darkened by the
+// missing pixels beyond them. Colour is kept for channel-variance mode.
+func boxBlur(img image.Image, radius int) *image.RGBA {
+	bounds := img.Bounds()
+	src := image.NewRGBA(bounds)
+	draw.Draw(src, bounds, img, bounds.Min, draw.Src)
+	if radius <= 0 || bounds.Empty() {
+		return src
+	}
+
+	tmp := image.NewRGBA(bounds)
+	blurPass(tmp, src, bounds.Dx(), bounds.Dy(), 4, src.Stride, radius)
+	blurPass(src, tmp, bounds.Dy(), bounds.Dx(), src.Stride, 4, radius)
+	return src
+}
+
+// blurPass averages the 2*radius+1 samples around each pixel along one
+// axis. The image is read as lines lines of length pixels, where step is
+// the byte distance between neighbouring pixels of a line and lineStep the
+// distance between the starts of neighbouring lines.
+func blurPass(dst, src *image.RGBA, length, lines, step, lineStep, radius int) {
+	for line := range lines {
+		start := line * lineStep
+		for c := range 4 {
+			sum, count := 0, 0
+			// Prime the window with the pixels to the right of the first
+			for i := 0; i < radius && i < length; i++ {
+				sum += int(src.Pix[start+i*step+c])
+				count++
+			}
+			for i := range length {
+				if in := i + radius; in < length {
+					sum += int(src.Pix[start+in*step+c])
+					count++
+				}
+				if out := i - radius - 1; out >= 0 {
+					sum -= int(src.Pix[start+out*step+c])
+					count--
+				}
+				dst.Pix[start+i*step+c] = uint8((sum + count/2) / count)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package cropper
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+)
+
+// PreviewStyle controls the outline PreviewCrop draws
+type PreviewStyle struct {
+	Color     color.Color
+	Thickness int
+}
+
+// PreviewCrop runs the crop analysis without cropping and writes a copy of the
+// image to previewPath with the proposed crop rectangle outlined. WasCropped
+// in the result reports whether a crop would have been made.
+func PreviewCrop(inputPath, previewPath string, opts CropOptions, style PreviewStyle) (*CropResult, error) {
+	opts.DecodeLimiter.acquire()
+	defer opts.DecodeLimiter.release()
+
+	img, format, err := decodeFile(inputPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var tolerance float64
+	if opts.AutoTolerance {
+		opts = withAutoTolerance(img, opts)
+		tolerance = opts.Tolerance
+	}
+
+	bounds := img.Bounds()
+	cropRect, reason, stop, err := findCropRect(img, opts)
+	if err != nil {
+		return nil, err
+	}
+	cropRect, reason, notes := adjustCropRect(cropRect, bounds, reason, opts)
+	notes = append(notes, toleranceNotes(tolerance, opts)...)
+
+	overlay := image.NewRGBA(bounds)
+	draw.Draw(overlay, bounds, img, bounds.Min, draw.Src)
+	drawOutline(overlay, cropRect, style)
+
+	var buf bytes.Buffer
+	if _, err := encodeImage(&buf, overlay, previewPath, format, opts); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(previewPath, buf.Bytes(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write preview file: %w", err)
+	}
+	if opts.BrightnessMapPath != "" {
+		brightnessMap, err := encodeBrightnessMap(img, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(opts.BrightnessMapPath, brightnessMap, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write brightness map: %w", err)
+		}
+	}
+
+	var result *CropResult
+	if cropRect.Eq(bounds) {
+		result = &CropResult{
+			Message:         fmt.Sprintf("would leave unchanged (%s)", reason),
+			UnchangedReason: reason,
+		}
+	} else {
+		result = &CropResult{
+			WasCropped: true,
+			Message:    fmt.Sprintf("would crop %.1f%% of image area", areaCropPercent(cropRect, bounds)),
+		}
+	}
+	result.OriginalSize = bounds.Size()
+	result.CropRect = cropRect
+	result.Format = format
+	result.Tolerance = tolerance
+	result.StopCondition = stop
+	if opts.Stats {
+		result.Stats = imageStats(img, opts)
+	}
+	result.addNotes(notes)
+	result.addNotes(extensionNotes(inputPath, format))
+	return result, nil
+}
+
+// drawOutline draws a rectangle outline of the given style just inside rect
+func drawOutline(img draw.Image, rect image.Rectangle, style PreviewStyle) {
+	t := max(style.Thickness, 1)
+	fill := image.NewUniform(style.Color)
+
+	for _, band := range []image.Rectangle{
+		image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+t), // top
+		image.Rect(rect.Min.X, rect.Max.Y-t, rect.Max.X, rect.Max.Y), // bottom
+		image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+t, rect.Max.Y), // left
+		image.Rect(rect.Max.X-t, rect.Min.Y, rect.Max.X, rect.Max.Y), // right
+	} {
+		draw.Draw(img, band.Intersect(rect), fill, image.Point{}, draw.Src)
+	}
+}
@@ -0,0 +1,418 @@
+package cropper
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// image/jpeg only writes baseline JPEGs, so progressive output is produced by
+// this small multi-scan encoder. It keeps full chroma resolution, uses the
+// standard Huffman tables and spectral selection without successive
+// approximation: one interleaved DC scan, then a low and a high frequency AC
+// scan per component.
+
+// jpegQuality is the quality of JPEG output unless CropOptions.JPEGQuality
+// sets another
+const jpegQuality = 95
+
+// unzig maps a zig-zag index to the natural (row-major) index of an 8x8 block
+var unzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// unscaledQuant are the Annex K quantization tables in zig-zag order,
+// luminance first
+var unscaledQuant = [2][64]byte{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// huffmanSpec is a Huffman table as stored in a DHT segment: the number of
+// codes of each length 1-16 and the symbols in code order
+type huffmanSpec struct {
+	counts [16]byte
+	values []byte
+}
+
+// Annex K Huffman tables: luminance DC, luminance AC, chrominance DC,
+// chrominance AC. The AC tables contain EOB (0x00), which progressive scans
+// read as an end-of-band run of one block.
+var huffmanSpecs = [4]huffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// huffmanCode is the code and code length of one symbol
+type huffmanCode struct {
+	code uint32
+	size uint
+}
+
+// codes builds the symbol-to-code lookup for the table
+func (s huffmanSpec) codes() [256]huffmanCode {
+	var table [256]huffmanCode
+	code, k := uint32(0), 0
+	for length, n := range s.counts {
+		for i := 0; i < int(n); i++ {
+			table[s.values[k]] = huffmanCode{code, uint(length + 1)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return table
+}
+
+// dctCos holds C(u)/2 * cos((2x+1)uπ/16) for the separable forward DCT
+var dctCos = func() (c [8][8]float64) {
+	for u := 0; u < 8; u++ {
+		scale := 0.5
+		if u == 0 {
+			scale = 0.5 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			c[u][x] = scale * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return c
+}()
+
+// jpegComponent is one color component of the image being encoded
+type jpegComponent struct {
+	// table selects the quantization and Huffman tables, 0 luma and 1 chroma
+	table int
+	// blocks holds the quantized coefficients of every 8x8 block in raster
+	// order, each in zig-zag order
+	blocks [][64]int16
+}
+
+// jpegScan is one scan of a progressive JPEG: the components it covers and
+// its spectral band
+type jpegScan struct {
+	components []int
+	start, end int
+}
+
+// encodeProgressiveJPEG writes img as a progressive (SOF2) JPEG at the given
+// quality. *image.Gray is written as a single-component JPEG.
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > 0xffff || b.Dy() > 0xffff {
+		return fmt.Errorf("image size %dx%d cannot be written as JPEG", b.Dx(), b.Dy())
+	}
+
+	var quant [2][64]int
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	for t := range quant {
+		for k := range quant[t] {
+			quant[t][k] = min(max((int(unscaledQuant[t][k])*scale+50)/100, 1), 255)
+		}
+	}
+
+	gray, isGray := img.(*image.Gray)
+	nComp := 3
+	if isGray {
+		nComp = 1
+	}
+	bw, bh := (b.Dx()+7)/8, (b.Dy()+7)/8
+	comps := make([]jpegComponent, nComp)
+	for c := range comps {
+		comps[c].table = min(c, 1)
+		comps[c].blocks = make([][64]int16, bw*bh)
+	}
+
+	// Sample each block, replicating the last row and column into the padding
+	var samples [3][64]float64
+	for by := 0; by < bh; by++ {
+		for bx := 0; bx < bw; bx++ {
+			for i := 0; i < 64; i++ {
+				x := min(b.Min.X+bx*8+i%8, b.Max.X-1)
+				y := min(b.Min.Y+by*8+i/8, b.Max.Y-1)
+				if isGray {
+					samples[0][i] = float64(gray.GrayAt(x, y).Y) - 128
+					continue
+				}
+				r, g, bl, _ := img.At(x, y).RGBA()
+				yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+				samples[0][i] = float64(yy) - 128
+				samples[1][i] = float64(cb) - 128
+				samples[2][i] = float64(cr) - 128
+			}
+			for c := range comps {
+				comps[c].blocks[by*bw+bx] = quantizeBlock(&samples[c], &quant[comps[c].table])
+			}
+		}
+	}
+
+	all := make([]int, nComp)
+	for c := range all {
+		all[c] = c
+	}
+	scans := []jpegScan{{components: all, start: 0, end: 0}}
+	for _, band := range [][2]int{{1, 5}, {6, 63}} {
+		for c := range comps {
+			scans = append(scans, jpegScan{components: []int{c}, start: band[0], end: band[1]})
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	out.Write([]byte{0xff, 0xd8})
+
+	// Quantization tables
+	nTables := min(nComp, 2)
+	writeMarker(out, 0xdb, 65*nTables)
+	for t := 0; t < nTables; t++ {
+		out.WriteByte(byte(t))
+		for k := 0; k < 64; k++ {
+			out.WriteByte(byte(quant[t][k]))
+		}
+	}
+
+	// Frame header, SOF2 marks a progressive DCT frame
+	writeMarker(out, 0xc2, 6+3*nComp)
+	out.Write([]byte{8, byte(b.Dy() >> 8), byte(b.Dy()), byte(b.Dx() >> 8), byte(b.Dx()), byte(nComp)})
+	for c := range comps {
+		out.Write([]byte{byte(c + 1), 0x11, byte(comps[c].table)})
+	}
+
+	// Huffman tables, DC and AC for each quantization table in use
+	length := 0
+	for t := 0; t < 2*nTables; t++ {
+		length += 17 + len(huffmanSpecs[t].values)
+	}
+	writeMarker(out, 0xc4, length)
+	for t := 0; t < 2*nTables; t++ {
+		out.WriteByte(byte((t%2)<<4 | t/2))
+		out.Write(huffmanSpecs[t].counts[:])
+		out.Write(huffmanSpecs[t].values)
+	}
+
+	var codes [4][256]huffmanCode
+	for t := range codes {
+		codes[t] = huffmanSpecs[t].codes()
+	}
+
+	for _, scan := range scans {
+		writeMarker(out, 0xda, 4+2*len(scan.components))
+		out.WriteByte(byte(len(scan.components)))
+		for _, c := range scan.components {
+			t := byte(comps[c].table)
+			out.Write([]byte{byte(c + 1), t<<4 | t})
+		}
+		out.Write([]byte{byte(scan.start), byte(scan.end), 0})
+
+		e := entropyWriter{w: out}
+		if scan.start == 0 {
+			// DC scan, interleaved: one block of each component per MCU
+			var pred [3]int
+			for i := 0; i < bw*bh; i++ {
+				for _, c := range scan.components {
+					dc := int(comps[c].blocks[i][0])
+					e.emitValue(&codes[2*comps[c].table], 0, dc-pred[c])
+					pred[c] = dc
+				}
+			}
+		} else {
+			c := scan.components[0]
+			ac := &codes[2*comps[c].table+1]
+			for i := range comps[c].blocks {
+				run := 0
+				for k := scan.start; k <= scan.end; k++ {
+					v := int(comps[c].blocks[i][k])
+					if v == 0 {
+						run++
+						continue
+					}
+					for ; run > 15; run -= 16 {
+						e.emit(ac[0xf0])
+					}
+					e.emitValue(ac, run, v)
+					run = 0
+				}
+				if run > 0 {
+					e.emit(ac[0x00])
+				}
+			}
+		}
+		e.flush()
+	}
+
+	out.Write([]byte{0xff, 0xd9})
+	return out.Flush()
+}
+
+// quantizeBlock applies the forward DCT to level-shifted samples and returns
+// the quantized coefficients in zig-zag order
+func quantizeBlock(samples *[64]float64, quant *[64]int) [64]int16 {
+	var rows, coef [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < 8; x++ {
+				sum += dctCos[u][x] * samples[y*8+x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for y := 0; y < 8; y++ {
+				sum += dctCos[v][y] * rows[y*8+u]
+			}
+			coef[v*8+u] = sum
+		}
+	}
+
+	var out [64]int16
+	for k := 0; k < 64; k++ {
+		out[k] = int16(math.Round(coef[unzig[k]] / float64(quant[k])))
+	}
+	return out
+}
+
+// writeMarker writes a marker and the length field of a segment with the
+// given payload length
+func writeMarker(w *bufio.Writer, marker byte, payload int) {
+	n := payload + 2
+	w.Write([]byte{0xff, marker, byte(n >> 8), byte(n)})
+}
+
+// entropyWriter packs Huffman-coded bits MSB first, stuffing a zero byte
+// after every 0xff
+type entropyWriter struct {
+	w    *bufio.Writer
+	acc  uint32
+	bits uint
+}
+
+func (e *entropyWriter) writeBits(v uint32, n uint) {
+	e.acc = e.acc<<n | v&(1<<n-1)
+	e.bits += n
+	for e.bits >= 8 {
+		c := byte(e.acc >> (e.bits - 8))
+		e.w.WriteByte(c)
+		if c == 0xff {
+			e.w.WriteByte(0)
+		}
+		e.bits -= 8
+	}
+}
+
+func (e *entropyWriter) emit(h huffmanCode) {
+	e.writeBits(h.code, h.size)
+}
+
+// emitValue writes the symbol for a zero run and the magnitude category of v,
+// followed by the category's extra bits
+func (e *entropyWriter) emitValue(table *[256]huffmanCode, run, v int) {
+	a := v
+	if a < 0 {
+		a = -a
+		v--
+	}
+	size := bits.Len(uint(a))
+	e.emit(table[run<<4|size])
+	if size > 0 {
+		e.writeBits(uint32(v), uint(size))
+	}
+}
+
+// flush pads the final byte of a scan with one bits
+func (e *entropyWriter) flush() {
+	if e.bits > 0 {
+		e.writeBits(1<<(8-e.bits)-1, 8-e.bits)
+	}
+	e.acc, e.bits = 0, 0
+}
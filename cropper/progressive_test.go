@@ -0,0 +1,126 @@
+package cropper
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// gradientImage returns a w x h image whose colors change along both axes
+func gradientImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8((x + y) * 127 / (w + h)), 255})
+		}
+	}
+	return img
+}
+
+// meanError returns the mean absolute difference of the 8-bit RGB channels
+// of two images of the same size
+func meanError(a, b image.Image) float64 {
+	var sum float64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ca := color.RGBAModel.Convert(a.At(x, y)).(color.RGBA)
+			cb := color.RGBAModel.Convert(b.At(x-bounds.Min.X+b.Bounds().Min.X, y-bounds.Min.Y+b.Bounds().Min.Y)).(color.RGBA)
+			for _, d := range []int{int(ca.R) - int(cb.R), int(ca.G) - int(cb.G), int(ca.B) - int(cb.B)} {
+				sum += float64(max(d, -d))
+			}
+		}
+	}
+	return sum / float64(bounds.Dx()*bounds.Dy()*3)
+}
+
+func TestEncodeProgressiveJPEG(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"color", gradientImage(64, 48)},
+		{"odd size", gradientImage(37, 23)},
+		{"one pixel", gradientImage(1, 1)},
+		{"offset bounds", gradientImage(50, 40).SubImage(image.Rect(5, 3, 45, 33))},
+		{"gray", func() image.Image {
+			g := image.NewGray(image.Rect(0, 0, 40, 30))
+			for i := range g.Pix {
+				g.Pix[i] = uint8(i * 7)
+			}
+			return g
+		}()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := encodeProgressiveJPEG(&buf, tc.img, 90); err != nil {
+				t.Fatal(err)
+			}
+			data := buf.Bytes()
+
+			segments, err := readJPEGSegments(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("failed to read segments: %v", err)
+			}
+			var sof []byte
+			for _, s := range segments {
+				if s.marker >= 0xC0 && s.marker <= 0xC3 {
+					sof = append(sof, s.marker)
+				}
+			}
+			if !bytes.Equal(sof, []byte{0xC2}) {
+				t.Errorf("frame markers %X, want only SOF2 (C2)", sof)
+			}
+			// Entropy-coded data stuffs every 0xFF with a zero, so FF DA
+			// only occurs as a start of scan
+			if scans := bytes.Count(data, []byte{0xFF, markerSOS}); scans < 2 {
+				t.Errorf("%d scans, want several", scans)
+			}
+
+			decoded, format, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("output does not decode: %v", err)
+			}
+			if format != "jpeg" {
+				t.Errorf("decoded as %s, want jpeg", format)
+			}
+			if got, want := decoded.Bounds().Size(), tc.img.Bounds().Size(); got != want {
+				t.Fatalf("decoded size %v, want %v", got, want)
+			}
+			if _, gray := tc.img.(*image.Gray); gray {
+				if _, ok := decoded.(*image.Gray); !ok {
+					t.Errorf("decoded %T, want *image.Gray", decoded)
+				}
+			}
+			if e := meanError(tc.img, decoded); e > 4 {
+				t.Errorf("mean error %.2f per channel, want at most 4", e)
+			}
+		})
+	}
+}
+
+func TestProgressiveOption(t *testing.T) {
+	var buf bytes.Buffer
+	if err := encodeJPEG(&buf, borderedImage(160, 120, 16, 0), CropOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, out := cropBytes(t, buf.Bytes(), "photo.jpg", CropOptions{Tolerance: 10, MaxCropPercent: 40, Progressive: true})
+	if !result.WasCropped {
+		t.Fatalf("got %q, want a crop", result.Message)
+	}
+	segments, err := readJPEGSegments(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range segments {
+		if s.marker == 0xC0 {
+			t.Error("cropped output is baseline (SOF0), want progressive")
+		}
+		if s.marker == 0xC2 {
+			return
+		}
+	}
+	t.Error("cropped output has no SOF2 marker")
+}
@@ -0,0 +1,75 @@
+package cropper
+
+import (
+	"image"
+	"math"
+)
+
+// statsHistogramBins is the number of equal brightness ranges, from 0 to
+// 255, that ImageStats.Histogram counts pixels in
+const statsHistogramBins = 16
+
+// ImageStats are the brightness measurements the analysis of an image is
+// based on, taken on the whole upright image before any crop
+type ImageStats struct {
+	// CenterBrightness is the reference brightness edges are compared to
+	CenterBrightness float64 `json:"center_brightness"`
+	// Edges are the outer bands of the image, a tenth of its height or
+	// width deep, that the uniformity check compares to the center
+	Edges struct {
+		Top    EdgeStats `json:"top"`
+		Bottom EdgeStats `json:"bottom"`
+		Left   EdgeStats `json:"left"`
+		Right  EdgeStats `json:"right"`
+	} `json:"edges"`
+	// Histogram counts the sampled pixels in each of statsHistogramBins
+	// brightness ranges, darkest first
+	Histogram [statsHistogramBins]int `json:"histogram"`
+}
+
+// EdgeStats are the brightness measurements of one edge band
+type EdgeStats struct {
+	Brightness float64 `json:"brightness"`
+	// Deviation is how much brighter (positive) or darker (negative) the
+	// band is than the center, in the units of the tolerance: percent of
+	// the center brightness, or brightness levels with ThresholdAbsolute
+	Deviation float64 `json:"deviation"`
+	// StdDev is the standard deviation of the band's pixel brightness
+	StdDev float64 `json:"stddev"`
+}
+
+// imageStats measures img with the brightness, reference region and sample
+// stride the analysis uses
+func imageStats(img image.Image, opts CropOptions) *ImageStats {
+	img = analysisImage(img, opts)
+	luma := opts.luma()
+	bounds := img.Bounds()
+
+	stats := &ImageStats{CenterBrightness: referenceBrightness(img, bounds, opts)}
+
+	edge := func(rect image.Rectangle) EdgeStats {
+		brightness := calculateRegionBrightness(img, rect, luma, opts.stride())
+		deviation := brightness - stats.CenterBrightness
+		if opts.ThresholdMode != ThresholdAbsolute {
+			deviation = deviation / math.Max(stats.CenterBrightness, minRelativeBrightness) * 100
+		}
+		return EdgeStats{
+			Brightness: brightness,
+			Deviation:  deviation,
+			StdDev:     regionStdDev(img, rect, luma, opts.stride()),
+		}
+	}
+	bands := edgeBands(bounds)
+	stats.Edges.Top = edge(bands[0])
+	stats.Edges.Bottom = edge(bands[1])
+	stats.Edges.Left = edge(bands[2])
+	stats.Edges.Right = edge(bands[3])
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += opts.stride() {
+		for x := bounds.Min.X; x < bounds.Max.X; x += opts.stride() {
+			bin := int(calculateBrightness(img.At(x, y), luma)) * statsHistogramBins / 256
+			stats.Histogram[min(max(bin, 0), statsHistogramBins-1)]++
+		}
+	}
+	return stats
+}
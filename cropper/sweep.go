@@ -0,0 +1,49 @@
+package cropper
+
+// SweepResult is the outcome of analyzing an image at one tolerance
+type SweepResult struct {
+	Tolerance float64
+	// CropPercent is the percentage of image area the crop would remove
+	CropPercent float64
+	// HitLimit reports that the crop reached MaxCropPercent in a dimension
+	HitLimit bool
+}
+
+// SweepTolerances decodes an image once and runs the crop analysis for each
+// tolerance without writing any output. The Tolerance field of opts is
+// ignored.
+func SweepTolerances(inputPath string, tolerances []float64, opts CropOptions) ([]SweepResult, error) {
+	opts.DecodeLimiter.acquire()
+	defer opts.DecodeLimiter.release()
+
+	img, _, err := decodeFile(inputPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	maxCropWidth := int(float64(width) * opts.MaxCropPercent / 100.0)
+	maxCropHeight := int(float64(height) * opts.MaxCropPercent / 100.0)
+
+	results := make([]SweepResult, 0, len(tolerances))
+	for _, tolerance := range tolerances {
+		opts.Tolerance = tolerance
+		cropRect, reason, _, err := findCropRect(img, opts)
+		if err != nil {
+			return nil, err
+		}
+		cropRect, _, _ = adjustCropRect(cropRect, bounds, reason, opts)
+
+		croppedWidth := width - cropRect.Dx()
+		croppedHeight := height - cropRect.Dy()
+		results = append(results, SweepResult{
+			Tolerance:   tolerance,
+			CropPercent: areaCropPercent(cropRect, bounds),
+			HitLimit: (maxCropWidth > 0 && croppedWidth >= maxCropWidth) ||
+				(maxCropHeight > 0 && croppedHeight >= maxCropHeight),
+		})
+	}
+	return results, nil
+}
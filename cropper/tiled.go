@@ -0,0 +1,723 @@
+package cropper
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"slices"
+)
+
+// A PNG stores its pixels row by row, each row filtered against the one
+// above and all of them compressed as one zlib stream split over IDAT
+// chunks. The rows of a non-interlaced PNG can therefore be decoded one
+// after another without holding the image, which CropOptions.Tiled uses for
+// images too large to decode whole: a first pass box-averages the rows into
+// an overview that the analysis runs on, and a second pass decodes the rows
+// again and writes the kept part of each straight into the output PNG, with
+// the sample format, palette and transparency of the input.
+
+// tiledOverviewSize is the longest side, in pixels, of the overview a tiled
+// crop is found on. Smaller images are analyzed at full resolution.
+const tiledOverviewSize = 2048
+
+// tiledChunkSize is the size of the read buffer and the most compressed
+// data a tiled crop writes into one IDAT chunk
+const tiledChunkSize = 1 << 16
+
+// pngSignature starts every PNG file
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// PNG color types
+const (
+	pngGray      = 0
+	pngRGB       = 2
+	pngPaletted  = 3
+	pngGrayAlpha = 4
+	pngRGBA      = 6
+)
+
+// pngDepths are the bit depths allowed for each color type
+var pngDepths = map[byte][]int{
+	pngGray:      {1, 2, 4, 8, 16},
+	pngRGB:       {8, 16},
+	pngPaletted:  {1, 2, 4, 8},
+	pngGrayAlpha: {8, 16},
+	pngRGBA:      {8, 16},
+}
+
+// errNotStripPNG marks inputs whose rows cannot be read one after another;
+// a tiled crop decodes them whole instead
+var errNotStripPNG = errors.New("not a non-interlaced PNG")
+
+// pngHeader is what reading and writing the rows of a PNG needs to know
+type pngHeader struct {
+	width, height int
+	depth         int // bits per sample
+	colorType     byte
+	palette       []byte // PLTE payload, three bytes per entry
+	transparency  []byte // tRNS payload
+}
+
+// channels returns the samples per pixel
+func (h *pngHeader) channels() int {
+	switch h.colorType {
+	case pngRGB:
+		return 3
+	case pngGrayAlpha:
+		return 2
+	case pngRGBA:
+		return 4
+	}
+	return 1
+}
+
+// rowBytes returns the bytes of an unfiltered row width pixels wide
+func (h *pngHeader) rowBytes(width int) int {
+	return (width*h.channels()*h.depth + 7) / 8
+}
+
+// pixelBytes returns the distance in bytes between corresponding samples of
+// neighboring pixels that the filters use, at least 1
+func (h *pngHeader) pixelBytes() int {
+	return max(h.channels()*h.depth/8, 1)
+}
+
+// sample returns sample i of an unfiltered row
+func (h *pngHeader) sample(row []byte, i int) uint32 {
+	switch h.depth {
+	case 16:
+		return uint32(row[2*i])<<8 | uint32(row[2*i+1])
+	case 8:
+		return uint32(row[i])
+	}
+	bit := i * h.depth
+	return uint32(row[bit/8]>>(8-h.depth-bit%8)) & (1<<h.depth - 1)
+}
+
+// rgba returns pixel x of an unfiltered row as alpha-premultiplied 16-bit
+// values, as color.Color.RGBA does for the pixels image/png decodes
+func (h *pngHeader) rgba(row []byte, x int) (r, g, b, a uint32) {
+	maxSample := uint32(1)<<h.depth - 1
+	scale := func(v uint32) uint16 {
+		return uint16(v * 0xffff / maxSample)
+	}
+	// tRNS holds one 16-bit sample per channel of the transparent color
+	keyed := func(samples ...uint32) bool {
+		if len(h.transparency) < 2*len(samples) {
+			return false
+		}
+		for i, s := range samples {
+			if uint32(binary.BigEndian.Uint16(h.transparency[2*i:])) != s {
+				return false
+			}
+		}
+		return true
+	}
+
+	c := color.NRGBA64{A: 0xffff}
+	switch h.colorType {
+	case pngPaletted:
+		// Indices past the palette are opaque black, as image/png reads them
+		i := int(h.sample(row, x))
+		if 3*i+3 > len(h.palette) {
+			return 0, 0, 0, 0xffff
+		}
+		p := color.NRGBA{h.palette[3*i], h.palette[3*i+1], h.palette[3*i+2], 0xff}
+		if i < len(h.transparency) {
+			p.A = h.transparency[i]
+		}
+		return p.RGBA()
+	case pngGray:
+		v := h.sample(row, x)
+		c.R, c.G, c.B = scale(v), scale(v), scale(v)
+		if keyed(v) {
+			c.A = 0
+		}
+	case pngRGB:
+		rv, gv, bv := h.sample(row, 3*x), h.sample(row, 3*x+1), h.sample(row, 3*x+2)
+		c.R, c.G, c.B = scale(rv), scale(gv), scale(bv)
+		if keyed(rv, gv, bv) {
+			c.A = 0
+		}
+	case pngGrayAlpha:
+		v := scale(h.sample(row, 2*x))
+		c.R, c.G, c.B, c.A = v, v, v, scale(h.sample(row, 2*x+1))
+	case pngRGBA:
+		c.R, c.G, c.B, c.A = scale(h.sample(row, 4*x)), scale(h.sample(row, 4*x+1)), scale(h.sample(row, 4*x+2)), scale(h.sample(row, 4*x+3))
+	}
+	return c.RGBA()
+}
+
+// pngRowReader decodes the rows of a non-interlaced PNG one at a time
+type pngRowReader struct {
+	header pngHeader
+	zr     io.ReadCloser
+	// row and prev are the current and previous row, filter type byte first
+	row, prev []byte
+}
+
+// openPNGRows rewinds r and reads the chunks of the PNG in it up to the
+// image data. Inputs that are not PNGs, and interlaced PNGs, return
+// errNotStripPNG.
+func openPNGRows(r io.ReadSeeker) (*pngRowReader, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind input: %w", err)
+	}
+	br := bufio.NewReaderSize(r, tiledChunkSize)
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(br, signature); err != nil || string(signature) != pngSignature {
+		return nil, errNotStripPNG
+	}
+
+	var h pngHeader
+	for first := true; ; first = false {
+		length, typ, err := readChunkHeader(br)
+		if err != nil {
+			return nil, err
+		}
+		if first != (typ == "IHDR") {
+			return nil, fmt.Errorf("PNG chunk %q out of order", typ)
+		}
+		switch typ {
+		case "IDAT":
+			idat := &idatReader{br: br, left: length, crc: crc32.NewIEEE()}
+			idat.crc.Write([]byte(typ))
+			zr, err := zlib.NewReader(idat)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read PNG image data: %w", err)
+			}
+			return &pngRowReader{
+				header: h,
+				zr:     zr,
+				row:    make([]byte, 1+h.rowBytes(h.width)),
+				prev:   make([]byte, 1+h.rowBytes(h.width)),
+			}, nil
+		case "IEND":
+			return nil, errors.New("PNG has no image data")
+		}
+
+		data, err := readChunk(br, typ, length, typ == "IHDR" || typ == "PLTE" || typ == "tRNS")
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "IHDR":
+			if len(data) != 13 {
+				return nil, errors.New("PNG header has the wrong length")
+			}
+			h.width = int(binary.BigEndian.Uint32(data[0:4]))
+			h.height = int(binary.BigEndian.Uint32(data[4:8]))
+			h.depth = int(data[8])
+			h.colorType = data[9]
+			if data[12] != 0 {
+				return nil, errNotStripPNG
+			}
+			if h.width <= 0 || h.height <= 0 || h.width > 1<<31-1 || h.height > 1<<31-1 {
+				return nil, fmt.Errorf("PNG of %dx%d pixels", h.width, h.height)
+			}
+			if !slices.Contains(pngDepths[h.colorType], h.depth) || data[10] != 0 || data[11] != 0 {
+				return nil, fmt.Errorf("unsupported PNG color type %d at bit depth %d", h.colorType, h.depth)
+			}
+		case "PLTE":
+			h.palette = data
+		case "tRNS":
+			h.transparency = data
+		}
+	}
+}
+
+// next decodes the next row and returns its unfiltered samples, valid until
+// the following call
+func (p *pngRowReader) next() ([]byte, error) {
+	p.row, p.prev = p.prev, p.row
+	if _, err := io.ReadFull(p.zr, p.row); err != nil {
+		return nil, fmt.Errorf("failed to read PNG image data: %w", noEOF(err))
+	}
+	cur, prev := p.row[1:], p.prev[1:]
+	bpp := p.header.pixelBytes()
+	switch p.row[0] {
+	case 0:
+	case 1:
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case 2:
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case 3:
+		for i := range cur {
+			var left int
+			if i >= bpp {
+				left = int(cur[i-bpp])
+			}
+			cur[i] += byte((left + int(prev[i])) / 2)
+		}
+	case 4:
+		for i := range cur {
+			var left, upperLeft byte
+			if i >= bpp {
+				left, upperLeft = cur[i-bpp], prev[i-bpp]
+			}
+			cur[i] += paethPredictor(left, prev[i], upperLeft)
+		}
+	default:
+		return nil, fmt.Errorf("PNG row filter type %d is invalid", p.row[0])
+	}
+	return cur, nil
+}
+
+// close releases the decompressor
+func (p *pngRowReader) close() {
+	p.zr.Close()
+}
+
+// idatReader reads the payloads of consecutive IDAT chunks as one stream,
+// checking each chunk's CRC
+type idatReader struct {
+	br   *bufio.Reader
+	left uint32 // payload bytes of the current chunk not yet read
+	crc  hash.Hash32
+	done bool
+}
+
+func (d *idatReader) Read(p []byte) (int, error) {
+	for d.left == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := checkCRC(d.br, "IDAT", d.crc.Sum32()); err != nil {
+			return 0, err
+		}
+		length, typ, err := readChunkHeader(d.br)
+		if err != nil {
+			return 0, err
+		}
+		if typ != "IDAT" {
+			d.done = true
+			return 0, io.EOF
+		}
+		d.left = length
+		d.crc.Reset()
+		d.crc.Write([]byte(typ))
+	}
+
+	p = p[:min(len(p), int(d.left))]
+	n, err := d.br.Read(p)
+	d.crc.Write(p[:n])
+	d.left -= uint32(n)
+	return n, noEOF(err)
+}
+
+// readChunkHeader reads the length and type of the next chunk
+func readChunkHeader(r io.Reader) (uint32, string, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, "", fmt.Errorf("failed to read PNG chunk: %w", noEOF(err))
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > 1<<31-1 {
+		return 0, "", fmt.Errorf("PNG chunk of %d bytes", length)
+	}
+	return length, string(header[4:]), nil
+}
+
+// readChunk reads the payload of a chunk and checks its CRC. The payload is
+// returned when keep is set and discarded otherwise.
+func readChunk(r io.Reader, typ string, length uint32, keep bool) ([]byte, error) {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	var payload bytes.Buffer
+	var w io.Writer = crc
+	if keep {
+		w = io.MultiWriter(crc, &payload)
+	}
+	if _, err := io.CopyN(w, r, int64(length)); err != nil {
+		return nil, fmt.Errorf("failed to read PNG %s chunk: %w", typ, noEOF(err))
+	}
+	if err := checkCRC(r, typ, crc.Sum32()); err != nil {
+		return nil, err
+	}
+	return payload.Bytes(), nil
+}
+
+// checkCRC reads the CRC that ends a chunk and compares it with sum
+func checkCRC(r io.Reader, typ string, sum uint32) error {
+	var stored [4]byte
+	if _, err := io.ReadFull(r, stored[:]); err != nil {
+		return fmt.Errorf("failed to read PNG %s chunk: %w", typ, noEOF(err))
+	}
+	if binary.BigEndian.Uint32(stored[:]) != sum {
+		return fmt.Errorf("PNG %s chunk checksum mismatch", typ)
+	}
+	return nil
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for data that must continue
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// paethPredictor returns whichever of the left, up and upper left bytes is
+// closest to left+up-upperLeft, ties going in that order
+func paethPredictor(left, up, upperLeft byte) byte {
+	p := int(left) + int(up) - int(upperLeft)
+	pa, pb, pc := abs(p-int(left)), abs(p-int(up)), abs(p-int(upperLeft))
+	switch {
+	case pa <= pb && pa <= pc:
+		return left
+	case pb <= pc:
+		return up
+	}
+	return upperLeft
+}
+
+// abs returns the absolute value of v
+func abs(v int) int {
+	return max(v, -v)
+}
+
+// readOverview decodes every row of a strip PNG and box-averages the rows
+// into an overview at most maxSide pixels on its longest side. It returns
+// the overview and the side, in image pixels, of the square each overview
+// pixel averages.
+func readOverview(rows *pngRowReader, maxSide int) (*image.RGBA64, int, error) {
+	h := rows.header
+	factor := (max(h.width, h.height) + maxSide - 1) / maxSide
+	width, height := (h.width+factor-1)/factor, (h.height+factor-1)/factor
+	overview := image.NewRGBA64(image.Rect(0, 0, width, height))
+
+	sums := make([]uint64, 4*width)
+	for y := range h.height {
+		row, err := rows.next()
+		if err != nil {
+			return nil, 0, err
+		}
+		for x := range h.width {
+			r, g, b, a := h.rgba(row, x)
+			s := sums[4*(x/factor):]
+			s[0] += uint64(r)
+			s[1] += uint64(g)
+			s[2] += uint64(b)
+			s[3] += uint64(a)
+		}
+		if (y+1)%factor != 0 && y != h.height-1 {
+			continue
+		}
+
+		// Squares at the right and bottom edges may be cut short
+		oy := y / factor
+		rowsIn := y - oy*factor + 1
+		for ox := range width {
+			n := uint64(min(factor, h.width-ox*factor) * rowsIn)
+			s := sums[4*ox : 4*ox+4]
+			overview.SetRGBA64(ox, oy, color.RGBA64{uint16(s[0] / n), uint16(s[1] / n), uint16(s[2] / n), uint16(s[3] / n)})
+			clear(s)
+		}
+	}
+	return overview, factor, nil
+}
+
+// overviewOptions returns opts for analyzing an overview downscaled by
+// factor, with the options given in image pixels scaled along
+func overviewOptions(opts CropOptions, factor int) CropOptions {
+	opts.SeedInsetPixels /= factor
+	if opts.MinBorderWidth > 0 {
+		opts.MinBorderWidth = max(opts.MinBorderWidth/factor, 1)
+	}
+	return opts
+}
+
+// scaleRect maps a rectangle of an overview downscaled by factor back onto
+// the image bounds
+func scaleRect(rect image.Rectangle, factor int, bounds image.Rectangle) image.Rectangle {
+	return image.Rect(rect.Min.X*factor, rect.Min.Y*factor, rect.Max.X*factor, rect.Max.Y*factor).Intersect(bounds)
+}
+
+// pngChunkWriter writes everything written to it as IDAT chunks
+type pngChunkWriter struct {
+	w io.Writer
+}
+
+func (c pngChunkWriter) Write(p []byte) (int, error) {
+	if err := writeChunk(c.w, "IDAT", p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeChunk writes one PNG chunk with its length and CRC
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	var header, sum [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	for _, part := range [][]byte{header[:], []byte(typ), data, sum[:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zlibLevel returns the zlib level of a PNG compression level
+func zlibLevel(level png.CompressionLevel) int {
+	switch level {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	}
+	return zlib.DefaultCompression
+}
+
+// writeTiledCrop writes the rect part of the strip PNG rows reads to w as a
+// PNG in the same sample format, reading no further than the last kept row
+func writeTiledCrop(w io.Writer, rows *pngRowReader, rect image.Rectangle, level png.CompressionLevel) error {
+	h := rows.header
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(rect.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(rect.Dy()))
+	ihdr[8] = byte(h.depth)
+	ihdr[9] = h.colorType
+
+	if _, err := io.WriteString(w, pngSignature); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	chunks := []struct {
+		typ  string
+		data []byte
+	}{{"IHDR", ihdr}, {"PLTE", h.palette}, {"tRNS", h.transparency}}
+	for _, c := range chunks {
+		if c.data == nil {
+			continue
+		}
+		if err := writeChunk(w, c.typ, c.data); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+	}
+
+	idat := bufio.NewWriterSize(pngChunkWriter{w}, tiledChunkSize)
+	zw, err := zlib.NewWriterLevel(idat, zlibLevel(level))
+	if err != nil {
+		return err
+	}
+
+	// Like image/png, pick a filter per row unless the samples are packed
+	// or palette indices, which filters do not help
+	adaptive := h.depth >= 8 && h.colorType != pngPaletted && level != png.NoCompression
+	bpp := h.pixelBytes()
+	cur := make([]byte, h.rowBytes(rect.Dx()))
+	prev := make([]byte, len(cur))
+	var filtered [5][]byte
+	for y := 0; y < rect.Max.Y; y++ {
+		row, err := rows.next()
+		if err != nil {
+			return fmt.Errorf("failed to decode image: %w", err)
+		}
+		if y < rect.Min.Y {
+			continue
+		}
+
+		cropRow(cur, row, rect.Min.X, rect.Dx(), h)
+		filter, data := byte(0), cur
+		if adaptive {
+			filter, data = filterRow(cur, prev, bpp, &filtered)
+		}
+		if _, err := zw.Write([]byte{filter}); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+		if _, err := zw.Write(data); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+		cur, prev = prev, cur
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	if err := idat.Flush(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	if err := writeChunk(w, "IEND", nil); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
+
+// cropRow copies the samples of width pixels of row, from x on, into dst
+func cropRow(dst, row []byte, x, width int, h pngHeader) {
+	if h.depth >= 8 {
+		start := x * h.pixelBytes()
+		copy(dst, row[start:start+len(dst)])
+		return
+	}
+
+	// Packed samples move to the start of the byte
+	clear(dst)
+	for i := range width {
+		bit := i * h.depth
+		dst[bit/8] |= byte(h.sample(row, x+i) << (8 - h.depth - bit%8))
+	}
+}
+
+// filterRow applies the filter type that leaves the smallest sum of
+// absolute byte values, the heuristic image/png uses, to cur and returns
+// the type and the filtered row, which is one of buf
+func filterRow(cur, prev []byte, bpp int, buf *[5][]byte) (byte, []byte) {
+	for i := range buf {
+		if len(buf[i]) != len(cur) {
+			buf[i] = make([]byte, len(cur))
+		}
+	}
+	copy(buf[0], cur)
+	for i, c := range cur {
+		var left, upperLeft byte
+		if i >= bpp {
+			left, upperLeft = cur[i-bpp], prev[i-bpp]
+		}
+		up := prev[i]
+		buf[1][i] = c - left
+		buf[2][i] = c - up
+		buf[3][i] = c - byte((int(left)+int(up))/2)
+		buf[4][i] = c - paethPredictor(left, up, upperLeft)
+	}
+
+	best, bestSum := 0, -1
+	for filter, data := range buf {
+		sum := 0
+		for _, v := range data {
+			sum += abs(int(int8(v)))
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = filter, sum
+		}
+	}
+	return byte(best), buf[best]
+}
+
+// cropTiled is CropImageStream for CropOptions.Tiled. Inputs and options it
+// leaves to the whole-image path return a nil result, with r rewound and a
+// note saying why.
+func cropTiled(r io.ReadSeeker, w io.Writer, name string, opts CropOptions) (*CropResult, string, error) {
+	decodeWhole := func(note string) (*CropResult, string, error) {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, "", fmt.Errorf("failed to rewind input: %w", err)
+		}
+		return nil, note, nil
+	}
+
+	converts := opts.OutputFormat != "" && opts.OutputFormat != "png"
+	if opts.rotates() || opts.Normalize || opts.Devignette || opts.BackgroundKey != nil || opts.SkipIfLarger || opts.Stats || opts.Cache != nil || opts.ThumbnailPath != "" || opts.BrightnessMapPath != "" || converts {
+		return decodeWhole("decoded whole, the options need the whole image")
+	}
+	rows, err := openPNGRows(r)
+	if errors.Is(err, errNotStripPNG) {
+		return decodeWhole("decoded whole, tiled reading needs a non-interlaced PNG")
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	if opts.BitDepth == BitDepth8 && rows.header.depth == 16 {
+		rows.close()
+		return decodeWhole("decoded whole, narrowing to 8 bits needs the whole image")
+	}
+
+	// The overview takes the place of the decoded image
+	opts.DecodeLimiter.acquire()
+	defer opts.DecodeLimiter.release()
+
+	bounds := image.Rect(0, 0, rows.header.width, rows.header.height)
+	var cropRect image.Rectangle
+	var reason UnchangedReason
+	var stop StopCondition
+	var tolerance, confidence float64
+	var notes []string
+	if opts.ManualCrop != nil || opts.FixedRect != nil {
+		// Preset crops do not look at the pixels
+		rows.close()
+		if cropRect, reason, stop, err = presetCropRect(bounds, opts); err != nil {
+			return nil, "", err
+		}
+	} else {
+		overview, factor, err := readOverview(rows, tiledOverviewSize)
+		rows.close()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decode image: %w", err)
+		}
+		if factor > 1 {
+			notes = append(notes, fmt.Sprintf("analyzed a %dx%d overview", overview.Rect.Dx(), overview.Rect.Dy()))
+		}
+
+		overviewOpts := overviewOptions(opts, factor)
+		if opts.AutoTolerance {
+			overviewOpts = withAutoTolerance(overview, overviewOpts)
+			tolerance = overviewOpts.Tolerance
+		}
+		rect, analysisReason, analysisStop, err := findCropRect(overview, overviewOpts)
+		if err != nil {
+			return nil, "", err
+		}
+		size := overview.Rect.Size()
+		confidence = cropConfidence(overview, overview.Rect, rect, opts.luma(), opts.cropStep(size.X, size.Y))
+		cropRect, reason, stop = scaleRect(rect, factor, bounds), analysisReason, analysisStop
+	}
+
+	cropRect, reason, adjustNotes := adjustCropRect(cropRect, bounds, reason, opts)
+	notes = append(adjustNotes, notes...)
+	notes = append(notes, toleranceNotes(tolerance, opts)...)
+	notes = append(notes, extensionNotes(name, "png")...)
+
+	if cropRect.Eq(bounds) {
+		result, err := copyImage(r, w, reason)
+		if err != nil {
+			return nil, "", err
+		}
+		result.OriginalSize = bounds.Size()
+		result.CropRect = bounds
+		result.Format = "png"
+		result.Tolerance = tolerance
+		result.StopCondition = stop
+		result.addNotes(notes)
+		return result, "", nil
+	}
+
+	// Read the rows again, this time writing the kept part of each
+	rows, err = openPNGRows(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	defer rows.close()
+	if err := writeTiledCrop(w, rows, cropRect, opts.PNGCompression); err != nil {
+		return nil, "", err
+	}
+
+	result := &CropResult{
+		WasCropped:    true,
+		Message:       fmt.Sprintf("cropped %.1f%% of image area", areaCropPercent(cropRect, bounds)),
+		OriginalSize:  bounds.Size(),
+		CropRect:      cropRect,
+		Format:        "png",
+		Tolerance:     tolerance,
+		Confidence:    confidence,
+		StopCondition: stop,
+	}
+	result.addNotes(notes)
+	return result, "", nil
+}
@@ -0,0 +1,232 @@
+package cropper
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// borderedPaletted returns a w x h paletted image of the given palette with
+// a border of index 0 and a checkered inside of the other indices
+func borderedPaletted(w, h, border int, palette color.Palette) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+	inner := image.Rect(border, border, w-border, h-border)
+	for y := range h {
+		for x := range w {
+			if image.Pt(x, y).In(inner) {
+				img.SetColorIndex(x, y, uint8(1+(x/3+y/3)%(len(palette)-1)))
+			}
+		}
+	}
+	return img
+}
+
+func TestTiledMatchesWholeImage(t *testing.T) {
+	gray16 := image.NewGray16(image.Rect(0, 0, 90, 70))
+	for y := range 70 {
+		for x := range 90 {
+			if x >= 7 && x < 83 && y >= 7 && y < 63 {
+				gray16.SetGray16(x, y, color.Gray16{uint16(30000 + 50*x)})
+			}
+		}
+	}
+	translucent := image.NewNRGBA(image.Rect(0, 0, 80, 60))
+	for y := range 60 {
+		for x := range 80 {
+			c := color.NRGBA{0, 0, 0, 255}
+			if x >= 9 && x < 71 && y >= 9 && y < 51 {
+				c = color.NRGBA{200, uint8(2 * x), uint8(3 * y), uint8(60 + x)}
+			}
+			translucent.SetNRGBA(x, y, c)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"rgb", borderedImage(100, 80, 10, 0)},
+		{"odd size", borderedImage(77, 51, 6, 250)},
+		{"gray", framedGray(120, 90, 10, 160, 0)},
+		{"gray16", gray16},
+		{"translucent", translucent},
+		// One and four bits per pixel pack several pixels into a byte, and
+		// the borders do not end on a byte boundary
+		{"1-bit palette", borderedPaletted(85, 60, 11, color.Palette{color.Black, color.White})},
+		{"4-bit palette", borderedPaletted(85, 60, 13, color.Palette{
+			color.Black, color.RGBA{200, 40, 40, 255}, color.RGBA{40, 200, 40, 255}, color.RGBA{40, 40, 200, 255}, color.NRGBA{200, 200, 40, 128},
+		})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := pngBytes(t, tc.img)
+			opts := CropOptions{Tolerance: 10, MaxCropPercent: 40}
+			want, wantOut := cropBytes(t, data, "scan.png", opts)
+			if !want.WasCropped {
+				t.Fatalf("whole image not cropped (%s), the test image needs a border", want.Message)
+			}
+
+			opts.Tiled = true
+			got, out := cropBytes(t, data, "scan.png", opts)
+			if !got.WasCropped || !got.CropRect.Eq(want.CropRect) || got.Message != want.Message {
+				t.Fatalf("tiled crop %v (%s), want %v (%s)", got.CropRect, got.Message, want.CropRect, want.Message)
+			}
+			decoded, format, err := image.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("tiled output does not decode: %v", err)
+			}
+			wantDecoded, _, err := image.Decode(bytes.NewReader(wantOut))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != "png" || reflect.TypeOf(decoded) != reflect.TypeOf(wantDecoded) {
+				t.Errorf("tiled output decodes as %s %T, want png %T", format, decoded, wantDecoded)
+			}
+			if !sameImage(decoded, tc.img.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(got.CropRect)) {
+				t.Error("tiled output pixels differ from the crop of the input")
+			}
+		})
+	}
+}
+
+func TestTiledOverview(t *testing.T) {
+	// Three image pixels to an overview pixel
+	img := framedGray(4500, 300, 60, 170, 20)
+	data := pngBytes(t, img)
+	opts := CropOptions{Tolerance: 10, MaxCropPercent: 40, Refine: true}
+	whole, _ := cropBytes(t, data, "pano.png", opts)
+	opts.Tiled = true
+	result, out := cropBytes(t, data, "pano.png", opts)
+	if !strings.Contains(result.Message, "analyzed a 1500x100 overview") {
+		t.Errorf("message %q, want the overview size", result.Message)
+	}
+	want := whole.CropRect
+	for _, d := range []int{
+		result.CropRect.Min.X - want.Min.X, result.CropRect.Max.X - want.Max.X,
+		result.CropRect.Min.Y - want.Min.Y, result.CropRect.Max.Y - want.Max.Y,
+	} {
+		if abs(d) > 3 {
+			t.Fatalf("crop %v, want %v to within one overview pixel", result.CropRect, want)
+		}
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameImage(decoded, img.SubImage(result.CropRect)) {
+		t.Error("tiled output pixels differ from the crop of the input")
+	}
+}
+
+func TestReadOverview(t *testing.T) {
+	// 7x5 pixels in 3x3 squares leave squares of one column and two rows
+	img := image.NewGray(image.Rect(0, 0, 7, 5))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(7 * i)
+	}
+	rows, err := openPNGRows(bytes.NewReader(pngBytes(t, img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.close()
+	overview, factor, err := readOverview(rows, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if factor != 3 || overview.Rect != image.Rect(0, 0, 3, 2) {
+		t.Fatalf("factor %d, overview %v, want 3 and 3x2", factor, overview.Rect)
+	}
+	for oy := range 2 {
+		for ox := range 3 {
+			square := image.Rect(3*ox, 3*oy, 3*ox+3, 3*oy+3).Intersect(img.Rect)
+			var sum int
+			for y := square.Min.Y; y < square.Max.Y; y++ {
+				for x := square.Min.X; x < square.Max.X; x++ {
+					sum += int(img.GrayAt(x, y).Y) * 0x101
+				}
+			}
+			want := sum / (square.Dx() * square.Dy())
+			if got := overview.RGBA64At(ox, oy); int(got.R) != want || got.A != 0xffff {
+				t.Errorf("overview pixel (%d,%d) is %v, want gray %d", ox, oy, got, want)
+			}
+		}
+	}
+}
+
+func TestTiledDecodesOthersWhole(t *testing.T) {
+	var jpegData bytes.Buffer
+	if err := encodeJPEG(&jpegData, borderedImage(100, 80, 10, 0), CropOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	pngData := pngBytes(t, borderedImage(100, 80, 10, 0))
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		opts CropOptions
+		note string
+	}{
+		{"photo.jpg", jpegData.Bytes(), CropOptions{}, "tiled reading needs a non-interlaced PNG"},
+		{"scan.png", pngData, CropOptions{Normalize: true}, "the options need the whole image"},
+	} {
+		tc.opts.Tolerance, tc.opts.MaxCropPercent, tc.opts.Tiled = 10, 40, true
+		result, _ := cropBytes(t, tc.data, tc.name, tc.opts)
+		if !result.WasCropped || !strings.Contains(result.Message, "decoded whole, "+tc.note) {
+			t.Errorf("%s: got %q, want a crop decoded whole because %s", tc.name, result.Message, tc.note)
+		}
+	}
+}
+
+func TestTiledCorruptData(t *testing.T) {
+	data := pngBytes(t, borderedImage(100, 80, 10, 0))
+	i := bytes.Index(data, []byte("IDAT"))
+	data[i+20] ^= 0xff
+
+	var out bytes.Buffer
+	if _, err := CropImageStream(bytes.NewReader(data), &out, "scan.png", CropOptions{Tolerance: 10, MaxCropPercent: 40, Tiled: true}); err == nil {
+		t.Error("corrupt image data was accepted")
+	}
+}
+
+func TestCropImageTiled(t *testing.T) {
+	dir := t.TempDir()
+	input, output := filepath.Join(dir, "scan.png"), filepath.Join(dir, "scan_cropped.png")
+	if err := os.WriteFile(input, pngBytes(t, borderedImage(100, 80, 10, 0)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := CropImage(input, output, CropOptions{Tolerance: 10, MaxCropPercent: 40, Tiled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.WasCropped {
+		t.Fatalf("got %q, want a crop", result.Message)
+	}
+	// The output went through a temporary file, which is gone
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if !slices.Equal(names, []string{"scan.png", "scan_cropped.png"}) {
+		t.Errorf("directory holds %q, want only the input and output", names)
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("output mode %v, want 0644", info.Mode().Perm())
+	}
+}
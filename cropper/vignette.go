@@ -0,0 +1,146 @@
+package cropper
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// vignetteRings is the number of equal distance bands, from the center to
+// the corners, that the brightness falloff is measured in
+const vignetteRings = 32
+
+// maxVignetteGain bounds how much any pixel is brightened, one stop, so a
+// dark subject in a corner is not blown out
+const maxVignetteGain = 2.0
+
+// minVignetteFalloff is the share of brightness the corners must lose
+// before vignetting is corrected; smaller falloffs are within noise
+const minVignetteFalloff = 0.02
+
+// vignetteModel is a radial brightness falloff: at distance r from the
+// center, as a fraction of the half diagonal, brightness is 1 + a*r² + b*r⁴
+// times that of the center
+type vignetteModel struct {
+	a, b float64
+}
+
+// falloff returns the relative brightness at distance r
+func (m vignetteModel) falloff(r float64) float64 {
+	r2 := r * r
+	return 1 + m.a*r2 + m.b*r2*r2
+}
+
+// gain returns the factor that undoes the falloff at distance r. Pixels are
+// only ever brightened, and by at most maxVignetteGain.
+func (m vignetteModel) gain(r float64) float64 {
+	v := m.falloff(r)
+	if v <= 0 {
+		return maxVignetteGain
+	}
+	return min(max(1/v, 1), maxVignetteGain)
+}
+
+// radius returns the distance of the pixel at x, y from the center of
+// bounds, as a fraction of the half diagonal, so the corners are at 1
+func radius(bounds image.Rectangle, x, y int) float64 {
+	cx := float64(bounds.Min.X+bounds.Max.X) / 2
+	cy := float64(bounds.Min.Y+bounds.Max.Y) / 2
+	halfDiagonal := math.Hypot(float64(bounds.Dx()), float64(bounds.Dy())) / 2
+	return math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) / halfDiagonal
+}
+
+// fitVignette measures the mean brightness of each ring around the center of
+// img and fits a vignetteModel to it by weighted least squares. It returns
+// nil when the corners are not darker than the center by at least
+// minVignetteFalloff, along with a note saying what was found.
+func fitVignette(img image.Image, opts CropOptions) (*vignetteModel, string) {
+	bounds := img.Bounds()
+	luma := opts.luma()
+
+	var sums, radii [vignetteRings]float64
+	var counts [vignetteRings]int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += opts.stride() {
+		for x := bounds.Min.X; x < bounds.Max.X; x += opts.stride() {
+			r := radius(bounds, x, y)
+			ring := min(int(r*vignetteRings), vignetteRings-1)
+			sums[ring] += calculateBrightness(img.At(x, y), luma)
+			radii[ring] += r
+			counts[ring]++
+		}
+	}
+
+	// Brightness is p0 + p1*r² + p2*r⁴; solve the normal equations, each
+	// ring weighted by its pixel count
+	var m [3][3]float64
+	var v [3]float64
+	for i, n := range counts {
+		if n == 0 {
+			continue
+		}
+		r2 := radii[i] / float64(n) * radii[i] / float64(n)
+		basis := [3]float64{1, r2, r2 * r2}
+		mean := sums[i] / float64(n)
+		for j := range 3 {
+			for k := range 3 {
+				m[j][k] += float64(n) * basis[j] * basis[k]
+			}
+			v[j] += float64(n) * basis[j] * mean
+		}
+	}
+	p, ok := solve3(m, v)
+	if !ok || p[0] <= 0 {
+		return nil, "no vignetting found"
+	}
+
+	model := vignetteModel{a: p[1] / p[0], b: p[2] / p[0]}
+	falloff := 1 - model.falloff(1)
+	if falloff < minVignetteFalloff {
+		return nil, "no vignetting found"
+	}
+	// The falloff at the corners is extrapolated and can pass 100% when the
+	// fit bends down steeply; report the bounded gain that is applied
+	return &model, fmt.Sprintf("corners brightened by up to %.2fx", model.gain(1))
+}
+
+// solve3 solves the 3x3 linear system m*p = v by Cramer's rule. It reports
+// false when m is singular, as when the image is too small to have rings.
+func solve3(m [3][3]float64, v [3]float64) ([3]float64, bool) {
+	det := func(a [3][3]float64) float64 {
+		return a[0][0]*(a[1][1]*a[2][2]-a[1][2]*a[2][1]) -
+			a[0][1]*(a[1][0]*a[2][2]-a[1][2]*a[2][0]) +
+			a[0][2]*(a[1][0]*a[2][1]-a[1][1]*a[2][0])
+	}
+	d := det(m)
+	if math.Abs(d) < 1e-12 {
+		return [3]float64{}, false
+	}
+	var p [3]float64
+	for i := range 3 {
+		replaced := m
+		for row := range 3 {
+			replaced[row][i] = v[row]
+		}
+		p[i] = det(replaced) / d
+	}
+	return p, true
+}
+
+// correctVignette multiplies every pixel of img by the model's gain at its
+// distance from the center, in place. Alpha is kept, and the image keeps its
+// pixel type; paletted images take the closest palette color.
+func correctVignette(img draw.Image, model vignetteModel) {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			g := model.gain(radius(bounds, x, y))
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			scale := func(v uint16) uint16 {
+				return uint16(min(math.Round(float64(v)*g), 0xffff))
+			}
+			img.Set(x, y, color.NRGBA64{R: scale(c.R), G: scale(c.G), B: scale(c.B), A: c.A})
+		}
+	}
+}
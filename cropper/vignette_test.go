@@ -0,0 +1,69 @@
+package cropper
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// vignettedImage returns a w x h image of brightness 200 at the center that
+// darkens towards the corners by falloff(r), r being the distance from the
+// center as a fraction of the half diagonal
+func vignettedImage(w, h int, falloff func(r float64) float64) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			v := 200 * falloff(radius(img.Bounds(), x, y))
+			img.SetGray(x, y, color.Gray{uint8(max(v, 0))})
+		}
+	}
+	return img
+}
+
+func TestDevignette(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		falloff func(r float64) float64
+	}{
+		{"lens", func(r float64) float64 { return 1 - 0.4*r*r }},
+		// Black corners make the fit bend down past zero at r=1
+		{"steep", func(r float64) float64 { return max(1-r*r*r*r*r*r*3, 0) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := vignettedImage(120, 90, tc.falloff)
+			result, out := cropBytes(t, pngBytes(t, img), "lens.png", CropOptions{Devignette: true})
+			if !result.Corrected || result.WasCropped || result.UnchangedReason != "" {
+				t.Fatalf("corrected %v, cropped %v, reason %q (%s), want a corrected image",
+					result.Corrected, result.WasCropped, result.UnchangedReason, result.Message)
+			}
+			if !strings.Contains(result.Message, "corners brightened by up to") || strings.Contains(result.Message, "%") {
+				t.Errorf("message %q, want the gain applied at the corners", result.Message)
+			}
+
+			decoded, _, err := image.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Bounds().Size() != img.Bounds().Size() {
+				t.Fatalf("output size %v, want the whole image", decoded.Bounds().Size())
+			}
+			// Pixels are only brightened, by at most maxVignetteGain
+			for _, p := range []image.Point{{60, 45}, {10, 10}, {30, 70}} {
+				before := img.GrayAt(p.X, p.Y).Y
+				after := color.GrayModel.Convert(decoded.At(p.X, p.Y)).(color.Gray).Y
+				if after < before || float64(after) > float64(before)*maxVignetteGain+1 {
+					t.Errorf("pixel %v went from %d to %d", p, before, after)
+				}
+			}
+		})
+	}
+
+	// An evenly lit image is copied as it is
+	data := pngBytes(t, vignettedImage(120, 90, func(float64) float64 { return 1 }))
+	result, out := cropBytes(t, data, "flat.png", CropOptions{Devignette: true})
+	if result.Corrected || !bytes.Equal(out, data) {
+		t.Errorf("evenly lit image corrected (%s), want it copied unchanged", result.Message)
+	}
+}
@@ -0,0 +1,137 @@
+package cropper
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pendingOutput is a processed image held in memory, or for tiled crops in
+// a temporary file, until it is written. Splitting CropImage here lets a
+// Pool hand writing to separate goroutines.
+type pendingOutput struct {
+	outputPath string
+	data       []byte
+	tempPath   string    // holds the output instead of data when set
+	modTime    time.Time // of the input
+	result     *CropResult
+	opts       CropOptions
+}
+
+// prepareOutput does everything CropImage does short of writing: it reads,
+// crops and encodes the image into memory
+func prepareOutput(inputPath, outputPath string, opts CropOptions) (*pendingOutput, error) {
+	// Open the input file
+	file, err := os.Open(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer file.Close()
+
+	// Read the modification time before processing
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat input file: %w", err)
+	}
+
+	// Buffer the output so a failure leaves no partial file behind. Tiled
+	// crops are of images too large for memory, their output is buffered in
+	// a temporary file next to the output instead.
+	if opts.Tiled {
+		return prepareTempOutput(file, outputPath, info.ModTime(), opts)
+	}
+	var buf bytes.Buffer
+	result, err := CropImageStream(file, &buf, outputPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pendingOutput{
+		outputPath: outputPath,
+		data:       buf.Bytes(),
+		modTime:    info.ModTime(),
+		result:     result,
+		opts:       opts,
+	}, nil
+}
+
+// prepareTempOutput is prepareOutput writing into a temporary file that
+// write renames to outputPath
+func prepareTempOutput(input io.ReadSeeker, outputPath string, modTime time.Time, opts CropOptions) (*pendingOutput, error) {
+	temp, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	w := bufio.NewWriter(temp)
+	result, err := CropImageStream(input, w, outputPath, opts)
+	if err == nil {
+		if err = w.Flush(); err == nil {
+			err = temp.Chmod(0644)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to write output file: %w", err)
+		}
+	}
+	if closeErr := temp.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write output file: %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return nil, err
+	}
+
+	return &pendingOutput{
+		outputPath: outputPath,
+		tempPath:   temp.Name(),
+		modTime:    modTime,
+		result:     result,
+		opts:       opts,
+	}, nil
+}
+
+// write saves the output, its thumbnail and its brightness map
+func (p *pendingOutput) write() error {
+	// A temporary output left over by a failure is removed
+	if p.tempPath != "" {
+		defer os.Remove(p.tempPath)
+	}
+
+	if p.result.brightnessMap != nil {
+		if err := os.WriteFile(p.opts.BrightnessMapPath, p.result.brightnessMap, 0644); err != nil {
+			return fmt.Errorf("failed to write brightness map: %w", err)
+		}
+	}
+
+	// Save the thumbnail first, so a failure leaves no output without one
+	if p.result.thumbnail != nil {
+		if err := os.WriteFile(p.opts.ThumbnailPath, p.result.thumbnail, 0644); err != nil {
+			return fmt.Errorf("failed to write thumbnail: %w", err)
+		}
+	}
+
+	// Save the cropped or copied image
+	if p.tempPath != "" {
+		if err := os.Rename(p.tempPath, p.outputPath); err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+	} else if err := os.WriteFile(p.outputPath, p.data, 0644); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	// Keep incremental sync tools from seeing the output as new
+	if p.opts.PreserveMTime {
+		if err := os.Chtimes(p.outputPath, p.modTime, p.modTime); err != nil {
+			return fmt.Errorf("failed to set output modification time: %w", err)
+		}
+		if p.result.thumbnail != nil {
+			if err := os.Chtimes(p.opts.ThumbnailPath, p.modTime, p.modTime); err != nil {
+				return fmt.Errorf("failed to set thumbnail modification time: %w", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// envFlags are the flags that fall back to an environment variable when not
+// given on the command line, for container deployments configured through
+// the environment
+var envFlags = []struct {
+	flag string
+	env  string
+}{
+	{"tolerance", "IMAGECROP_TOLERANCE"},
+	{"max-crop", "IMAGECROP_MAX_CROP"},
+	{"threads", "IMAGECROP_THREADS"},
+	{"output", "IMAGECROP_OUTPUT"},
+}
+
+// applyEnv sets every flag of envFlags that was not given on the command
+// line from its environment variable, when that is set and not empty. The
+// flag is then marked as explicit, so --profile leaves it alone and later
+// checks treat it exactly like a command-line value. Values are validated
+// with the flags.
+func applyEnv(explicitFlags map[string]bool) error {
+	for _, ef := range envFlags {
+		if explicitFlags[ef.flag] {
+			continue
+		}
+		value := os.Getenv(ef.env)
+		if value == "" {
+			continue
+		}
+		if err := flag.Set(ef.flag, value); err != nil {
+			return fmt.Errorf("%s: failed to set --%s: %w", ef.env, ef.flag, err)
+		}
+		explicitFlags[ef.flag] = true
+	}
+	return nil
+}
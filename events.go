@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// eventWriter streams newline-delimited JSON progress events to a file or
+// FIFO for tools that wrap the CLI. A nil writer discards events.
+type eventWriter struct {
+	mu        sync.Mutex
+	file      *os.File
+	enc       *json.Encoder
+	total     int
+	completed int
+}
+
+type startEvent struct {
+	Type    string `json:"type"`
+	Total   int    `json:"total"`
+	Threads int    `json:"threads"`
+}
+
+type fileDoneEvent struct {
+	Type      string `json:"type"`
+	Completed int    `json:"completed"`
+	Total     int    `json:"total"`
+	reportEntry
+	CropX int `json:"crop_x"`
+	CropY int `json:"crop_y"`
+}
+
+type summaryEvent struct {
+	Type      string `json:"type"`
+	Processed int    `json:"processed"`
+	Cropped   int    `json:"cropped"`
+	Corrected int    `json:"corrected"`
+	Unchanged int    `json:"unchanged"`
+	Skipped   int    `json:"skipped"`
+	Errors    int    `json:"errors"`
+}
+
+// newEventWriter opens path for writing. Opening a FIFO blocks until a reader
+// connects.
+func newEventWriter(path string) (*eventWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventWriter{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// emit writes one event per line. Write errors are ignored so a reader that
+// goes away does not stop processing.
+func (w *eventWriter) emit(event any) {
+	_ = w.enc.Encode(event)
+}
+
+// start announces the number of files about to be processed
+func (w *eventWriter) start(total, threads int) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.total = total
+	w.emit(startEvent{Type: "start", Total: total, Threads: threads})
+}
+
+// fileDone reports one finished file, successful or not
+func (w *eventWriter) fileDone(r result) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.completed++
+	w.emit(fileDoneEvent{
+		Type:        "file_done",
+		Completed:   w.completed,
+		Total:       w.total,
+		reportEntry: newReportEntry(r),
+		CropX:       r.cropRect.Min.X,
+		CropY:       r.cropRect.Min.Y,
+	})
+}
+
+// summary reports the final counts and closes the writer
+func (w *eventWriter) summary(event summaryEvent) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	event.Type = "summary"
+	w.emit(event)
+	w.file.Close()
+}
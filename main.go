@@ -1,51 +1,282 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"imagecrop/cropper"
 	"io/fs"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 )
 
 type job struct {
+	index     int
 	inputPath string
 	filename  string
 	outputDir string
-	tolerance float64
-	maxCrop   float64
+	// outputPath, when set, is the literal output file and overrides the
+	// output template
+	outputPath string
+	// outputName, when set, replaces filename when naming the output
+	outputName string
+	// backupPath, when set, is where the original is copied before cropping
+	backupPath string
+	// sourcePath, when set, is the file inputPath was made from: the PDF
+	// of a rasterized page
+	sourcePath string
+	opts       cropper.CropOptions
+}
+
+// thumbnailPath returns where the job's --thumbnail is written: next to a
+// literal output file, or in the output directory named after the input
+// ("photo.jpg" gives "photo_thumb.jpg") without any filename overrides
+func (j job) thumbnailPath() string {
+	dir, name := j.outputDir, j.filename
+	if j.outputPath != "" {
+		dir, name = filepath.Dir(j.outputPath), filepath.Base(j.outputPath)
+	} else if j.outputName != "" {
+		name = j.outputName
+	}
+	// Keyed outputs, and so their thumbnails, are PNGs
+	if j.opts.BackgroundKey != nil {
+		name = cropper.CorrectExtension(name, "png")
+	}
+	ext := filepath.Ext(name)
+	return filepath.Join(dir, strings.TrimSuffix(name, ext)+"_thumb"+ext)
+}
+
+// brightnessMapPath returns where the job's --debug-brightness-dir map is
+// written, named after the input ("photo.jpg" gives "photo_brightness.png")
+func (j job) brightnessMapPath(dir string) string {
+	name := strings.TrimSuffix(j.filename, filepath.Ext(j.filename))
+	return filepath.Join(dir, name+"_brightness.png")
 }
 
 type result struct {
-	filename   string
-	success    bool
-	wasCropped bool
-	message    string
+	index           int
+	filename        string
+	inputPath       string
+	outputPath      string
+	success         bool
+	wasCropped      bool
+	corrected       bool // rewritten without a crop, with --devignette
+	message         string
+	unchangedReason cropper.UnchangedReason
+	originalSize    image.Point
+	cropRect        image.Rectangle
+	confidence      float64
+	tolerance       float64             // picked with --auto-tolerance
+	mislabeled      bool                // the input's extension belongs to another format
+	stats           *cropper.ImageStats // measured for --stats-json
+	sourcePath      string              // the PDF a page came from
+	stopCondition   cropper.StopCondition
+	// inputSize and outputSize are the file sizes in bytes once the output
+	// is in place, both zero for previews or when either could not be read
+	inputSize  int64
+	outputSize int64
+}
+
+// bytesSaved is how much smaller the output is than the input, negative
+// when re-encoding grew the file
+func (r result) bytesSaved() int64 {
+	return r.inputSize - r.outputSize
 }
 
 func main() {
 	// Define CLI flags
-	inputDir := flag.String("input", "", "Input directory containing image files (required)")
-	outputDir := flag.String("output", "cropped", "Output directory (default: cropped)")
+	inputDir := flag.String("input", "", "Input directory containing image files, or a single image file (required unless --input-archive is set)")
+	outputDir := flag.String("output", "cropped", "Output directory, or output file when --input is a file (default: cropped)")
+	trustExtension := flag.Bool("trust-extension", true, "Name outputs after the input's extension even when the content is another format; false corrects it, e.g. a JPEG saved as .png is written as .jpg")
+	outputTemplateFlag := flag.String("output-template", defaultOutputTemplate, "Output file name template with {name}, {ext}, {cropped}, {w}, {h} and {date} placeholders")
+	extensions := flag.String("extensions", "", "Comma-separated file extensions to process (e.g. jpg,png; default: all supported formats)")
+	globFlag := flag.String("glob", "", "Comma-separated file name patterns to process, any of which must match (e.g. 'IMG_*,scan-??.png')")
+	inputArchive := flag.String("input-archive", "", "Zip archive to read images from instead of --input")
+	outputArchive := flag.String("output-archive", "", "Zip archive to write outputs to instead of --output (requires --input-archive)")
 	tolerance := flag.Float64("tolerance", 15.0, "Brightness variation tolerance percentage (0-100, default: 15)")
+	toleranceAbs := flag.Float64("tolerance-abs", 0, "Brightness variation tolerance in 0-255 units, instead of --tolerance (implies --threshold-mode absolute)")
 	maxCrop := flag.Float64("max-crop", 30.0, "Maximum crop percentage per dimension (0-100, default: 30)")
+	maxCropPerEdge := flag.Float64("max-crop-per-edge", 0, "Maximum crop percentage of a dimension from any single edge (0-100, default: 0 = no per-edge limit)")
 	threads := flag.Int("threads", 4, "Number of concurrent threads (default: 4)")
+	thresholdMode := flag.String("threshold-mode", "relative", "How --tolerance is applied: relative (percent of center brightness) or absolute (0-255 brightness units)")
+	equalize := flag.Bool("equalize", false, "Analyze a histogram-equalized copy of each image (output pixels are unchanged)")
+	denoise := flag.Bool("denoise", false, "Analyze a lightly blurred copy of each image to steady noisy edges (output pixels are unchanged)")
+	forceSquare := flag.Bool("force-square", false, "Trim the longer side after cropping to produce square output")
+	preserveDPI := flag.Bool("preserve-dpi", false, "Keep the JFIF resolution (DPI) header of JPEG inputs")
+	skipIfLarger := flag.Bool("skip-if-larger", false, "Keep the original when a crop removing under 10% of the area encodes larger than the input")
+	maxFileSize := flag.String("max-filesize", "", "Lower the JPEG quality until each cropped JPEG fits this size (e.g. 500KB, 2MB or bytes)")
+	thumbnail := flag.Int("thumbnail", 0, "Also write NAME_thumb.EXT scaled so its longest side is this many pixels (default: 0 = off)")
+	rotate := flag.Int("rotate", 0, "Rotate every image clockwise by 0, 90, 180 or 270 degrees before cropping, after --auto-orient")
+	autoOrient := flag.Bool("auto-orient", false, "Rotate JPEGs upright according to their EXIF orientation before cropping, even if no crop is made")
+	filenameOverrides := flag.Bool("filename-overrides", false, "Read per-file tolerance and max crop from name tokens such as photo__tol20__mc40.jpg and drop them from the output name")
+	backupDir := flag.String("backup", "", "Copy each original into this directory, keeping its relative path, before writing its output")
+	jpegQualityFlag := flag.Int("jpeg-quality", 95, "Quality of cropped JPEGs (1-100, default: 95)")
+	progressive := flag.Bool("progressive", false, "Write cropped JPEGs as progressive instead of baseline")
+	losslessJPEG := flag.Bool("lossless-jpeg", false, "Crop baseline JPEGs without re-compressing, moving the crop's top left corner onto the 8 or 16 pixel block grid")
+	preserveMTime := flag.Bool("preserve-mtime", false, "Give each output the modification time of its input")
+	deterministic := flag.Bool("deterministic", false, "Blank EXIF dates and drop XMP from metadata copied by --copy-metadata so outputs do not depend on when a file was taken or edited")
+	copyMetadata := flag.Bool("copy-metadata", false, "Copy EXIF, XMP, ICC and IPTC metadata of JPEG inputs to the output")
+	lumaStandard := flag.String("luma-standard", "bt601", "Luminance coefficients: bt601 or bt709 (default: bt601)")
+	lumaWeights := flag.String("luma-weights", "", "Explicit r,g,b luminance weights, overriding --luma-standard (e.g. 0.2126,0.7152,0.0722)")
+	adaptiveReference := flag.Bool("adaptive-reference", false, "When the reference region itself is not uniform, as on images that are mostly border, compare edges against a small patch at its center")
+	reference := flag.String("reference", "", "Normalized x,y point to center the reference region on (e.g. 0.33,0.66; default: image center)")
+	devignette := flag.Bool("devignette", false, "Correct lens vignetting, brightening darkened corners, and write the whole image instead of cropping it")
+	removeBackground := flag.String("remove-background", "", "Crop to the content around this RRGGBB background color and make the background transparent, writing PNG output")
+	backgroundTolerance := flag.Float64("background-tolerance", 30, "Largest difference of any RGB channel, 0-255, from the --remove-background color that still counts as background (default: 30)")
+	centerShape := flag.String("center-shape", "proportional", "Shape of the reference region: proportional (inner 60% of each dimension) or box (square of 60% of the shorter side, for panoramas)")
+	bitDepth := flag.String("bitdepth", "keep", "Output bit depth: keep (16-bit sources stay 16-bit where the format allows) or 8 (default: keep)")
+	pngCompression := flag.String("png-compression", "default", "PNG compression level: default, none, fast or best (default: default)")
+	normalize := flag.Bool("normalize", false, "Stretch the brightness of cropped images to the full range before encoding (alters pixels)")
+	protectFacesFlag := flag.Bool("protect-faces", false, "Never crop into detected faces (needs a build with -tags faces)")
+	autoTolerance := flag.Bool("auto-tolerance", false, "Pick each image's tolerance from the brightness spread of its center, looser for busy images and tighter for clean ones, instead of --tolerance")
+	toleranceFalloff := flag.Float64("tolerance-falloff", 0, "Share of --tolerance removed as the crop approaches --max-crop (0-1, default: 0 = constant tolerance)")
+	sampleStride := flag.Int("sample-stride", 1, "Average only every Nth pixel in x and y when comparing brightness (default: 1 = every pixel)")
+	multiEdge := flag.Bool("multi-edge", false, "Crop every non-uniform edge per iteration instead of only the worst one, a different search whose crops can differ from the default (faster on images bordered on several sides)")
+	lockEdges := flag.Bool("stop-on-content-detection", false, "Stop sampling an edge while it is sure to stay within --tolerance (fewer brightness averages, same crop)")
+	minBorderWidth := flag.Int("min-border-width", 0, "Only crop edges with a flat border at least this many pixels deep, leaving textured edges such as foliage alone (default: 0 = off)")
+	cropStep := flag.Float64("crop-step", 1, "Pixels each brightness search step removes, as a percentage of the mean image dimension (default: 1)")
+	refine := flag.Bool("refine", false, "After the coarse crop converges, back each edge out pixel by pixel while the image stays uniform")
+	minContrast := flag.Float64("min-contrast", 0, "Only start cropping when an edge differs from the center by more than this many brightness units, 0-255 (default: 0 = off)")
+	minCrop := flag.Float64("min-crop-percent", 0, "Treat crops removing less than this percentage of image area as unchanged (default: 0 = off)")
+	seedInsetFlag := flag.String("seed-inset", "", "Border known to be on every side, in pixels or percent (e.g. 50 or 3%); the brightness search starts inside it")
+	manualCropFlag := flag.String("manual-crop", "", "Skip the analysis and remove exactly top,bottom,left,right pixels from every image (e.g. 40,40,0,0)")
+	safeAreaFlag := flag.String("safe-area", "", "Region that always stays inside the crop, as insets from the top,right,bottom,left edges in pixels or percent, or one inset for all (e.g. 0,5%,20%,5%)")
+	margin := flag.String("margin", "", "Padding kept around the detected content, in pixels or percent (e.g. 12 or 2%)")
+	mode := flag.String("mode", "brightness", "Processing mode: brightness, gif-animated, edges, channel-variance or document (default: brightness)")
+	channelVariance := flag.Float64("channel-variance", 100, "Largest per-channel variance of a border line in channel-variance mode (default: 100)")
+	edgeThreshold := flag.Float64("edge-threshold", 0, "Sobel gradient magnitude counted as an edge in edges mode (default: 0 = automatic)")
+	edgeMargin := flag.Float64("edge-margin", 2, "Padding around detected content in edges mode, percent of each dimension (default: 2)")
+	cacheSize := flag.Int("cache-size", 0, "Remember the crop of this many distinct images by content hash, skipping analysis of repeats (default: 0 = off)")
+	writeThreads := flag.Int("write-threads", 0, "Write outputs on this many separate goroutines so --threads workers keep cropping during slow writes (default: 0 = workers write their own outputs)")
+	pngThreads := flag.Int("png-threads", 0, "Maximum PNG images processed at once (default: 0 = up to --threads)")
+	jpegThreads := flag.Int("jpeg-threads", 0, "Maximum JPEG images processed at once (default: 0 = up to --threads)")
+	maxDecodes := flag.Int("max-concurrent-decodes", 0, "Maximum images decoded in memory at once (default: same as --threads)")
+	tiled := flag.Bool("tiled", false, "Read non-interlaced PNGs a strip of rows at a time and find the crop on a downscaled overview, for images too large to decode; other images are decoded whole")
+	maskPath := flag.String("mask", "", "Mask image, or directory of masks named after each image, marking background in white")
+	bucketOutput := flag.Bool("bucket-output", false, "Sort outputs into cropped/ and unchanged/ subdirectories and list failures in errors/")
+	includeHidden := flag.Bool("include-hidden", false, "Also process files and directories whose names start with a dot, skipped by default")
+	verbose := flag.Bool("verbose", false, "Print additional detail, such as files skipped during the directory walk")
+	uniformCrop := flag.String("uniform-crop", "", "Crop every image to one rectangle combined from the crops of all images: intersection or median (for same-size frames such as a time-lapse)")
+	sweep := flag.String("sweep", "", "Comma-separated tolerances to compare without writing output (e.g. 5,10,15,20,25)")
+	analyzeOnly := flag.Bool("analyze-only", false, "Print the detected border widths of each image as JSON lines without writing any images")
+	emitGeometry := flag.Bool("emit-geometry", false, "Print each image's crop as an ImageMagick geometry string (WxH+X+Y) without writing any images")
+	debugBrightnessDir := flag.String("debug-brightness-dir", "", "Also write a grayscale PNG of each image's brightness, as the analysis sees it, to this directory")
+	pdfDPI := flag.Int("pdf-dpi", 300, "Resolution PDF pages are rasterized at, in dots per inch (needs a build with -tags pdf; default: 300)")
+	previewDir := flag.String("preview-dir", "", "Write copies with the proposed crop outlined to this directory instead of cropping")
+	previewColor := flag.String("preview-color", "ff0000", "Outline color for --preview-dir as hex RGB (default: ff0000)")
+	previewThickness := flag.Int("preview-thickness", 3, "Outline thickness in pixels for --preview-dir (default: 3)")
+	contactSheet := flag.String("contact-sheet", "", "After processing, tile thumbnails of every output with its file name into this PNG, continued on NAME_2.png and so on for large batches")
+	contactSheetColumns := flag.Int("contact-sheet-columns", 6, "Thumbnails per row of --contact-sheet (default: 6)")
+	contactSheetCell := flag.Int("contact-sheet-cell", 200, "Size in pixels of the square each --contact-sheet thumbnail is scaled to fit (default: 200)")
+	cpuProfile := flag.String("cpuprofile", "", "Write a CPU profile of the run to this file, for go tool pprof")
+	memProfile := flag.String("memprofile", "", "Write a heap profile to this file when the run ends, for go tool pprof")
+	reportPath := flag.String("report", "", "Write a per-file report to this path (CSV if it ends in .csv, JSON otherwise)")
+	errorList := flag.String("error-list", "", "Write the input path of every file that failed to this file, one per line, for re-running just those")
+	statsPath := flag.String("stats-json", "", "Write each image's center and edge brightness, deviations and a 16-bin brightness histogram to this JSON file")
+	parallelismReport := flag.Bool("parallelism-report", false, "Print each worker's file count and busy time after the summary, for tuning --threads")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics at http://ADDR/metrics while processing (e.g. :9090)")
+	eventsPath := flag.String("events", "", "Write newline-delimited JSON progress events to this file or FIFO")
+	verify := flag.Bool("verify", false, "Re-decode every output after processing and check it against the reported result")
+	verifyReportPath := flag.String("verify-report", "", "Verify the outputs listed in a JSON report from a previous run, then exit")
+	ordered := flag.Bool("ordered", false, "Print per-file results in discovery order instead of completion order")
+	failFast := flag.Bool("fail-fast", false, "Stop at the first file that fails and exit with status 1")
+	summaryOnly := flag.Bool("summary-only", false, "Suppress per-file output, print only errors and the final summary")
+	profileName := flag.String("profile", "", "Apply a named set of --jpeg-quality, --png-compression, --tolerance and --max-crop values; explicit flags win (built in: archive, web)")
+	profilesPath := flag.String("profiles-file", "", "JSON file of additional profiles for --profile, keyed by name")
+	toStdout := flag.Bool("stdout", false, "Write the cropped image of a single input file to standard output; all messages go to standard error")
+	outputFormat := flag.String("format", "", "Output format with --stdout: jpeg, png or gif (default: the input's format)")
 
 	flag.Parse()
 
+	// With --stdout the image is the only thing written to standard output;
+	// every message, errors included, goes to standard error instead
+	imageOut := os.Stdout
+	if *toStdout {
+		os.Stdout = os.Stderr
+	}
+
+	// Flags given on the command line, for those whose default is not enough
+	// to tell whether they were set
+	explicitFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	// Environment variables stand in for flags not given on the command
+	// line, ahead of the profile
+	if err := applyEnv(explicitFlags); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Apply the selected profile to every flag not given explicitly, before
+	// any flag is validated
+	if *profilesPath != "" && *profileName == "" {
+		fmt.Println("Error: --profiles-file requires --profile")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *profileName != "" {
+		profiles, err := loadProfiles(*profilesPath)
+		if err != nil {
+			fmt.Printf("Error: --profiles-file: %v\n", err)
+			os.Exit(1)
+		}
+		p, ok := profiles[*profileName]
+		if !ok {
+			fmt.Printf("Error: --profile must be one of: %s\n", strings.Join(profileNames(profiles), ", "))
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := applyProfile(p, explicitFlags); err != nil {
+			fmt.Printf("Error: --profile %s: %v\n", *profileName, err)
+			os.Exit(1)
+		}
+	}
+
+	// Verifying an earlier report needs no input and processes nothing
+	if *verifyReportPath != "" {
+		failed, err := verifyReport(*verifyReportPath)
+		if err != nil {
+			fmt.Printf("Error verifying report: %v\n", err)
+			os.Exit(1)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Validate required flags
-	if *inputDir == "" {
+	if *inputDir == "" && *inputArchive == "" {
 		fmt.Println("Error: --input flag is required")
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *inputDir != "" && *inputArchive != "" {
+		fmt.Println("Error: --input and --input-archive cannot be combined")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	// Validate tolerance
-	if *tolerance < 0 || *tolerance > 100 {
-		fmt.Println("Error: --tolerance must be between 0 and 100")
+	// Validate archive output, archives only support plain cropping
+	if *outputArchive != "" && *inputArchive == "" {
+		fmt.Println("Error: --output-archive requires --input-archive")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *inputArchive != "" && (*sweep != "" || *analyzeOnly || *emitGeometry || *previewDir != "" || *bucketOutput || *errorList != "" || *verify || *eventsPath != "" || *backupDir != "" || *metricsAddr != "" || *parallelismReport || *filenameOverrides || *thumbnail != 0 || *writeThreads != 0 || *uniformCrop != "" || *debugBrightnessDir != "" || *contactSheet != "") {
+		fmt.Println("Error: --input-archive cannot be combined with --sweep, --analyze-only, --emit-geometry, --preview-dir, --bucket-output, --error-list, --verify, --events, --backup, --metrics-addr, --parallelism-report, --filename-overrides, --thumbnail, --write-threads, --uniform-crop, --debug-brightness-dir or --contact-sheet")
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -57,6 +288,44 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Validate max-crop-per-edge
+	if *maxCropPerEdge < 0 || *maxCropPerEdge > 100 {
+		fmt.Println("Error: --max-crop-per-edge must be between 0 and 100")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate extensions
+	// PDFs are rasterized into pages when a rasterizer is built in; archive
+	// entries are only ever images
+	allowedExts, err := parseExtensions(*extensions, cropper.DefaultPDFRasterizer != nil && *inputArchive == "")
+	if err != nil {
+		fmt.Printf("Error: --extensions: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate glob patterns, which filter the directory walk
+	globs, err := parseGlobs(*globFlag)
+	if err != nil {
+		fmt.Printf("Error: --glob: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if globs != nil && (*inputArchive != "" || *toStdout) {
+		fmt.Println("Error: --glob cannot be combined with --input-archive or --stdout")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate output template
+	nameTemplate, err := parseOutputTemplate(*outputTemplateFlag)
+	if err != nil {
+		fmt.Printf("Error: --output-template: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	// Validate threads
 	if *threads < 1 {
 		fmt.Println("Error: --threads must be at least 1")
@@ -64,180 +333,1645 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Check if input directory exists
-	if _, err := os.Stat(*inputDir); os.IsNotExist(err) {
-		fmt.Printf("Error: Input directory '%s' does not exist\n", *inputDir)
+	// Validate write threads
+	if *writeThreads < 0 {
+		fmt.Println("Error: --write-threads must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate absolute tolerance, shorthand for --threshold-mode absolute
+	// with --tolerance in brightness units
+	if explicitFlags["tolerance-abs"] {
+		if explicitFlags["tolerance"] {
+			fmt.Println("Error: --tolerance and --tolerance-abs cannot be combined")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if explicitFlags["threshold-mode"] && cropper.ThresholdMode(*thresholdMode) != cropper.ThresholdAbsolute {
+			fmt.Println("Error: --tolerance-abs requires --threshold-mode absolute")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if *toleranceAbs < 0 || *toleranceAbs > 255 {
+			fmt.Println("Error: --tolerance-abs must be between 0 and 255")
+			flag.Usage()
+			os.Exit(1)
+		}
+		*thresholdMode = string(cropper.ThresholdAbsolute)
+		*tolerance = *toleranceAbs
+	}
+
+	// Validate threshold mode
+	cropThreshold := cropper.ThresholdMode(*thresholdMode)
+	if cropThreshold != cropper.ThresholdRelative && cropThreshold != cropper.ThresholdAbsolute {
+		fmt.Println("Error: --threshold-mode must be one of: relative, absolute")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate tolerance, absolute tolerances are on the 0-255 brightness scale
+	maxTolerance := 100.0
+	if cropThreshold == cropper.ThresholdAbsolute {
+		maxTolerance = 255
+	}
+	if *tolerance < 0 || *tolerance > maxTolerance {
+		fmt.Printf("Error: --tolerance must be between 0 and %.0f\n", maxTolerance)
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	// Create output directory if it doesn't exist
-	if err := os.MkdirAll(*outputDir, 0755); err != nil {
-		fmt.Printf("Error creating output directory: %v\n", err)
+	// Validate auto tolerance, which replaces the configured one
+	if *autoTolerance {
+		if explicitFlags["tolerance"] || explicitFlags["tolerance-abs"] || *sweep != "" {
+			fmt.Println("Error: --auto-tolerance cannot be combined with --tolerance, --tolerance-abs or --sweep")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if cropper.Mode(*mode) == cropper.ModeEdges || cropper.Mode(*mode) == cropper.ModeChannelVariance {
+			fmt.Println("Error: --auto-tolerance cannot be combined with --mode edges or channel-variance")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	// Validate tolerance falloff
+	if *toleranceFalloff < 0 || *toleranceFalloff > 1 {
+		fmt.Println("Error: --tolerance-falloff must be between 0 and 1")
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	// Collect all image files first
-	var jobs []job
-	err := filepath.WalkDir(*inputDir, func(path string, d fs.DirEntry, err error) error {
+	// Validate sweep tolerances
+	var sweepTolerances []float64
+	if *sweep != "" {
+		var err error
+		sweepTolerances, err = parseTolerances(*sweep, maxTolerance)
 		if err != nil {
-			return err
+			fmt.Printf("Error: --sweep: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
 		}
+	}
+
+	// Validate stats, which come with processed images
+	if *statsPath != "" && (*sweep != "" || *analyzeOnly || *emitGeometry) {
+		fmt.Println("Error: --stats-json cannot be combined with --sweep, --analyze-only or --emit-geometry")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *errorList != "" && (*sweep != "" || *analyzeOnly || *emitGeometry) {
+		fmt.Println("Error: --error-list cannot be combined with --sweep, --analyze-only or --emit-geometry")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// The worker report covers the processing pool, which these runs skip
+	if *parallelismReport && (*sweep != "" || *analyzeOnly || *emitGeometry) {
+		fmt.Println("Error: --parallelism-report cannot be combined with --sweep, --analyze-only or --emit-geometry")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate geometry output, another analysis-only dry run
+	if *emitGeometry && (*sweep != "" || *analyzeOnly) {
+		fmt.Println("Error: --emit-geometry cannot be combined with --sweep or --analyze-only")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate uniform crop, which replaces the analysis of single images
+	if *uniformCrop != "" && *uniformCrop != uniformIntersection && *uniformCrop != uniformMedian {
+		fmt.Println("Error: --uniform-crop must be one of: intersection, median")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *uniformCrop != "" && (*sweep != "" || *analyzeOnly || *emitGeometry) {
+		fmt.Println("Error: --uniform-crop cannot be combined with --sweep, --analyze-only or --emit-geometry")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-		// Skip directories and non-image files
-		if d.IsDir() {
-			return nil
+	// Validate luminance coefficients
+	var luma cropper.LumaWeights
+	switch *lumaStandard {
+	case "bt601":
+		luma = cropper.LumaBT601
+	case "bt709":
+		luma = cropper.LumaBT709
+	default:
+		fmt.Println("Error: --luma-standard must be one of: bt601, bt709")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *lumaWeights != "" {
+		var err error
+		luma, err = parseLumaWeights(*lumaWeights)
+		if err != nil {
+			fmt.Printf("Error: --luma-weights: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
 		}
+	}
 
-		ext := strings.ToLower(filepath.Ext(path))
-		if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
-			return nil
+	// Validate reference point
+	var referencePoint *cropper.ReferencePoint
+	if *reference != "" {
+		var err error
+		referencePoint, err = parseReferencePoint(*reference)
+		if err != nil {
+			fmt.Printf("Error: --reference: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
 		}
+	}
 
-		jobs = append(jobs, job{
-			inputPath: path,
-			filename:  filepath.Base(path),
-			outputDir: *outputDir,
-			tolerance: *tolerance,
-			maxCrop:   *maxCrop,
-		})
+	// Validate center shape
+	cropCenterShape := cropper.CenterShape(*centerShape)
+	if cropCenterShape != cropper.CenterProportional && cropCenterShape != cropper.CenterBox {
+		fmt.Println("Error: --center-shape must be one of: proportional, box")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-		return nil
-	})
+	// Validate minimum crop
+	if *minCrop < 0 || *minCrop > 100 {
+		fmt.Println("Error: --min-crop-percent must be between 0 and 100")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	if err != nil {
-		fmt.Printf("Error walking directory: %v\n", err)
+	// Validate crop step
+	if *cropStep <= 0 || *cropStep > 100 {
+		fmt.Println("Error: --crop-step must be greater than 0 and at most 100")
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	if len(jobs) == 0 {
-		fmt.Println("\nNo image files found to process.")
-		return
+	// Validate minimum contrast
+	if *minContrast < 0 || *minContrast > 255 {
+		fmt.Println("Error: --min-contrast must be between 0 and 255")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate sample stride
+	if *sampleStride < 1 {
+		fmt.Println("Error: --sample-stride must be at least 1")
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	fmt.Printf("Found %d images to process using %d threads...\n\n", len(jobs), *threads)
-
-	// Create channels for jobs and results
-	jobChan := make(chan job, len(jobs))
-	resultChan := make(chan result, len(jobs))
-
-	// Counters with mutex for thread safety
-	var (
-		processedCount int
-		croppedCount   int
-		unchangedCount int
-		errorCount     int
-		mu             sync.Mutex
-		outputMu       sync.Mutex // Separate mutex for console output
-	)
-
-	// Start worker goroutines
-	var wg sync.WaitGroup
-	for i := 0; i < *threads; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			for j := range jobChan {
-				// Print processing message (thread-safe)
-				outputMu.Lock()
-				fmt.Printf("Processing: %s\n", j.filename)
-				outputMu.Unlock()
-
-				// Process the image with a temporary output path
-				tempPath := filepath.Join(j.outputDir, fmt.Sprintf(".temp_%d_%s", workerID, j.filename))
-				cropResult, err := cropper.CropImage(j.inputPath, tempPath, j.tolerance, j.maxCrop)
+	// Validate minimum border width
+	if *minBorderWidth < 0 {
+		fmt.Println("Error: --min-border-width must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-				if err != nil {
-					outputMu.Lock()
-					fmt.Printf("  Error: %v\n", err)
-					outputMu.Unlock()
-
-					mu.Lock()
-					errorCount++
-					mu.Unlock()
-
-					resultChan <- result{
-						filename: j.filename,
-						success:  false,
-						message:  err.Error(),
-					}
-					continue
-				}
+	// Validate bit depth
+	outputDepth := cropper.BitDepth(*bitDepth)
+	if outputDepth != cropper.BitDepthKeep && outputDepth != cropper.BitDepth8 {
+		fmt.Println("Error: --bitdepth must be one of: keep, 8")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-				// Determine final output path based on whether image was cropped
-				var outputPath string
-				if cropResult.WasCropped {
-					nameWithoutExt := strings.TrimSuffix(j.filename, filepath.Ext(j.filename))
-					outputPath = filepath.Join(j.outputDir, nameWithoutExt+"_cropped"+filepath.Ext(j.filename))
-				} else {
-					outputPath = filepath.Join(j.outputDir, j.filename)
-				}
+	// Validate PDF resolution
+	if *pdfDPI < 1 {
+		fmt.Println("Error: --pdf-dpi must be at least 1")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-				// Rename temp file to final output path
-				if err := os.Rename(tempPath, outputPath); err != nil {
-					outputMu.Lock()
-					fmt.Printf("  Error renaming output file: %v\n", err)
-					outputMu.Unlock()
+	// Validate JPEG quality
+	if *jpegQualityFlag < 1 || *jpegQualityFlag > 100 {
+		fmt.Println("Error: --jpeg-quality must be between 1 and 100")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-					os.Remove(tempPath) // Clean up temp file
+	// Validate PNG compression
+	compressionLevels := map[string]png.CompressionLevel{
+		"default": png.DefaultCompression,
+		"none":    png.NoCompression,
+		"fast":    png.BestSpeed,
+		"best":    png.BestCompression,
+	}
+	compressionLevel, ok := compressionLevels[*pngCompression]
+	if !ok {
+		fmt.Println("Error: --png-compression must be one of: default, none, fast, best")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-					mu.Lock()
-					errorCount++
-					mu.Unlock()
+	// Face protection needs a detector compiled in
+	var faceDetector cropper.FaceDetector
+	if *protectFacesFlag {
+		if cropper.DefaultFaceDetector == nil {
+			fmt.Println("Error: --protect-faces is not available, this build has no face detector (build with -tags faces)")
+			os.Exit(1)
+		}
+		faceDetector = cropper.DefaultFaceDetector
+	}
 
-					resultChan <- result{
-						filename: j.filename,
-						success:  false,
-						message:  err.Error(),
-					}
-					continue
-				}
+	// Validate max file size
+	var maxFileSizeBytes int64
+	if *maxFileSize != "" {
+		var err error
+		maxFileSizeBytes, err = parseByteSize(*maxFileSize)
+		if err != nil {
+			fmt.Printf("Error: --max-filesize: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
 
-				// Update counters
-				mu.Lock()
-				processedCount++
-				if cropResult.WasCropped {
-					croppedCount++
-				} else {
-					unchangedCount++
-				}
-				mu.Unlock()
-
-				// Print result message (thread-safe)
-				outputMu.Lock()
-				fmt.Printf("  %s -> %s\n", cropResult.Message, filepath.Base(outputPath))
-				outputMu.Unlock()
-
-				resultChan <- result{
-					filename:   j.filename,
-					success:    true,
-					wasCropped: cropResult.WasCropped,
-					message:    cropResult.Message,
-				}
-			}
-		}(i)
+	// Validate lossless JPEG, which copies blocks rather than encoding pixels
+	if *losslessJPEG && (*progressive || *normalize || *maxFileSize != "") {
+		fmt.Println("Error: --lossless-jpeg cannot be combined with --progressive, --normalize or --max-filesize, which re-encode")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate background removal, which replaces the analysis and writes
+	// transparent PNGs whatever the input format
+	var backgroundKey color.Color
+	if *removeBackground != "" {
+		var err error
+		backgroundKey, err = parseHexColor(*removeBackground)
+		if err != nil {
+			fmt.Printf("Error: --remove-background: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if explicitFlags["mode"] || *maskPath != "" {
+			fmt.Println("Error: --remove-background cannot be combined with --mode or --mask, which decide the crop differently")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if *losslessJPEG || *normalize || *skipIfLarger {
+			fmt.Println("Error: --remove-background cannot be combined with --lossless-jpeg, --normalize or --skip-if-larger")
+			flag.Usage()
+			os.Exit(1)
+		}
+	} else if explicitFlags["background-tolerance"] {
+		fmt.Println("Error: --background-tolerance requires --remove-background")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *backgroundTolerance < 0 || *backgroundTolerance > 255 {
+		fmt.Println("Error: --background-tolerance must be between 0 and 255")
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	// Send jobs to workers
-	for _, j := range jobs {
-		jobChan <- j
+	// Validate devignetting, which replaces cropping altogether
+	if *devignette {
+		if explicitFlags["mode"] || *maskPath != "" || *manualCropFlag != "" || *uniformCrop != "" || *removeBackground != "" {
+			fmt.Println("Error: --devignette cannot be combined with --mode, --mask, --manual-crop, --uniform-crop or --remove-background")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if *sweep != "" || *analyzeOnly || *emitGeometry || *previewDir != "" {
+			fmt.Println("Error: --devignette cannot be combined with --sweep, --analyze-only, --emit-geometry or --preview-dir, which show crops")
+			flag.Usage()
+			os.Exit(1)
+		}
 	}
-	close(jobChan)
 
-	// Wait for all workers to complete
-	wg.Wait()
-	close(resultChan)
+	// Validate tiled reading, which never holds a whole image
+	if *tiled {
+		if *inputArchive != "" || *toStdout || *sweep != "" || *analyzeOnly || *emitGeometry || *previewDir != "" || *uniformCrop != "" {
+			fmt.Println("Error: --tiled cannot be combined with --input-archive, --stdout, --sweep, --analyze-only, --emit-geometry, --preview-dir or --uniform-crop, which decode whole images")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if *rotate != 0 || *normalize || *devignette || *removeBackground != "" || *skipIfLarger || *bitDepth == "8" || *thumbnail != 0 || *debugBrightnessDir != "" || *statsPath != "" || *cacheSize != 0 || *contactSheet != "" || *verify {
+			fmt.Println("Error: --tiled cannot be combined with --rotate, --normalize, --devignette, --remove-background, --skip-if-larger, --bitdepth 8, --thumbnail, --debug-brightness-dir, --stats-json, --cache-size, --contact-sheet or --verify, which need the whole image")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
 
-	// Drain results channel (optional, for future use)
-	for range resultChan {
-		// Results already processed in workers
+	// Validate standard output, a single image and nothing else
+	if *toStdout {
+		if *inputArchive != "" || explicitFlags["output"] || *sweep != "" || *analyzeOnly || *emitGeometry || *previewDir != "" || *uniformCrop != "" {
+			fmt.Println("Error: --stdout cannot be combined with --input-archive, --output, --sweep, --analyze-only, --emit-geometry, --preview-dir or --uniform-crop")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if *bucketOutput || *backupDir != "" || *thumbnail != 0 || *contactSheet != "" || *debugBrightnessDir != "" || *verify || *reportPath != "" || *statsPath != "" || *eventsPath != "" || *errorList != "" || *metricsAddr != "" || *parallelismReport || *writeThreads != 0 || *preserveMTime || *filenameOverrides {
+			fmt.Println("Error: --stdout cannot be combined with flags that write other files or describe a batch (--bucket-output, --backup, --thumbnail, --contact-sheet, --debug-brightness-dir, --verify, --report, --stats-json, --events, --error-list, --metrics-addr, --parallelism-report, --write-threads, --preserve-mtime, --filename-overrides)")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	if *outputFormat != "" {
+		if !*toStdout {
+			fmt.Println("Error: --format requires --stdout")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if !slices.Contains(outputFormats, *outputFormat) {
+			fmt.Printf("Error: --format must be one of: %s\n", strings.Join(outputFormats, ", "))
+			flag.Usage()
+			os.Exit(1)
+		}
+		if *removeBackground != "" && *outputFormat != "png" {
+			fmt.Println("Error: --remove-background writes PNG output, --format must be png or left out")
+			flag.Usage()
+			os.Exit(1)
+		}
 	}
 
-	// Print summary
-	fmt.Printf("\nProcessing complete!\n")
-	fmt.Printf("Successfully processed: %d files\n", processedCount)
-	fmt.Printf("  Cropped: %d files\n", croppedCount)
-	fmt.Printf("  Unchanged: %d files\n", unchangedCount)
-	if errorCount > 0 {
-		fmt.Printf("Errors encountered: %d files\n", errorCount)
+	// Validate margin
+	var marginPixels int
+	var marginPercent float64
+	if *margin != "" {
+		var err error
+		marginPixels, marginPercent, err = parseMargin(*margin)
+		if err != nil {
+			fmt.Printf("Error: --margin: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	// Validate safe area
+	var safeArea *cropper.SafeArea
+	if *safeAreaFlag != "" {
+		var err error
+		safeArea, err = parseSafeArea(*safeAreaFlag)
+		if err != nil {
+			fmt.Printf("Error: --safe-area: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	// Validate seed inset, a percentage is checked against the crop limits
+	// here, pixels are limited per image
+	var seedPixels int
+	var seedPercent float64
+	if *seedInsetFlag != "" {
+		var err error
+		seedPixels, seedPercent, err = parseMargin(*seedInsetFlag)
+		if err != nil {
+			fmt.Printf("Error: --seed-inset: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if 2*seedPercent > *maxCrop || (*maxCropPerEdge > 0 && seedPercent > *maxCropPerEdge) {
+			fmt.Println("Error: --seed-inset exceeds --max-crop or --max-crop-per-edge")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	// Validate preview style
+	var previewStyle cropper.PreviewStyle
+	if *previewDir != "" {
+		c, err := parseHexColor(*previewColor)
+		if err != nil {
+			fmt.Printf("Error: --preview-color: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if *previewThickness < 1 {
+			fmt.Println("Error: --preview-thickness must be at least 1")
+			flag.Usage()
+			os.Exit(1)
+		}
+		previewStyle = cropper.PreviewStyle{Color: c, Thickness: *previewThickness}
+	}
+
+	// Validate mode
+	cropMode := cropper.Mode(*mode)
+	switch cropMode {
+	case cropper.ModeBrightness, cropper.ModeGIFAnimated, cropper.ModeEdges, cropper.ModeChannelVariance, cropper.ModeDocument:
+	default:
+		fmt.Println("Error: --mode must be one of: brightness, gif-animated, edges, channel-variance, document")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate manual crop, which replaces every analysis
+	var manualCrop *cropper.ManualCrop
+	if *manualCropFlag != "" {
+		var err error
+		manualCrop, err = parseManualCrop(*manualCropFlag)
+		if err != nil {
+			fmt.Printf("Error: --manual-crop: %v\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if explicitFlags["mode"] || *maskPath != "" || *uniformCrop != "" || *sweep != "" {
+			fmt.Println("Error: --manual-crop cannot be combined with --mode, --mask, --uniform-crop or --sweep")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	// The seed only applies to the brightness search
+	if *seedInsetFlag != "" && (cropMode == cropper.ModeEdges || cropMode == cropper.ModeChannelVariance) {
+		fmt.Println("Error: --seed-inset cannot be combined with --mode edges or channel-variance")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// The contrast gate only applies to the brightness search
+	if *minContrast > 0 && (cropMode == cropper.ModeEdges || cropMode == cropper.ModeChannelVariance || *removeBackground != "") {
+		fmt.Println("Error: --min-contrast cannot be combined with --mode edges or channel-variance, or with --remove-background")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate rotation, animated GIFs are cropped frame by frame unrotated
+	if *rotate != 0 && *rotate != 90 && *rotate != 180 && *rotate != 270 {
+		fmt.Println("Error: --rotate must be one of: 0, 90, 180, 270")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *rotate != 0 && cropMode == cropper.ModeGIFAnimated {
+		fmt.Println("Error: --rotate cannot be combined with --mode gif-animated")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate thumbnail size, animated GIFs are written frame by frame
+	// without a single image to scale
+	if *thumbnail < 0 {
+		fmt.Println("Error: --thumbnail must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *thumbnail != 0 && cropMode == cropper.ModeGIFAnimated {
+		fmt.Println("Error: --thumbnail cannot be combined with --mode gif-animated")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Brightness maps show one image, animated GIFs are cropped frame by frame
+	if *debugBrightnessDir != "" && cropMode == cropper.ModeGIFAnimated {
+		fmt.Println("Error: --debug-brightness-dir cannot be combined with --mode gif-animated")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate contact sheet, which shows outputs and is always a PNG
+	if *contactSheet != "" {
+		if !strings.EqualFold(filepath.Ext(*contactSheet), ".png") {
+			fmt.Println("Error: --contact-sheet must name a .png file")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if *sweep != "" || *analyzeOnly || *emitGeometry {
+			fmt.Println("Error: --contact-sheet cannot be combined with --sweep, --analyze-only or --emit-geometry, which write no images")
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	if *contactSheetColumns < 1 {
+		fmt.Println("Error: --contact-sheet-columns must be at least 1")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *contactSheetCell < 16 {
+		fmt.Println("Error: --contact-sheet-cell must be at least 16")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate channel variance threshold
+	if *channelVariance < 0 {
+		fmt.Println("Error: --channel-variance must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate edge detection settings
+	if *edgeThreshold < 0 {
+		fmt.Println("Error: --edge-threshold must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *edgeMargin < 0 || *edgeMargin > 50 {
+		fmt.Println("Error: --edge-margin must be between 0 and 50")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate max-concurrent-decodes
+	if *maxDecodes < 0 {
+		fmt.Println("Error: --max-concurrent-decodes must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Validate cache size
+	if *cacheSize < 0 {
+		fmt.Println("Error: --cache-size must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+	var rectCache *cropper.RectCache
+	if *cacheSize > 0 {
+		rectCache = cropper.NewRectCache(*cacheSize)
+	}
+
+	// Only a limit below the thread count has any effect
+	var decodeLimiter cropper.Limiter
+	if *maxDecodes > 0 && *maxDecodes < *threads {
+		decodeLimiter = cropper.NewLimiter(*maxDecodes)
+	}
+
+	// Validate per-format limits; like the decode limit, only a limit below
+	// the thread count has any effect
+	var formatLimiters map[string]cropper.Limiter
+	for format, limit := range map[string]int{"png": *pngThreads, "jpeg": *jpegThreads} {
+		if limit < 0 {
+			fmt.Printf("Error: --%s-threads must not be negative\n", format)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if limit > 0 && limit < *threads {
+			if formatLimiters == nil {
+				formatLimiters = make(map[string]cropper.Limiter)
+			}
+			formatLimiters[format] = cropper.NewLimiter(limit)
+		}
+	}
+
+	// A mask directory holds one mask per image, a mask file applies to every image
+	maskIsDir := false
+	if *maskPath != "" {
+		info, err := os.Stat(*maskPath)
+		if err != nil {
+			fmt.Printf("Error: Mask '%s' does not exist\n", *maskPath)
+			os.Exit(1)
+		}
+		maskIsDir = info.IsDir()
+	}
+
+	// Options shared by every image, masks may still vary per image
+	baseOpts := cropper.CropOptions{
+		Tolerance:             *tolerance,
+		MaxCropPercent:        *maxCrop,
+		MaskPath:              *maskPath,
+		DecodeLimiter:         decodeLimiter,
+		FormatLimiters:        formatLimiters,
+		Mode:                  cropMode,
+		ThresholdMode:         cropThreshold,
+		Equalize:              *equalize,
+		Denoise:               *denoise,
+		ForceSquare:           *forceSquare,
+		PreserveDPI:           *preserveDPI,
+		EdgeThreshold:         *edgeThreshold,
+		EdgeMarginPercent:     *edgeMargin,
+		BitDepth:              outputDepth,
+		PNGCompression:        compressionLevel,
+		Normalize:             *normalize,
+		FaceDetector:          faceDetector,
+		Cache:                 rectCache,
+		ToleranceFalloff:      *toleranceFalloff,
+		Refine:                *refine,
+		CropStepPercent:       *cropStep,
+		MultiEdge:             *multiEdge,
+		LockEdges:             *lockEdges,
+		MinBorderWidth:        *minBorderWidth,
+		SampleStride:          *sampleStride,
+		ChannelVariance:       *channelVariance,
+		MinCropPercent:        *minCrop,
+		MinContrast:           *minContrast,
+		MarginPixels:          marginPixels,
+		MarginPercent:         marginPercent,
+		SafeArea:              safeArea,
+		ManualCrop:            manualCrop,
+		SeedInsetPixels:       seedPixels,
+		SeedInsetPercent:      seedPercent,
+		Luma:                  luma,
+		Reference:             referencePoint,
+		CenterShape:           cropCenterShape,
+		Devignette:            *devignette,
+		BackgroundKey:         backgroundKey,
+		BackgroundTolerance:   *backgroundTolerance,
+		AdaptiveReference:     *adaptiveReference,
+		AutoTolerance:         *autoTolerance,
+		Stats:                 *statsPath != "",
+		CopyMetadata:          *copyMetadata,
+		Deterministic:         *deterministic,
+		Progressive:           *progressive,
+		LosslessJPEG:          *losslessJPEG,
+		JPEGQuality:           *jpegQualityFlag,
+		MaxFileSize:           maxFileSizeBytes,
+		AutoOrient:            *autoOrient,
+		ThumbnailSize:         *thumbnail,
+		SkipIfLarger:          *skipIfLarger,
+		Rotate:                *rotate,
+		PreserveMTime:         *preserveMTime,
+		MaxCropPerEdgePercent: *maxCropPerEdge,
+		OutputFormat:          *outputFormat,
+		Tiled:                 *tiled,
+	}
+
+	// Profile everything from here on. Exits below go through exit, or
+	// cleanup once there are temporary files, since os.Exit skips deferred
+	// calls.
+	prof, err := startProfiles(*cpuProfile, *memProfile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer prof.stop()
+	exit := func(code int) {
+		prof.stop()
+		os.Exit(code)
+	}
+
+	// Archive entries are cropped in memory, there is no directory to walk
+	if *inputArchive != "" {
+		maskDir := ""
+		if maskIsDir {
+			maskDir = *maskPath
+			baseOpts.MaskPath = ""
+		}
+		code := runArchiveInput(archiveConfig{
+			archivePath:    *inputArchive,
+			outputDir:      *outputDir,
+			outputArchive:  *outputArchive,
+			maskDir:        maskDir,
+			extensions:     allowedExts,
+			template:       nameTemplate,
+			trustExtension: *trustExtension,
+			threads:        *threads,
+			reportPath:     *reportPath,
+			statsPath:      *statsPath,
+			summaryOnly:    *summaryOnly,
+			ordered:        *ordered,
+			failFast:       *failFast,
+		}, baseOpts)
+		if code != 0 {
+			exit(code)
+		}
+		return
+	}
+
+	// A single file cropped to standard output, no directories are involved
+	if *toStdout {
+		if info, err := os.Stat(*inputDir); err != nil || !info.Mode().IsRegular() {
+			fmt.Println("Error: --stdout requires --input to be a single image file")
+			flag.Usage()
+			exit(1)
+		}
+		opts := baseOpts
+		if maskIsDir {
+			opts.MaskPath = findMask(*maskPath, filepath.Base(*inputDir))
+		}
+		if err := runStdout(*inputDir, imageOut, opts); err != nil {
+			fmt.Printf("Error processing %s: %v\n", *inputDir, err)
+			exit(1)
+		}
+		return
+	}
+
+	// Check if input exists. A single file is cropped on its own, into
+	// --output as a file unless that names a directory.
+	inputInfo, err := os.Stat(*inputDir)
+	if os.IsNotExist(err) {
+		fmt.Printf("Error: Input '%s' does not exist\n", *inputDir)
+		exit(1)
+	}
+	singleFile := err == nil && inputInfo.Mode().IsRegular()
+	outputRoot, singleOutput := *outputDir, ""
+	if singleFile {
+		if globs != nil {
+			fmt.Println("Error: --glob requires --input to be a directory")
+			flag.Usage()
+			exit(1)
+		}
+		outputRoot, singleOutput, err = resolveSingleOutput(*inputDir, *outputDir, explicitFlags["output"])
+		if err != nil {
+			fmt.Printf("Error: --output: %v\n", err)
+			exit(1)
+		}
+		if singleOutput != "" && *removeBackground != "" && !strings.EqualFold(filepath.Ext(singleOutput), ".png") {
+			fmt.Println("Error: --output must name a .png file with --remove-background, which writes PNG output")
+			flag.Usage()
+			exit(1)
+		}
+		if singleOutput != "" && *bucketOutput {
+			fmt.Println("Error: --bucket-output requires --output to be a directory")
+			flag.Usage()
+			exit(1)
+		}
+		if singleOutput != "" && strings.EqualFold(filepath.Ext(*inputDir), pdfExtension) && cropper.DefaultPDFRasterizer != nil {
+			fmt.Println("Error: --output must be a directory for PDF input, which can have several pages (end it with / to create one)")
+			flag.Usage()
+			exit(1)
+		}
+	} else if sameDir, err := isSameDir(*inputDir, *outputDir); err != nil {
+		// Refuse to write into the input directory; outputs and temp files
+		// would collide with the originals and be picked up again on the next run
+		fmt.Printf("Error resolving directories: %v\n", err)
+		exit(1)
+	} else if sameDir {
+		fmt.Println("Error: --output must be different from --input")
+		exit(1)
+	}
+
+	// Backups must not land where they would be walked as input or mixed
+	// with outputs
+	if *backupDir != "" {
+		for _, dir := range []string{*inputDir, outputRoot} {
+			if singleFile && dir == *inputDir {
+				continue
+			}
+			if sameDir, err := isSameDir(dir, *backupDir); err != nil {
+				fmt.Printf("Error resolving directories: %v\n", err)
+				exit(1)
+			} else if sameDir {
+				fmt.Println("Error: --backup must be different from --input and --output")
+				exit(1)
+			}
+		}
+	}
+
+	// Sweeps and analysis only analyze, previews only write to the preview
+	// directory
+	writesOutput := sweepTolerances == nil && !*analyzeOnly && !*emitGeometry
+	if *previewDir != "" && writesOutput {
+		if err := os.MkdirAll(*previewDir, 0755); err != nil {
+			fmt.Printf("Error creating preview directory: %v\n", err)
+			exit(1)
+		}
+	} else if writesOutput {
+		// Create output directory if it doesn't exist
+		if err := os.MkdirAll(outputRoot, 0755); err != nil {
+			fmt.Printf("Error creating output directory: %v\n", err)
+			exit(1)
+		}
+
+		// Create bucket subdirectories up front so workers only rename into them
+		if *bucketOutput {
+			buckets := []string{"cropped", "unchanged", "errors"}
+			if *devignette {
+				buckets = append(buckets, "corrected")
+			}
+			for _, bucket := range buckets {
+				if err := os.MkdirAll(filepath.Join(outputRoot, bucket), 0755); err != nil {
+					fmt.Printf("Error creating output directory: %v\n", err)
+					exit(1)
+				}
+			}
+		}
+	}
+
+	// Brightness maps are written in dry-run previews too
+	if *debugBrightnessDir != "" && writesOutput {
+		if err := os.MkdirAll(*debugBrightnessDir, 0755); err != nil {
+			fmt.Printf("Error creating brightness map directory: %v\n", err)
+			exit(1)
+		}
+	}
+
+	// Collect all image files first. PDFs become one job per page, rasterized
+	// into a temporary directory that is removed once processing is done.
+	var jobs []job
+	skippedCount := 0
+	hiddenCount := 0
+	matchedCount, unmatchedCount := 0, 0
+	var pdfDir string
+	cleanup := func() {
+		if pdfDir != "" {
+			os.RemoveAll(pdfDir)
+		}
+		prof.stop()
+	}
+	defer cleanup()
+	addJob := func(j job) error {
+		pages := []job{j}
+		if strings.EqualFold(filepath.Ext(j.filename), pdfExtension) && cropper.DefaultPDFRasterizer != nil {
+			if pdfDir == "" {
+				if pdfDir, err = os.MkdirTemp("", "imagecrop-pdf-"); err != nil {
+					return fmt.Errorf("failed to create directory for PDF pages: %w", err)
+				}
+			}
+			j.index = len(jobs)
+			if pages, err = expandPDF(j, *pdfDPI, pdfDir); err != nil {
+				return fmt.Errorf("%s: %w", j.inputPath, err)
+			}
+		}
+		for _, pj := range pages {
+			pj.index = len(jobs)
+			if *thumbnail > 0 {
+				pj.opts.ThumbnailPath = pj.thumbnailPath()
+			}
+			if *debugBrightnessDir != "" {
+				pj.opts.BrightnessMapPath = pj.brightnessMapPath(*debugBrightnessDir)
+			}
+			jobs = append(jobs, pj)
+		}
+		return nil
+	}
+	if singleFile {
+		opts := baseOpts
+		if maskIsDir {
+			opts.MaskPath = findMask(*maskPath, filepath.Base(*inputDir))
+		}
+		j := job{
+			inputPath:  *inputDir,
+			filename:   filepath.Base(*inputDir),
+			outputDir:  outputRoot,
+			outputPath: singleOutput,
+			opts:       opts,
+		}
+		if *backupDir != "" {
+			j.backupPath = filepath.Join(*backupDir, j.filename)
+		}
+		if *filenameOverrides {
+			j.outputName, err = applyFilenameOverrides(j.filename, &j.opts, maxTolerance)
+			if err != nil {
+				fmt.Printf("Error: invalid filename override in %s: %v\n", *inputDir, err)
+				cleanup()
+				os.Exit(1)
+			}
+		}
+		if err := addJob(j); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			cleanup()
+			os.Exit(1)
+		}
+	} else {
+		// Directories this run writes to may sit inside the input, like the
+		// default cropped directory with --input .; walking them would pick
+		// up the outputs of earlier runs as new inputs
+		writeDirs := []string{outputRoot, *backupDir, *previewDir}
+
+		err = filepath.WalkDir(*inputDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// Leftovers of earlier runs are never inputs
+			if !d.IsDir() && isOwnFile(d.Name()) {
+				return nil
+			}
+
+			// Skip hidden files and directories, such as .DS_Store.jpg or the
+			// ._ resource forks macOS leaves on shared drives. The input
+			// itself is always walked.
+			if path != *inputDir && strings.HasPrefix(d.Name(), ".") && !*includeHidden {
+				if *verbose {
+					fmt.Printf("Skipping %s: hidden\n", path)
+				}
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				hiddenCount++
+				return nil
+			}
+
+			// Skip directories and non-image files
+			if d.IsDir() {
+				if path != *inputDir {
+					if written, err := containsDir(writeDirs, path); err != nil {
+						return err
+					} else if written {
+						if *verbose {
+							fmt.Printf("Skipping %s: written by this run\n", path)
+						}
+						return filepath.SkipDir
+					}
+				}
+				return nil
+			}
+
+			ext := strings.ToLower(filepath.Ext(path))
+			if !allowedExts[ext] {
+				skippedCount++
+				if *verbose {
+					fmt.Printf("Skipping %s: extension %q not selected\n", path, filepath.Ext(path))
+				}
+				return nil
+			}
+
+			if globs != nil && !matchesGlob(d.Name(), globs) {
+				unmatchedCount++
+				if *verbose {
+					fmt.Printf("Skipping %s: no --glob pattern matches\n", path)
+				}
+				return nil
+			}
+			matchedCount++
+
+			opts := baseOpts
+			if maskIsDir {
+				opts.MaskPath = findMask(*maskPath, filepath.Base(path))
+			}
+
+			j := job{
+				inputPath: path,
+				filename:  filepath.Base(path),
+				outputDir: *outputDir,
+				opts:      opts,
+			}
+			if *backupDir != "" {
+				rel, err := filepath.Rel(*inputDir, path)
+				if err != nil {
+					return err
+				}
+				j.backupPath = filepath.Join(*backupDir, rel)
+			}
+			if *filenameOverrides {
+				j.outputName, err = applyFilenameOverrides(j.filename, &j.opts, maxTolerance)
+				if err != nil {
+					return fmt.Errorf("invalid filename override in %s: %w", path, err)
+				}
+			}
+			return addJob(j)
+		})
+		if err != nil {
+			fmt.Printf("Error walking directory: %v\n", err)
+			cleanup()
+			os.Exit(1)
+		}
+	}
+
+	if len(jobs) == 0 {
+		fmt.Println("\nNo image files found to process.")
+		if skippedCount > 0 {
+			fmt.Printf("Skipped: %d non-image files\n", skippedCount)
+		}
+		if hiddenCount > 0 {
+			fmt.Printf("Skipped: %d hidden files (use --include-hidden to process them)\n", hiddenCount)
+		}
+		if unmatchedCount > 0 {
+			fmt.Printf("Skipped: %d images not matching --glob\n", unmatchedCount)
+		}
+		return
+	}
+
+	if sweepTolerances != nil {
+		runSweep(jobs, sweepTolerances, *threads)
+		return
+	}
+
+	if *analyzeOnly {
+		if runAnalyze(jobs, *threads) > 0 {
+			cleanup()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *emitGeometry {
+		if runEmitGeometry(jobs, *threads) > 0 {
+			cleanup()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Analyze every image first and crop them all to the combined rectangle
+	if *uniformCrop != "" {
+		rect, analyzed, err := uniformCropRect(jobs, *threads, *uniformCrop)
+		if err != nil {
+			fmt.Printf("Error: --uniform-crop: %v\n", err)
+			cleanup()
+			os.Exit(1)
+		}
+		fmt.Printf("Uniform crop (%s of %d images): %dx%d at %d,%d\n", *uniformCrop, analyzed, rect.Dx(), rect.Dy(), rect.Min.X, rect.Min.Y)
+		for i := range jobs {
+			jobs[i].opts.FixedRect = &rect
+		}
+	}
+
+	if !*summaryOnly {
+		fmt.Printf("Found %d images to process using %d threads...\n\n", len(jobs), *threads)
+	}
+
+	// Open the progress event stream
+	var events *eventWriter
+	if *eventsPath != "" {
+		events, err = newEventWriter(*eventsPath)
+		if err != nil {
+			fmt.Printf("Error opening events file: %v\n", err)
+			cleanup()
+			os.Exit(1)
+		}
+		events.start(len(jobs), *threads)
+	}
+
+	// Serve metrics for scrapers while the run lasts
+	var runMetrics *metrics
+	if *metricsAddr != "" {
+		runMetrics = newMetrics()
+		if err := serveMetrics(*metricsAddr, runMetrics); err != nil {
+			fmt.Printf("Error starting metrics server: %v\n", err)
+			cleanup()
+			os.Exit(1)
+		}
+	}
+
+	var workerReport *parallelism
+	if *parallelismReport {
+		workerReport = newParallelism(*threads)
+	}
+
+	// Ctrl-C or SIGTERM stops submitting files; those being processed finish
+	// and are moved into place, so no temp files or partial outputs are left.
+	// A second signal kills the process as usual.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		fmt.Println("\nInterrupted, finishing files in progress (interrupt again to abort)")
+		cancel()
+	}()
+
+	s := processJobs(ctx, jobs, processConfig{
+		threads:        *threads,
+		writeThreads:   *writeThreads,
+		template:       nameTemplate,
+		bucketOutput:   *bucketOutput,
+		trustExtension: *trustExtension,
+		previewDir:     *previewDir,
+		previewStyle:   &previewStyle,
+		summaryOnly:    *summaryOnly,
+		verbose:        *verbose,
+		ordered:        *ordered,
+		failFast:       *failFast,
+		events:         events,
+		metrics:        runMetrics,
+		parallelism:    workerReport,
+	})
+
+	if *reportPath != "" {
+		if err := writeReport(*reportPath, reportEntries(s.results)); err != nil {
+			fmt.Printf("Error writing report: %v\n", err)
+		}
+	}
+	if *statsPath != "" {
+		if err := writeStats(*statsPath, s.results); err != nil {
+			fmt.Printf("Error writing stats: %v\n", err)
+		}
+	}
+
+	if *errorList != "" {
+		if err := writeErrorList(*errorList, s.failed); err != nil {
+			fmt.Printf("Error writing error list: %v\n", err)
+		}
+	}
+
+	if *bucketOutput && len(s.failed) > 0 {
+		if err := writeErrorListing(filepath.Join(outputRoot, "errors", "errors.txt"), s.failed); err != nil {
+			fmt.Printf("Error writing error listing: %v\n", err)
+		}
+	}
+
+	if *contactSheet != "" {
+		sheets, err := cropper.WriteContactSheets(*contactSheet, contactSheetEntries(s.results), *contactSheetColumns, *contactSheetCell)
+		if err != nil {
+			fmt.Printf("Error writing contact sheet: %v\n", err)
+		}
+		for _, sheet := range sheets {
+			fmt.Printf("Contact sheet: %s\n", sheet)
+		}
+	}
+
+	// Print summary
+	fmt.Printf("\nProcessing complete!\n")
+	fmt.Printf("Successfully processed: %d files\n", s.processed)
+	fmt.Printf("  Cropped: %d files\n", s.cropped)
+	if s.corrected > 0 {
+		fmt.Printf("  Corrected: %d files\n", s.corrected)
+	}
+	fmt.Printf("  Unchanged: %d files\n", s.unchanged)
+	if s.larger > 0 {
+		fmt.Printf("    Kept original, crop was larger: %d files\n", s.larger)
+	}
+	if *previewDir == "" && s.processed > 0 {
+		fmt.Printf("Bytes saved: %s\n", formatByteSize(s.bytesSaved))
+	}
+	if skippedCount > 0 {
+		fmt.Printf("Skipped: %d non-image files\n", skippedCount)
+	}
+	if hiddenCount > 0 {
+		fmt.Printf("Skipped: %d hidden files\n", hiddenCount)
+	}
+	if globs != nil {
+		fmt.Printf("Matched --glob: %d images, %d skipped\n", matchedCount, unmatchedCount)
+	}
+	if s.mislabeled > 0 {
+		fmt.Printf("Mislabeled: %d files whose extension does not match their content\n", s.mislabeled)
+	}
+	if s.errors > 0 {
+		fmt.Printf("Errors encountered: %d files\n", s.errors)
+	}
+	if rectCache != nil {
+		hits, misses := rectCache.Stats()
+		fmt.Printf("Cache: %d hits, %d misses\n", hits, misses)
+	}
+	if workerReport != nil {
+		workerReport.print(s.elapsed)
+	}
+
+	events.summary(summaryEvent{
+		Processed: s.processed,
+		Cropped:   s.cropped,
+		Corrected: s.corrected,
+		Unchanged: s.unchanged,
+		Skipped:   skippedCount,
+		Errors:    s.errors,
+	})
+
+	if s.interrupted {
+		fmt.Printf("\nInterrupted, %d files not processed\n", len(jobs)-len(s.results))
+		cleanup()
+		os.Exit(130)
+	}
+
+	if s.firstFailure != nil {
+		fmt.Printf("\nStopped after %s failed (--fail-fast), %d files not processed\n", s.firstFailure.filename, len(jobs)-len(s.results))
+		cleanup()
+		os.Exit(1)
+	}
+
+	// Previews are not crops, there is nothing to verify
+	if *verify && *previewDir == "" {
+		fmt.Println()
+		if runVerify(reportEntries(s.results)) > 0 {
+			cleanup()
+			os.Exit(1)
+		}
+	}
+}
+
+// finishJob moves a job's temporary output to its final name, the job's
+// literal output path or one derived from the template, with the extension
+// corrected to the content unless trusted, and sorted into a bucket when
+// requested, and converts the outcome into a result. Previews are written in
+// place and not moved.
+func finishJob(j job, pr cropper.JobResult, cfg processConfig) result {
+	r := result{
+		index:      j.index,
+		filename:   j.filename,
+		inputPath:  j.inputPath,
+		sourcePath: j.sourcePath,
+	}
+	if pr.Err != nil {
+		r.message = pr.Err.Error()
+		return r
+	}
+	cropResult := pr.Result
+
+	// Determine final output path based on whether image was cropped. A
+	// literal output file of a single-file run is used as given.
+	outputPath := pr.Job.OutputPath
+	if pr.Job.Preview == nil {
+		if j.outputPath != "" {
+			outputPath = j.outputPath
+		} else {
+			name := j.filename
+			if j.outputName != "" {
+				name = j.outputName
+			}
+			if !cfg.trustExtension {
+				name = cropper.CorrectExtension(name, cropResult.Format)
+			}
+			if j.opts.BackgroundKey != nil {
+				name = cropper.CorrectExtension(name, "png")
+			}
+			outputPath = cfg.template.expand(name, cropResult, cropResult.CropRect.Size(), time.Now())
+			if cfg.bucketOutput {
+				if cropResult.WasCropped {
+					outputPath = filepath.Join("cropped", outputPath)
+				} else if cropResult.Corrected {
+					outputPath = filepath.Join("corrected", outputPath)
+				} else {
+					outputPath = filepath.Join("unchanged", outputPath)
+				}
+			}
+			outputPath = filepath.Join(j.outputDir, outputPath)
+		}
+
+		// Rename temp file to final output path
+		if err := os.Rename(pr.Job.OutputPath, outputPath); err != nil {
+			os.Remove(pr.Job.OutputPath) // Clean up temp file
+			r.message = err.Error()
+			return r
+		}
+
+		// Savings are measured on the file actually written
+		if in, err := os.Stat(j.inputPath); err == nil {
+			if out, err := os.Stat(outputPath); err == nil {
+				r.inputSize, r.outputSize = in.Size(), out.Size()
+			}
+		}
+	}
+
+	r.outputPath = outputPath
+	r.success = true
+	r.wasCropped = cropResult.WasCropped
+	r.corrected = cropResult.Corrected
+	r.message = cropResult.Message
+	r.unchangedReason = cropResult.UnchangedReason
+	r.originalSize = cropResult.OriginalSize
+	r.cropRect = cropResult.CropRect
+	r.confidence = cropResult.Confidence
+	r.tolerance = cropResult.Tolerance
+	r.stopCondition = cropResult.StopCondition
+	r.stats = cropResult.Stats
+	r.mislabeled = cropper.ExtensionMismatch(j.filename, cropResult.Format)
+	return r
+}
+
+// parseHexColor parses an RRGGBB hex color, with or without a leading '#'
+func parseHexColor(s string) (color.Color, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return nil, fmt.Errorf("expected RRGGBB but got %q", s)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex color %q", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+}
+
+// parseLumaWeights parses "r,g,b" luminance weights and normalizes them to
+// sum to 1 so brightness stays on the 0-255 scale
+func parseLumaWeights(s string) (cropper.LumaWeights, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return cropper.LumaWeights{}, fmt.Errorf("expected r,g,b but got %q", s)
+	}
+
+	var weights [3]float64
+	sum := 0.0
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return cropper.LumaWeights{}, fmt.Errorf("invalid weight %q", part)
+		}
+		if value < 0 {
+			return cropper.LumaWeights{}, fmt.Errorf("weight %g must not be negative", value)
+		}
+		weights[i] = value
+		sum += value
+	}
+	if sum == 0 {
+		return cropper.LumaWeights{}, fmt.Errorf("weights must not all be zero")
+	}
+	return cropper.LumaWeights{R: weights[0] / sum, G: weights[1] / sum, B: weights[2] / sum}, nil
+}
+
+// parseReferencePoint parses a normalized "x,y" point with both values in [0, 1]
+func parseReferencePoint(s string) (*cropper.ReferencePoint, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected x,y but got %q", s)
+	}
+
+	var coords [2]float64
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid coordinate %q", part)
+		}
+		if value < 0 || value > 1 {
+			return nil, fmt.Errorf("coordinate %g must be between 0 and 1", value)
+		}
+		coords[i] = value
+	}
+	return &cropper.ReferencePoint{X: coords[0], Y: coords[1]}, nil
+}
+
+// parseMargin parses a margin given in pixels ("12") or as a percentage of
+// each dimension ("2%")
+func parseMargin(s string) (int, float64, error) {
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		value, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid percentage %q", s)
+		}
+		if value < 0 || value > 50 {
+			return 0, 0, fmt.Errorf("percentage %g must be between 0 and 50", value)
+		}
+		return 0, value, nil
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, 0, fmt.Errorf("expected pixels or a percentage but got %q", s)
+	}
+	if value < 0 {
+		return 0, 0, fmt.Errorf("pixels %d must not be negative", value)
+	}
+	return value, 0, nil
+}
+
+// parseSafeArea parses safe area insets in CSS order, "top,right,bottom,left",
+// or a single inset for every edge. Each is in pixels or a percentage as
+// accepted by parseMargin.
+func parseSafeArea(s string) (*cropper.SafeArea, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 1 && len(parts) != 4 {
+		return nil, fmt.Errorf("expected one inset or top,right,bottom,left but got %q", s)
+	}
+
+	insets := make([]cropper.Inset, len(parts))
+	for i, part := range parts {
+		pixels, percent, err := parseMargin(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		insets[i] = cropper.Inset{Pixels: pixels, Percent: percent}
+	}
+	if len(insets) == 1 {
+		return &cropper.SafeArea{Top: insets[0], Right: insets[0], Bottom: insets[0], Left: insets[0]}, nil
+	}
+	area := &cropper.SafeArea{Top: insets[0], Right: insets[1], Bottom: insets[2], Left: insets[3]}
+	if area.Top.Percent+area.Bottom.Percent >= 100 || area.Left.Percent+area.Right.Percent >= 100 {
+		return nil, fmt.Errorf("opposite insets leave no safe area")
+	}
+	return area, nil
+}
+
+// parseManualCrop parses the pixels to remove from each edge, given as
+// "top,bottom,left,right"
+func parseManualCrop(s string) (*cropper.ManualCrop, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("expected top,bottom,left,right but got %q", s)
+	}
+
+	var pixels [4]int
+	for i, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pixel count %q", part)
+		}
+		if value < 0 {
+			return nil, fmt.Errorf("pixel count %d must not be negative", value)
+		}
+		pixels[i] = value
+	}
+	return &cropper.ManualCrop{Top: pixels[0], Bottom: pixels[1], Left: pixels[2], Right: pixels[3]}, nil
+}
+
+// formatByteSize formats a byte count for people, in bytes below a kilobyte
+// and otherwise with one decimal in KB, MB or GB of 1024. Negative counts
+// keep their sign.
+func formatByteSize(n int64) string {
+	size := math.Abs(float64(n))
+	sign := ""
+	if n < 0 {
+		sign = "-"
+	}
+	if size < 1<<10 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	units := []string{"KB", "MB", "GB"}
+	unit := 0
+	size /= 1 << 10
+	for size >= 1<<10 && unit < len(units)-1 {
+		size /= 1 << 10
+		unit++
+	}
+	return fmt.Sprintf("%s%.1f %s", sign, size, units[unit])
+}
+
+// parseByteSize parses a size in bytes ("500000") or with a KB or MB suffix
+// ("500KB", "2MB"), where a kilobyte is 1024 bytes
+func parseByteSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			value, multiplier = strings.TrimSpace(number), m
+			break
+		}
+	}
+	value = strings.TrimSuffix(value, "B")
+
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("expected a size such as 500KB but got %q", s)
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("size %q must be positive", s)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// parseExtensions parses a comma-separated extension list, with or without
+// leading dots, into a lookup set. Extensions no decoder supports are an
+// error, as is .pdf unless pdf is set. An empty list selects every supported
+// extension.
+func parseExtensions(s string, pdf bool) (map[string]bool, error) {
+	names := cropper.SupportedExtensions()
+	if pdf {
+		names = append(names, pdfExtension)
+	}
+	supported := make(map[string]bool)
+	for _, ext := range names {
+		supported[ext] = true
+	}
+	if s == "" {
+		return supported, nil
+	}
+
+	allowed := make(map[string]bool)
+	for _, field := range strings.Split(s, ",") {
+		ext := strings.ToLower(strings.TrimSpace(field))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if !supported[ext] {
+			return nil, fmt.Errorf("unsupported extension %q (supported: %s)", field, strings.Join(names, ", "))
+		}
+		allowed[ext] = true
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("no extensions given")
+	}
+	return allowed, nil
+}
+
+// parseGlobs parses a comma-separated list of filepath.Match patterns. The
+// patterns are matched against base names, so they must not contain a path
+// separator. An empty list returns nil, selecting every file.
+func parseGlobs(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var globs []string
+	for _, field := range strings.Split(s, ",") {
+		pattern := strings.TrimSpace(field)
+		if pattern == "" {
+			continue
+		}
+		if strings.ContainsAny(pattern, "/"+string(filepath.Separator)) {
+			return nil, fmt.Errorf("pattern %q must match file names, not paths", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		globs = append(globs, pattern)
+	}
+	if len(globs) == 0 {
+		return nil, fmt.Errorf("no patterns given")
+	}
+	return globs, nil
+}
+
+// matchesGlob reports whether name matches any of the patterns
+func matchesGlob(name string, globs []string) bool {
+	for _, pattern := range globs {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// writeErrorListing writes one line per failed file with its error message
+func writeErrorListing(path string, failed []result) error {
+	var b strings.Builder
+	for _, r := range failed {
+		fmt.Fprintf(&b, "%s: %s\n", r.filename, r.message)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// writeErrorList writes the input path of every failed result to path, one
+// per line in discovery order, so the list can be fed back as input. Pages
+// are listed as their PDF, once. A run without failures writes an empty
+// list, replacing that of an earlier run.
+func writeErrorList(path string, failed []result) error {
+	sorted := slices.Clone(failed)
+	slices.SortFunc(sorted, func(a, b result) int { return a.index - b.index })
+
+	var b strings.Builder
+	listed := make(map[string]bool)
+	for _, r := range sorted {
+		p := r.inputPath
+		if r.sourcePath != "" {
+			p = r.sourcePath
+		}
+		if !listed[p] {
+			listed[p] = true
+			fmt.Fprintln(&b, p)
+		}
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// contactSheetEntries lists the output of every successful result in
+// discovery order, labeled with its file name
+func contactSheetEntries(results []result) []cropper.ContactSheetEntry {
+	ok := make([]result, 0, len(results))
+	for _, r := range results {
+		if r.success {
+			ok = append(ok, r)
+		}
+	}
+	slices.SortFunc(ok, func(a, b result) int { return a.index - b.index })
+
+	entries := make([]cropper.ContactSheetEntry, len(ok))
+	for i, r := range ok {
+		entries[i] = cropper.ContactSheetEntry{Path: r.outputPath, Label: filepath.Base(r.outputPath)}
+	}
+	return entries
+}
+
+// isOwnFile reports whether name is a file this tool leaves next to its
+// outputs, a temporary output or a .crop.json sidecar, which must not be
+// picked up as input when outputs are written inside the input directory.
+// Hidden files are skipped anyway, this also holds with --include-hidden.
+func isOwnFile(name string) bool {
+	return strings.HasPrefix(name, ".temp_") || strings.HasSuffix(name, ".crop.json")
+}
+
+// findMask returns the mask in maskDir that belongs to the named image, matched
+// by base name with any image extension. Images without a mask return "" and
+// fall back to brightness analysis.
+func findMask(maskDir, filename string) string {
+	name := strings.TrimSuffix(filename, filepath.Ext(filename))
+	for _, ext := range []string{".png", ".jpg", ".jpeg"} {
+		candidate := filepath.Join(maskDir, name+ext)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// containsDir reports whether dir is the same location as any of dirs,
+// ignoring empty entries
+func containsDir(dirs []string, dir string) (bool, error) {
+	for _, d := range dirs {
+		if d == "" {
+			continue
+		}
+		if same, err := isSameDir(d, dir); err != nil || same {
+			return same, err
+		}
+	}
+	return false, nil
+}
+
+// resolveSingleOutput decides where the output of a single input file goes.
+// An explicit --output naming an existing directory, or ending in a path
+// separator, is used as an output directory with the usual templated names,
+// as is the default output directory. Anything else is the literal output
+// file, returned with the directory it is written in.
+func resolveSingleOutput(inputPath, output string, outputSet bool) (string, string, error) {
+	if !outputSet || strings.HasSuffix(output, string(filepath.Separator)) {
+		return output, "", nil
+	}
+	if info, err := os.Stat(output); err == nil {
+		if info.IsDir() {
+			return output, "", nil
+		}
+		if inputInfo, err := os.Stat(inputPath); err == nil && os.SameFile(info, inputInfo) {
+			return "", "", fmt.Errorf("output file must be different from the input file")
+		}
+	}
+	return filepath.Dir(output), output, nil
+}
+
+// isSameDir reports whether two directory paths refer to the same location,
+// resolving relative paths and symlinks. A path that does not exist yet cannot
+// be the same as an existing one.
+func isSameDir(a, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	if absA == absB {
+		return true, nil
+	}
+
+	infoA, err := os.Stat(absA)
+	if err != nil {
+		return false, nil
+	}
+	infoB, err := os.Stat(absB)
+	if err != nil {
+		return false, nil
 	}
+	return os.SameFile(infoA, infoB), nil
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsSameDir(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "cropped")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(sub, link); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{dir, dir, true},
+		{".", dir, true},
+		{sub, "cropped", true},
+		{sub, "./cropped/", true},
+		{link, sub, true},
+		{dir, sub, false},
+		{sub, filepath.Join(dir, "missing"), false},
+		{"missing", "missing", true},
+	} {
+		got, err := isSameDir(tc.a, tc.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("isSameDir(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestContainsDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.Mkdir("cropped", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		dirs []string
+		want bool
+	}{
+		{[]string{"cropped", "", ""}, true},
+		{[]string{"", "backup", "cropped"}, true},
+		{[]string{"", "", ""}, false},
+		{[]string{"backup"}, false},
+	} {
+		got, err := containsDir(tc.dirs, filepath.Join(dir, "cropped"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("containsDir(%q) = %v, want %v", tc.dirs, got, tc.want)
+		}
+	}
+}
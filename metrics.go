@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the processing
+// duration histogram
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics holds the counters served by --metrics-addr in the Prometheus text
+// format. Updates and scrapes may run concurrently. A nil metrics discards
+// observations.
+type metrics struct {
+	processed  atomic.Int64
+	cropped    atomic.Int64
+	corrected  atomic.Int64
+	unchanged  atomic.Int64
+	errors     atomic.Int64
+	bytesSaved atomic.Int64
+
+	// durationCounts[i] counts durations in bucket i alone, the last entry
+	// those above every bound; exposition makes them cumulative
+	durationCounts []atomic.Int64
+	durationSum    atomic.Int64 // nanoseconds
+}
+
+func newMetrics() *metrics {
+	return &metrics{durationCounts: make([]atomic.Int64, len(durationBuckets)+1)}
+}
+
+// serveMetrics exposes m at /metrics on addr. The listener is opened before
+// returning so address errors are reported up front.
+func serveMetrics(addr string, m *metrics) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// observe records the outcome of one file and how long it took. Bytes saved
+// go negative when re-encoding grows a file.
+func (m *metrics) observe(r result, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	if !r.success {
+		m.errors.Add(1)
+	} else {
+		m.processed.Add(1)
+		if r.wasCropped {
+			m.cropped.Add(1)
+		} else if r.corrected {
+			m.corrected.Add(1)
+		} else {
+			m.unchanged.Add(1)
+		}
+		m.bytesSaved.Add(r.bytesSaved())
+	}
+
+	bucket := len(durationBuckets)
+	for i, bound := range durationBuckets {
+		if duration.Seconds() <= bound {
+			bucket = i
+			break
+		}
+	}
+	m.durationCounts[bucket].Add(1)
+	m.durationSum.Add(int64(duration))
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("imagecrop_images_processed_total", "Images processed successfully.", m.processed.Load())
+	counter("imagecrop_images_cropped_total", "Images written cropped.", m.cropped.Load())
+	counter("imagecrop_images_corrected_total", "Images rewritten without a crop.", m.corrected.Load())
+	counter("imagecrop_images_unchanged_total", "Images copied unchanged.", m.unchanged.Load())
+	counter("imagecrop_errors_total", "Images that failed to process.", m.errors.Load())
+	fmt.Fprintf(w, "# HELP imagecrop_bytes_saved Input bytes minus output bytes over all processed images.\n# TYPE imagecrop_bytes_saved gauge\nimagecrop_bytes_saved %d\n", m.bytesSaved.Load())
+
+	name := "imagecrop_processing_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time to process one image.\n# TYPE %s histogram\n", name, name)
+	var cumulative int64
+	for i, bound := range durationBuckets {
+		cumulative += m.durationCounts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	cumulative += m.durationCounts[len(durationBuckets)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n", name, time.Duration(m.durationSum.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// printer serializes console output from concurrent workers. In ordered mode
+// each job's lines are held back until every earlier job has finished, so the
+// log follows file-discovery order regardless of which worker finishes first.
+type printer struct {
+	mu       sync.Mutex
+	ordered  bool
+	next     int
+	pending  map[int]*strings.Builder
+	finished map[int]bool
+}
+
+// newPrinter creates a printer, buffering per job when ordered is set
+func newPrinter(ordered bool) *printer {
+	return &printer{
+		ordered:  ordered,
+		pending:  make(map[int]*strings.Builder),
+		finished: make(map[int]bool),
+	}
+}
+
+// printf writes a line belonging to the job at index
+func (p *printer) printf(index int, format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.ordered {
+		fmt.Printf(format, args...)
+		return
+	}
+
+	buf, ok := p.pending[index]
+	if !ok {
+		buf = &strings.Builder{}
+		p.pending[index] = buf
+	}
+	fmt.Fprintf(buf, format, args...)
+}
+
+// done marks the job at index as complete and flushes any buffered output
+// that is now in sequence
+func (p *printer) done(index int) {
+	if !p.ordered {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.finished[index] = true
+	for p.finished[p.next] {
+		if buf, ok := p.pending[p.next]; ok {
+			fmt.Print(buf.String())
+			delete(p.pending, p.next)
+		}
+		delete(p.finished, p.next)
+		p.next++
+	}
+}
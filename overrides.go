@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"imagecrop/cropper"
+)
+
+// overrideSeparator joins override tokens to the file name, as in
+// "photo__tol20__mc40.jpg"
+const overrideSeparator = "__"
+
+// applyFilenameOverrides reads per-file settings from the trailing tokens of
+// filename into opts and returns the name with those tokens removed. Tokens
+// are tol<n> for the tolerance and mc<n> for the max crop percentage;
+// reading stops at the first segment that is not one, so names that happen
+// to contain the separator are left alone. When a token repeats, the last
+// one wins. A tolerance token also wins over --auto-tolerance.
+func applyFilenameOverrides(filename string, opts *cropper.CropOptions, maxTolerance float64) (string, error) {
+	ext := filepath.Ext(filename)
+	parts := strings.Split(strings.TrimSuffix(filename, ext), overrideSeparator)
+
+	// The first part is the name itself and never a token
+	first := len(parts)
+	for first > 1 && isOverrideToken(parts[first-1]) {
+		first--
+	}
+
+	for _, token := range parts[first:] {
+		switch {
+		case strings.HasPrefix(token, "tol"):
+			value, _ := strconv.ParseFloat(strings.TrimPrefix(token, "tol"), 64)
+			if value > maxTolerance {
+				return "", fmt.Errorf("%s: tolerance must be between 0 and %.0f", token, maxTolerance)
+			}
+			opts.Tolerance = value
+			opts.AutoTolerance = false
+		case strings.HasPrefix(token, "mc"):
+			value, _ := strconv.ParseFloat(strings.TrimPrefix(token, "mc"), 64)
+			if value > 100 {
+				return "", fmt.Errorf("%s: max crop must be between 0 and 100", token)
+			}
+			opts.MaxCropPercent = value
+		}
+	}
+	return strings.Join(parts[:first], overrideSeparator) + ext, nil
+}
+
+// isOverrideToken reports whether s is a known prefix followed by a
+// non-negative number
+func isOverrideToken(s string) bool {
+	for _, prefix := range []string{"tol", "mc"} {
+		if value, ok := strings.CutPrefix(s, prefix); ok {
+			n, err := strconv.ParseFloat(value, 64)
+			return err == nil && n >= 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"imagecrop/cropper"
+)
+
+// workerStats is what one pool worker did during a run, for
+// --parallelism-report
+type workerStats struct {
+	files int
+	busy  time.Duration
+}
+
+// parallelism collects per-worker statistics from the results of
+// processJobs. It is only fed by the collecting loop, so needs no locking.
+type parallelism struct {
+	workers     []workerStats // indexed by cropper.JobResult.Worker
+	slowestFile string
+	slowest     time.Duration
+}
+
+// newParallelism tracks a pool of the given number of workers
+func newParallelism(workers int) *parallelism {
+	return &parallelism{workers: make([]workerStats, max(workers, 1))}
+}
+
+// observe adds a finished job to the statistics of its worker
+func (p *parallelism) observe(pr cropper.JobResult, filename string) {
+	if pr.Worker < 0 || pr.Worker >= len(p.workers) {
+		return
+	}
+	p.workers[pr.Worker].files++
+	p.workers[pr.Worker].busy += pr.WorkerTime
+	if pr.WorkerTime > p.slowest {
+		p.slowest, p.slowestFile = pr.WorkerTime, filename
+	}
+}
+
+// print writes the per-worker table: files, busy time and busy share of the
+// wall time of the run, then how far apart the busiest and idlest workers
+// were and the file that kept one worker longest
+func (p *parallelism) print(elapsed time.Duration) {
+	fmt.Printf("Parallelism: %d workers over %s\n", len(p.workers), elapsed.Round(time.Millisecond))
+	busiest, idlest := p.workers[0].busy, p.workers[0].busy
+	for i, w := range p.workers {
+		share := 0.0
+		if elapsed > 0 {
+			share = float64(w.busy) / float64(elapsed) * 100
+		}
+		fmt.Printf("  worker %d: %d files, busy %s (%.0f%%)\n", i, w.files, w.busy.Round(time.Millisecond), share)
+		busiest = max(busiest, w.busy)
+		idlest = min(idlest, w.busy)
+	}
+	fmt.Printf("  busiest worker %s, idlest %s\n", busiest.Round(time.Millisecond), idlest.Round(time.Millisecond))
+	if p.slowestFile != "" {
+		fmt.Printf("  slowest file: %s (%s)\n", p.slowestFile, p.slowest.Round(time.Millisecond))
+	}
+}
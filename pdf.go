@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"image/png"
+	"imagecrop/cropper"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pdfExtension is accepted as input when a PDF rasterizer is built in
+const pdfExtension = ".pdf"
+
+// expandPDF rasterizes the PDF of j and returns one job per page. Each page
+// is written as a PNG to tempDir and named after the PDF and page number
+// ("receipt.pdf" gives "receipt_p1.png"), which is also the name its output
+// is based on. Pages have no backup, the PDF itself is never overwritten.
+func expandPDF(j job, dpi int, tempDir string) ([]job, error) {
+	pages, err := cropper.DefaultPDFRasterizer.RasterizePDF(j.inputPath, dpi)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []job
+	for i, page := range pages {
+		pageName := func(name string) string {
+			return fmt.Sprintf("%s_p%d.png", strings.TrimSuffix(name, filepath.Ext(name)), i+1)
+		}
+
+		pj := j
+		pj.filename = pageName(j.filename)
+		pj.inputPath = filepath.Join(tempDir, fmt.Sprintf("%d_%s", j.index, pj.filename))
+		pj.backupPath = ""
+		pj.sourcePath = j.inputPath
+		if j.outputName != "" {
+			pj.outputName = pageName(j.outputName)
+		}
+
+		f, err := os.Create(pj.inputPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create page file: %w", err)
+		}
+		err = png.Encode(f, page)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to write page %d: %w", i+1, err)
+		}
+		jobs = append(jobs, pj)
+	}
+	return jobs, nil
+}
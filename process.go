@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"imagecrop/cropper"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// processConfig holds the run-wide settings of processJobs
+type processConfig struct {
+	threads        int
+	writeThreads   int
+	template       outputTemplate
+	bucketOutput   bool
+	trustExtension bool                  // keep input extensions that do not match the content
+	previewDir     string                // outline crops here instead of cropping
+	previewStyle   *cropper.PreviewStyle // used with previewDir
+	summaryOnly    bool                  // print nothing per file
+	verbose        bool
+	ordered        bool
+	failFast       bool
+	events         *eventWriter // optional
+	metrics        *metrics     // optional
+	parallelism    *parallelism // optional
+}
+
+// runSummary counts the outcomes of processJobs
+type runSummary struct {
+	processed    int
+	cropped      int
+	corrected    int // rewritten without a crop
+	unchanged    int
+	larger       int // unchanged because the crop was larger
+	mislabeled   int // extension did not match the content
+	bytesSaved   int64
+	errors       int
+	results      []result // in completion order
+	failed       []result
+	firstFailure *result // set when --fail-fast stopped the run
+	interrupted  bool    // set when ctx was canceled before every job ran
+	elapsed      time.Duration
+}
+
+// processJobs crops every job on a worker pool, moves each temporary output
+// to its final name and prints per-file progress. Canceling ctx, or with
+// failFast the first failure, stops the remaining submissions; files already
+// being processed still finish and are moved into place.
+func processJobs(ctx context.Context, jobs []job, cfg processConfig) runSummary {
+	var (
+		s     runSummary
+		out   = newPrinter(cfg.ordered) // Serializes console output
+		start = time.Now()
+	)
+
+	// Start the worker pool; workers only announce each file, the outcome is
+	// handled below as results arrive
+	pool := cropper.NewWriterPool(cfg.threads, cfg.writeThreads)
+	if !cfg.summaryOnly {
+		pool.OnStart = func(pj cropper.Job) {
+			out.printf(pj.ID, "Processing: %s\n", jobs[pj.ID].filename)
+		}
+	}
+
+	// Send jobs to workers. Each job writes to a temporary output path, or
+	// only outlines the proposed crop when previewing.
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	go func() {
+		defer pool.Close()
+		for _, j := range jobs {
+			pj := cropper.Job{
+				ID:         j.index,
+				InputPath:  j.inputPath,
+				OutputPath: filepath.Join(j.outputDir, fmt.Sprintf(".temp_%d_%s", j.index, j.filename)),
+				BackupPath: j.backupPath,
+				Opts:       j.opts,
+			}
+			if cfg.previewDir != "" {
+				nameWithoutExt := strings.TrimSuffix(j.filename, filepath.Ext(j.filename))
+				pj.OutputPath = filepath.Join(cfg.previewDir, nameWithoutExt+"_preview"+filepath.Ext(j.filename))
+				pj.Preview = cfg.previewStyle
+			}
+			if !pool.SubmitContext(ctx, pj) {
+				return
+			}
+		}
+	}()
+
+	for pr := range pool.Results() {
+		r := finishJob(jobs[pr.Job.ID], pr, cfg)
+		if r.success {
+			s.processed++
+			if r.mislabeled {
+				s.mislabeled++
+			}
+			if r.wasCropped {
+				s.cropped++
+			} else if r.corrected {
+				s.corrected++
+			} else {
+				s.unchanged++
+				if r.unchangedReason == cropper.LargerOutput {
+					s.larger++
+				}
+			}
+			s.bytesSaved += r.bytesSaved()
+			if !cfg.summaryOnly {
+				out.printf(r.index, "  %s -> %s\n", r.message, filepath.Base(r.outputPath))
+				if cfg.verbose && cfg.previewDir == "" {
+					out.printf(r.index, "  saved %s (%d -> %d bytes)\n", formatByteSize(r.bytesSaved()), r.inputSize, r.outputSize)
+				}
+				if cfg.verbose && r.stopCondition != "" {
+					out.printf(r.index, "  search stopped: %s\n", r.stopCondition)
+				}
+			}
+		} else {
+			s.errors++
+			s.failed = append(s.failed, r)
+			if pr.Err != nil {
+				out.printf(r.index, "  Error processing %s: %s\n", r.filename, r.message)
+			} else {
+				out.printf(r.index, "  Error renaming output file for %s: %s\n", r.filename, r.message)
+			}
+			if cfg.failFast && s.firstFailure == nil {
+				s.firstFailure = &r
+				cancel()
+			}
+		}
+		out.done(r.index)
+
+		cfg.events.fileDone(r)
+		cfg.metrics.observe(r, pr.Duration)
+		if cfg.parallelism != nil {
+			cfg.parallelism.observe(pr, r.filename)
+		}
+		s.results = append(s.results, r)
+	}
+	s.elapsed = time.Since(start)
+	s.interrupted = parent.Err() != nil && len(s.results) < len(jobs)
+	return s
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"imagecrop/cropper"
+)
+
+// writeTestPNG writes a w x h PNG of brightness 128 to path, with a black
+// border of the given width on every side
+func writeTestPNG(t *testing.T, path string, w, h, border int) {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	inner := image.Rect(border, border, w-border, h-border)
+	for y := range h {
+		for x := range w {
+			if image.Pt(x, y).In(inner) {
+				img.SetGray(x, y, color.Gray{128})
+			}
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testJobs makes a job for each file name in dir, writing to outputDir
+func testJobs(dir, outputDir string, names ...string) []job {
+	var jobs []job
+	for i, name := range names {
+		jobs = append(jobs, job{
+			index:     i,
+			inputPath: filepath.Join(dir, name),
+			filename:  name,
+			outputDir: outputDir,
+			opts:      cropper.CropOptions{Tolerance: 10, MaxCropPercent: 40},
+		})
+	}
+	return jobs
+}
+
+// dirNames returns the sorted names of the entries of dir
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestProcessJobs(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	writeTestPNG(t, filepath.Join(in, "bordered.png"), 120, 80, 10)
+	writeTestPNG(t, filepath.Join(in, "plain.png"), 120, 80, 0)
+	if err := os.WriteFile(filepath.Join(in, "broken.png"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := testJobs(in, out, "bordered.png", "plain.png", "broken.png")
+	s := processJobs(context.Background(), jobs, processConfig{
+		threads:        2,
+		template:       defaultOutputTemplate,
+		trustExtension: true,
+		summaryOnly:    true,
+	})
+
+	if s.processed != 2 || s.cropped != 1 || s.unchanged != 1 || s.errors != 1 {
+		t.Errorf("summary = %d processed, %d cropped, %d unchanged, %d errors, want 2, 1, 1, 1",
+			s.processed, s.cropped, s.unchanged, s.errors)
+	}
+	if len(s.results) != len(jobs) {
+		t.Errorf("got %d results, want %d", len(s.results), len(jobs))
+	}
+	if len(s.failed) != 1 || s.failed[0].filename != "broken.png" {
+		t.Errorf("failed = %v, want broken.png", s.failed)
+	}
+
+	want := []string{"bordered_cropped.png", "plain.png"}
+	if got := dirNames(t, out); !slices.Equal(got, want) {
+		t.Errorf("output directory holds %v, want %v", got, want)
+	}
+}
+
+func TestProcessJobsManyFiles(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	var names []string
+	for i := range 24 {
+		name := fmt.Sprintf("img%02d.png", i)
+		border := 0
+		if i%2 == 0 {
+			border = 8
+		}
+		writeTestPNG(t, filepath.Join(in, name), 64, 48, border)
+		names = append(names, name)
+	}
+
+	s := processJobs(context.Background(), testJobs(in, out, names...), processConfig{
+		threads:        4,
+		writeThreads:   2,
+		template:       defaultOutputTemplate,
+		trustExtension: true,
+		summaryOnly:    true,
+	})
+
+	if s.processed != 24 || s.cropped != 12 || s.unchanged != 12 || s.errors != 0 {
+		t.Errorf("summary = %d processed, %d cropped, %d unchanged, %d errors, want 24, 12, 12, 0",
+			s.processed, s.cropped, s.unchanged, s.errors)
+	}
+
+	got := dirNames(t, out)
+	if len(got) != 24 {
+		t.Errorf("output directory holds %d files, want 24: %v", len(got), got)
+	}
+	for _, name := range got {
+		if strings.HasPrefix(name, ".temp_") {
+			t.Errorf("temporary file %s left behind", name)
+		}
+	}
+	for i, name := range names {
+		want := name
+		if i%2 == 0 {
+			want = strings.TrimSuffix(name, ".png") + "_cropped.png"
+		}
+		if !slices.Contains(got, want) {
+			t.Errorf("missing output %s", want)
+		}
+	}
+}
+
+func TestProcessJobsDevignette(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	writeTestPNG(t, filepath.Join(in, "plain.png"), 120, 80, 0)
+
+	// Corners darkened to 60% of the center
+	lens := image.NewGray(image.Rect(0, 0, 120, 80))
+	for y := range 80 {
+		for x := range 120 {
+			dx, dy := (float64(x)-60)/60, (float64(y)-40)/40
+			lens.SetGray(x, y, color.Gray{uint8(200 * (1 - 0.2*(dx*dx+dy*dy)))})
+		}
+	}
+	f, err := os.Create(filepath.Join(in, "lens.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, lens); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	jobs := testJobs(in, out, "lens.png", "plain.png")
+	for i := range jobs {
+		jobs[i].opts.Devignette = true
+	}
+	s := processJobs(context.Background(), jobs, processConfig{
+		threads:        2,
+		template:       defaultOutputTemplate,
+		trustExtension: true,
+		summaryOnly:    true,
+	})
+
+	if s.processed != 2 || s.cropped != 0 || s.corrected != 1 || s.unchanged != 1 {
+		t.Errorf("summary = %d processed, %d cropped, %d corrected, %d unchanged, want 2, 0, 1, 1",
+			s.processed, s.cropped, s.corrected, s.unchanged)
+	}
+	want := []string{"lens_corrected.png", "plain.png"}
+	if got := dirNames(t, out); !slices.Equal(got, want) {
+		t.Errorf("output directory holds %v, want %v", got, want)
+	}
+	for _, e := range reportEntries(s.results) {
+		if e.File == jobs[0].inputPath && (e.Status != "corrected" || e.UnchangedReason != "") {
+			t.Errorf("lens.png reported as %s (%q), want corrected", e.Status, e.UnchangedReason)
+		}
+	}
+}
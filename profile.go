@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// profiles writes the --cpuprofile and --memprofile of a run
+type profiles struct {
+	cpu     *os.File
+	memPath string
+	stopped bool
+}
+
+// startProfiles starts CPU profiling into cpuPath and remembers memPath for
+// the heap profile written by stop. Either path may be empty.
+func startProfiles(cpuPath, memPath string) (*profiles, error) {
+	p := &profiles{memPath: memPath}
+	if cpuPath == "" {
+		return p, nil
+	}
+	f, err := os.Create(cpuPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CPU profile: %w", err)
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to start CPU profile: %w", err)
+	}
+	p.cpu = f
+	return p, nil
+}
+
+// stop flushes the CPU profile and writes the heap profile. It must run
+// before os.Exit, which skips deferred calls; later calls do nothing.
+func (p *profiles) stop() {
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+
+	if p.cpu != nil {
+		pprof.StopCPUProfile()
+		if err := p.cpu.Close(); err != nil {
+			fmt.Printf("Error writing CPU profile: %v\n", err)
+		}
+	}
+	if p.memPath != "" {
+		if err := writeHeapProfile(p.memPath); err != nil {
+			fmt.Printf("Error writing memory profile: %v\n", err)
+		}
+	}
+}
+
+// writeHeapProfile writes a heap profile to path after a garbage collection,
+// so it shows the memory still in use
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create memory profile: %w", err)
+	}
+	runtime.GC()
+	err = pprof.WriteHeapProfile(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
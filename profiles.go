@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// profile is a named set of flag values selected with --profile. Unset
+// fields leave their flag alone.
+type profile struct {
+	JPEGQuality    *int     `json:"jpeg_quality,omitempty"`
+	PNGCompression *string  `json:"png_compression,omitempty"`
+	Tolerance      *float64 `json:"tolerance,omitempty"`
+	MaxCrop        *float64 `json:"max_crop,omitempty"`
+}
+
+// builtinProfiles are available without a profiles file, which can replace
+// them by name
+var builtinProfiles = map[string]profile{
+	// Smaller files for publishing
+	"web": {
+		JPEGQuality:    ptr(82),
+		PNGCompression: ptr("best"),
+	},
+	// Near-lossless output and conservative crops for long-term storage
+	"archive": {
+		JPEGQuality: ptr(98),
+		Tolerance:   ptr(10.0),
+		MaxCrop:     ptr(15.0),
+	},
+}
+
+// ptr returns a pointer to v, for optional profile fields
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// loadProfiles returns the built-in profiles merged with those of the JSON
+// file at path, an object keyed by profile name. An empty path returns the
+// built-in profiles.
+func loadProfiles(path string) (map[string]profile, error) {
+	profiles := make(map[string]profile, len(builtinProfiles))
+	for name, p := range builtinProfiles {
+		profiles[name] = p
+	}
+	if path == "" {
+		return profiles, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles file: %w", err)
+	}
+	var custom map[string]profile
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles file: %w", err)
+	}
+	for name, p := range custom {
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+// profileNames returns the names of profiles in sorted order
+func profileNames(profiles map[string]profile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// flagValues returns the flag values p sets, keyed by flag name
+func (p profile) flagValues() map[string]string {
+	values := make(map[string]string)
+	if p.JPEGQuality != nil {
+		values["jpeg-quality"] = strconv.Itoa(*p.JPEGQuality)
+	}
+	if p.PNGCompression != nil {
+		values["png-compression"] = *p.PNGCompression
+	}
+	if p.Tolerance != nil {
+		values["tolerance"] = strconv.FormatFloat(*p.Tolerance, 'g', -1, 64)
+	}
+	if p.MaxCrop != nil {
+		values["max-crop"] = strconv.FormatFloat(*p.MaxCrop, 'g', -1, 64)
+	}
+	return values
+}
+
+// applyProfile sets the flags p defines, except those given explicitly on
+// the command line, which win. Values are validated with the flags.
+func applyProfile(p profile, explicitFlags map[string]bool) error {
+	for name, value := range p.flagValues() {
+		if explicitFlags[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("failed to set --%s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	"imagecrop/cropper"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reportEntry is one file's row in a JSON or CSV report
+type reportEntry struct {
+	File            string  `json:"file"`
+	Output          string  `json:"output,omitempty"`
+	Status          string  `json:"status"`
+	Message         string  `json:"message"`
+	UnchangedReason string  `json:"unchanged_reason,omitempty"`
+	Width           int     `json:"width,omitempty"`
+	Height          int     `json:"height,omitempty"`
+	OriginalWidth   int     `json:"original_width,omitempty"`
+	OriginalHeight  int     `json:"original_height,omitempty"`
+	Confidence      float64 `json:"confidence,omitempty"`
+	Tolerance       float64 `json:"tolerance,omitempty"`
+	Geometry        string  `json:"geometry,omitempty"`
+	StopCondition   string  `json:"stop_condition,omitempty"`
+}
+
+// newReportEntry converts a worker result into a report row
+func newReportEntry(r result) reportEntry {
+	entry := reportEntry{
+		File:            r.inputPath,
+		Output:          r.outputPath,
+		Message:         r.message,
+		UnchangedReason: string(r.unchangedReason),
+		Width:           r.cropRect.Dx(),
+		Height:          r.cropRect.Dy(),
+		OriginalWidth:   r.originalSize.X,
+		OriginalHeight:  r.originalSize.Y,
+		Confidence:      r.confidence,
+		Tolerance:       r.tolerance,
+		StopCondition:   string(r.stopCondition),
+	}
+	if r.success && !r.cropRect.Empty() {
+		entry.Geometry = cropper.Geometry(r.cropRect, image.Rectangle{Max: r.originalSize})
+	}
+	switch {
+	case !r.success:
+		entry.Status = "error"
+	case r.wasCropped:
+		entry.Status = "cropped"
+	case r.corrected:
+		entry.Status = "corrected"
+	default:
+		entry.Status = "unchanged"
+	}
+	return entry
+}
+
+// reportEntries converts results into report rows in discovery order
+func reportEntries(results []result) []reportEntry {
+	sorted := append([]result(nil), results...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].index < sorted[b].index })
+
+	entries := make([]reportEntry, len(sorted))
+	for i, r := range sorted {
+		entries[i] = newReportEntry(r)
+	}
+	return entries
+}
+
+// writeReport writes one entry per result. Paths ending in .csv produce CSV,
+// anything else JSON.
+func writeReport(path string, entries []reportEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		w := csv.NewWriter(file)
+		w.Write([]string{"file", "output", "status", "message", "unchanged_reason", "width", "height", "original_width", "original_height", "confidence", "tolerance", "geometry", "stop_condition"})
+		for _, e := range entries {
+			w.Write([]string{
+				e.File, e.Output, e.Status, e.Message, e.UnchangedReason,
+				strconv.Itoa(e.Width), strconv.Itoa(e.Height),
+				strconv.Itoa(e.OriginalWidth), strconv.Itoa(e.OriginalHeight),
+				strconv.FormatFloat(e.Confidence, 'f', 2, 64),
+				strconv.FormatFloat(e.Tolerance, 'f', -1, 64),
+				e.Geometry, e.StopCondition,
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	} else {
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			return err
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close report: %w", err)
+	}
+	return nil
+}
+
+// statsEntry is one image's entry in a --stats-json file
+type statsEntry struct {
+	File string `json:"file"`
+	*cropper.ImageStats
+}
+
+// writeStats writes the stats of every result that has them as a JSON
+// array, in discovery order. Failed files have none and are left out.
+func writeStats(path string, results []result) error {
+	sorted := append([]result(nil), results...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].index < sorted[b].index })
+
+	entries := []statsEntry{}
+	for _, r := range sorted {
+		if r.stats != nil {
+			entries = append(entries, statsEntry{File: r.inputPath, ImageStats: r.stats})
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(entries); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close stats: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"imagecrop/cropper"
+)
+
+// outputFormats are the values of --format
+var outputFormats = []string{"jpeg", "png", "gif"}
+
+// runStdout crops the image file at inputPath and writes the result, or the
+// unchanged input, to w for --stdout. The output is held in memory until
+// the crop succeeded, so a failure leaves w empty rather than holding part
+// of an image.
+func runStdout(inputPath string, w io.Writer, opts cropper.CropOptions) error {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to open input: %w", err)
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if _, err := cropper.CropImageStream(f, &buf, filepath.Base(inputPath), opts); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
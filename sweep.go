@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"imagecrop/cropper"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// parseTolerances parses a comma-separated list of tolerance values
+func parseTolerances(s string, maxTolerance float64) ([]float64, error) {
+	var tolerances []float64
+	for _, field := range strings.Split(s, ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tolerance %q", field)
+		}
+		if value < 0 || value > maxTolerance {
+			return nil, fmt.Errorf("tolerance %g must be between 0 and %.0f", value, maxTolerance)
+		}
+		tolerances = append(tolerances, value)
+	}
+	return tolerances, nil
+}
+
+// runSweep analyzes every job at each tolerance without writing output and
+// prints the average crop and how many images hit the max-crop limit
+func runSweep(jobs []job, tolerances []float64, threads int) {
+	fmt.Printf("Sweeping %d tolerances over %d images using %d threads...\n\n", len(tolerances), len(jobs), threads)
+
+	var (
+		totalCrop  = make([]float64, len(tolerances))
+		limitHits  = make([]int, len(tolerances))
+		analyzed   int
+		errorCount int
+		mu         sync.Mutex
+	)
+
+	jobChan := make(chan job, len(jobs))
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobChan {
+				results, err := cropper.SweepTolerances(j.inputPath, tolerances, j.opts)
+
+				mu.Lock()
+				if err != nil {
+					fmt.Printf("  Error analyzing %s: %v\n", j.filename, err)
+					errorCount++
+					mu.Unlock()
+					continue
+				}
+				analyzed++
+				for i, r := range results {
+					totalCrop[i] += r.CropPercent
+					if r.HitLimit {
+						limitHits[i]++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, j := range jobs {
+		jobChan <- j
+	}
+	close(jobChan)
+	wg.Wait()
+
+	fmt.Printf("%-10s %9s %14s\n", "Tolerance", "Avg crop", "Hit max-crop")
+	for i, tolerance := range tolerances {
+		avg := 0.0
+		if analyzed > 0 {
+			avg = totalCrop[i] / float64(analyzed)
+		}
+		fmt.Printf("%-10g %8.1f%% %14s\n", tolerance, avg, fmt.Sprintf("%d/%d", limitHits[i], analyzed))
+	}
+	if errorCount > 0 {
+		fmt.Printf("\nErrors encountered: %d files\n", errorCount)
+	}
+}
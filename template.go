@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"imagecrop/cropper"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultOutputTemplate reproduces the classic naming: "photo_cropped.jpg"
+// for crops, "photo_corrected.jpg" for corrected images and "photo.jpg" for
+// unchanged copies
+const defaultOutputTemplate = "{name}{cropped}{ext}"
+
+// templatePlaceholder matches one {placeholder} in an output template
+var templatePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// templatePlaceholders are the placeholders an output template may use
+var templatePlaceholders = map[string]bool{
+	"{name}":    true,
+	"{ext}":     true,
+	"{cropped}": true,
+	"{w}":       true,
+	"{h}":       true,
+	"{date}":    true,
+}
+
+// outputTemplate builds output file names from a template such as
+// "{name}-{w}x{h}{ext}"
+type outputTemplate string
+
+// parseOutputTemplate validates a template. It may only use known
+// placeholders, must end in {ext} so outputs keep an extension matching
+// their format, and must not contain path separators.
+func parseOutputTemplate(s string) (outputTemplate, error) {
+	for _, p := range templatePlaceholder.FindAllString(s, -1) {
+		if !templatePlaceholders[p] {
+			return "", fmt.Errorf("unknown placeholder %s", p)
+		}
+	}
+	if !strings.HasSuffix(s, "{ext}") {
+		return "", fmt.Errorf("template must end with {ext}")
+	}
+	if strings.ContainsAny(s, `/\`) {
+		return "", fmt.Errorf("template must not contain path separators")
+	}
+	if strings.TrimSuffix(s, "{ext}") == "" {
+		return "", fmt.Errorf("template must produce a name before {ext}")
+	}
+	return outputTemplate(s), nil
+}
+
+// expand returns the output file name for filename, given its crop result
+// and the output dimensions
+func (t outputTemplate) expand(filename string, cropResult *cropper.CropResult, size image.Point, now time.Time) string {
+	ext := filepath.Ext(filename)
+	suffix := ""
+	if cropResult.WasCropped {
+		suffix = "_cropped"
+	} else if cropResult.Corrected {
+		suffix = "_corrected"
+	}
+	return strings.NewReplacer(
+		"{name}", strings.TrimSuffix(filename, ext),
+		"{ext}", ext,
+		"{cropped}", suffix,
+		"{w}", strconv.Itoa(size.X),
+		"{h}", strconv.Itoa(size.Y),
+		"{date}", now.Format("2006-01-02"),
+	).Replace(string(t))
+}
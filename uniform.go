@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"imagecrop/cropper"
+	"sort"
+)
+
+// Ways --uniform-crop combines the crops of single images
+const (
+	uniformIntersection = "intersection"
+	uniformMedian       = "median"
+)
+
+// uniformCropRect analyzes every job and combines their crops into one
+// rectangle. The intersection removes every border found in any image; the
+// median removes the median border of each edge, so an object passing an
+// edge in a few frames does not widen the crop. All images must be the same
+// size. Images that fail analysis are left out, they fail again when
+// processed. It returns the rectangle and how many images it is based on.
+func uniformCropRect(jobs []job, threads int, method string) (image.Rectangle, int, error) {
+	var (
+		size    image.Point
+		borders []cropper.Borders
+	)
+	for i, line := range analyzeJobs(jobs, threads) {
+		if line.Error != "" {
+			continue
+		}
+		lineSize := image.Pt(line.Width, line.Height)
+		if len(borders) == 0 {
+			size = lineSize
+		} else if lineSize != size {
+			return image.Rectangle{}, 0, fmt.Errorf("%s is %dx%d, other images are %dx%d", jobs[i].filename, lineSize.X, lineSize.Y, size.X, size.Y)
+		}
+		borders = append(borders, line.Borders)
+	}
+	if len(borders) == 0 {
+		return image.Rectangle{}, 0, fmt.Errorf("no image could be analyzed")
+	}
+
+	var b cropper.Borders
+	switch method {
+	case uniformIntersection:
+		for _, e := range borders {
+			b.Top = max(b.Top, e.Top)
+			b.Bottom = max(b.Bottom, e.Bottom)
+			b.Left = max(b.Left, e.Left)
+			b.Right = max(b.Right, e.Right)
+		}
+	case uniformMedian:
+		b = cropper.Borders{
+			Top:    medianBorder(borders, func(e cropper.Borders) int { return e.Top }),
+			Bottom: medianBorder(borders, func(e cropper.Borders) int { return e.Bottom }),
+			Left:   medianBorder(borders, func(e cropper.Borders) int { return e.Left }),
+			Right:  medianBorder(borders, func(e cropper.Borders) int { return e.Right }),
+		}
+	}
+
+	rect := image.Rect(b.Left, b.Top, size.X-b.Right, size.Y-b.Bottom)
+	if rect.Empty() {
+		return image.Rectangle{}, 0, fmt.Errorf("the combined borders leave nothing of the image")
+	}
+	return rect, len(borders), nil
+}
+
+// medianBorder returns the median of one edge's border, the lower of the two
+// middle values for an even count
+func medianBorder(borders []cropper.Borders, edge func(cropper.Borders) int) int {
+	values := make([]int, len(borders))
+	for i, b := range borders {
+		values[i] = edge(b)
+	}
+	sort.Ints(values)
+	return values[(len(values)-1)/2]
+}
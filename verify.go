@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+)
+
+// verifyEntry re-decodes a reported output and checks that it is a valid
+// image whose dimensions match what the run reported
+func verifyEntry(e reportEntry) error {
+	file, err := os.Open(e.Output)
+	if err != nil {
+		return fmt.Errorf("cannot open output: %w", err)
+	}
+	defer file.Close()
+
+	// A full decode catches truncated or partially written files
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return fmt.Errorf("output is not a valid image: %w", err)
+	}
+
+	size := img.Bounds().Size()
+	if size.X <= 0 || size.Y <= 0 {
+		return fmt.Errorf("output is empty (%dx%d)", size.X, size.Y)
+	}
+	if size.X != e.Width || size.Y != e.Height {
+		return fmt.Errorf("output is %dx%d but %dx%d was reported", size.X, size.Y, e.Width, e.Height)
+	}
+
+	sameSize := size.X == e.OriginalWidth && size.Y == e.OriginalHeight
+	if e.Status == "cropped" && sameSize {
+		return fmt.Errorf("reported as cropped but has the original size %dx%d", size.X, size.Y)
+	}
+	if (e.Status == "unchanged" || e.Status == "corrected") && !sameSize {
+		return fmt.Errorf("reported as %s but is %dx%d instead of %dx%d", e.Status, size.X, size.Y, e.OriginalWidth, e.OriginalHeight)
+	}
+	return nil
+}
+
+// runVerify checks every successfully processed entry and prints each
+// mismatch. It returns the number of outputs that failed verification.
+func runVerify(entries []reportEntry) int {
+	checked := 0
+	failed := 0
+	for _, e := range entries {
+		if e.Status != "cropped" && e.Status != "corrected" && e.Status != "unchanged" {
+			continue
+		}
+		checked++
+		if err := verifyEntry(e); err != nil {
+			fmt.Printf("  Verification failed for %s: %v\n", e.Output, err)
+			failed++
+		}
+	}
+
+	fmt.Printf("Verified: %d outputs", checked)
+	if failed > 0 {
+		fmt.Printf(", %d mismatches", failed)
+	}
+	fmt.Println()
+	return failed
+}
+
+// verifyReport loads a JSON report written by --report and verifies it
+func verifyReport(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []reportEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("invalid report: %w", err)
+	}
+	return runVerify(entries), nil
+}